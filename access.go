@@ -0,0 +1,119 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// accessBatchSize is the number of ids updated per statement
+const accessBatchSize = 500
+
+// accessTracker collects the ids of assets read and writes their access
+// time to the database in batches, so reads never wait for the database.
+// An asset's access time is written at most once per granularity.
+type accessTracker struct {
+	model       AssetModel
+	granularity time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]bool
+	// written holds when the access time of an asset was last written
+	written map[string]time.Time
+}
+
+func createAccessTracker(model AssetModel, granularity time.Duration) *accessTracker {
+	return &accessTracker{
+		model:       model,
+		granularity: granularity,
+		now:         time.Now,
+		pending:     map[string]bool{},
+		written:     map[string]time.Time{},
+	}
+}
+
+// Record notes that the asset id was read.
+func (a *accessTracker) Record(id string) {
+	a.mu.Lock()
+	if last, ok := a.written[id]; !ok || a.now().Sub(last) >= a.granularity {
+		a.pending[id] = true
+	}
+	a.mu.Unlock()
+}
+
+// Flush writes the access times recorded since the last flush. Ids that
+// could not be written are kept for the next one.
+func (a *accessTracker) Flush() (written int, err error) {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = map[string]bool{}
+	now := a.now()
+	for id, last := range a.written {
+		if now.Sub(last) >= a.granularity {
+			delete(a.written, id)
+		}
+	}
+	a.mu.Unlock()
+
+	ids := make([]string, 0, len(pending))
+	for id := range pending {
+		ids = append(ids, id)
+	}
+	for len(ids) > 0 {
+		n := accessBatchSize
+		if n > len(ids) {
+			n = len(ids)
+		}
+		batch := ids[:n]
+		// Rows written within granularity, e.g. by another server, are left
+		if err = a.model.Touch(batch, now.Unix(), now.Add(-a.granularity).Unix()); err != nil {
+			break
+		}
+		a.mu.Lock()
+		for _, id := range batch {
+			a.written[id] = now
+		}
+		a.mu.Unlock()
+		written += n
+		ids = ids[n:]
+	}
+	statAdd("access.flushed", int64(written))
+
+	if len(ids) > 0 {
+		a.mu.Lock()
+		for _, id := range ids {
+			a.pending[id] = true
+		}
+		a.mu.Unlock()
+	}
+	return
+}
+
+func (a *accessTracker) Run(interval time.Duration, stop <-chan struct{}) {
+	every(interval, stop, a.flushAndLog)
+}
+
+func (a *accessTracker) flushAndLog() {
+	if _, err := a.Flush(); err != nil {
+		log.Printf("Failed to write access times: %v\n", err)
+	}
+}
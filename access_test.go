@@ -0,0 +1,108 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+type mockTouchModel struct {
+	mockModel
+	batches [][]string
+	at      int64
+	before  int64
+	fail    bool
+}
+
+func (m *mockTouchModel) Touch(ids []string, at, before int64) error {
+	if m.fail {
+		return errors.New("database is down")
+	}
+	batch := append([]string{}, ids...)
+	sort.Strings(batch)
+	m.batches = append(m.batches, batch)
+	m.at, m.before = at, before
+	return nil
+}
+
+func TestAccessTracker_Dedup(t *testing.T) {
+	model := &mockTouchModel{}
+	tracker := createAccessTracker(model, time.Hour)
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+
+	tracker.Record("a1")
+	tracker.Record("a2")
+	tracker.Record("a1")
+	written, err := tracker.Flush()
+	if err != nil || written != 2 || len(model.batches) != 1 || fmt.Sprint(model.batches[0]) != "[a1 a2]" {
+		t.Fail()
+		t.Logf("Expected one batch with both assets. Got: %v (%d, %v)", model.batches, written, err)
+	}
+	if model.at != now.Unix() || model.before != now.Add(-time.Hour).Unix() {
+		t.Fail()
+		t.Logf("Unexpected times: %d, %d", model.at, model.before)
+	}
+
+	// Within granularity reads are not written again
+	now = now.Add(30 * time.Minute)
+	tracker.Record("a1")
+	if written, _ := tracker.Flush(); written != 0 {
+		t.Fail()
+		t.Logf("Expected no write within granularity. Got: %d", written)
+	}
+	now = now.Add(time.Hour)
+	tracker.Record("a1")
+	if written, _ := tracker.Flush(); written != 1 {
+		t.Fail()
+		t.Logf("Expected a write after granularity. Got: %d", written)
+	}
+}
+
+func TestAccessTracker_Batches(t *testing.T) {
+	model := &mockTouchModel{}
+	tracker := createAccessTracker(model, time.Hour)
+	for i := 0; i < accessBatchSize+10; i++ {
+		tracker.Record(fmt.Sprintf("asset%d", i))
+	}
+	written, err := tracker.Flush()
+	if err != nil || written != accessBatchSize+10 || len(model.batches) != 2 {
+		t.Fail()
+		t.Logf("Expected two batches. Got: %d batches (%d, %v)", len(model.batches), written, err)
+	}
+}
+
+func TestAccessTracker_Retry(t *testing.T) {
+	model := &mockTouchModel{fail: true}
+	tracker := createAccessTracker(model, time.Hour)
+	tracker.Record("a1")
+	if _, err := tracker.Flush(); err == nil {
+		t.Fail()
+		t.Log("Expected the database error")
+	}
+	model.fail = false
+	if written, err := tracker.Flush(); err != nil || written != 1 {
+		t.Fail()
+		t.Logf("Expected the failed write to be retried. Got: %d, %v", written, err)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// ListedAsset is an asset in admin listings, which show its blob hash.
+type ListedAsset struct {
+	AssetBase
+	Hash string `xml:"Hash" json:"hash"`
+}
+
+type AssetList struct {
+	XMLName xml.Name      `xml:"AssetList" json:"-"`
+	Assets  []ListedAsset `xml:"AssetBase" json:"assets"`
+	// Next is the cursor of the following page, empty on the last one
+	Next string `xml:"Next,omitempty" json:"next,omitempty"`
+}
+
+// encodeCursor makes the id a listing continues after opaque to clients.
+func encodeCursor(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	id, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("invalid cursor")
+	}
+	return string(id), nil
+}
+
+// parseTime reads a unix time or an RFC 3339 time.
+func parseTime(s string) (int64, error) {
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return unix, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Unix(), nil
+}
+
+// parseAssetFilter reads the filter of an admin listing from its query.
+func parseAssetFilter(query url.Values) (filter AssetFilter, err error) {
+	if s := query.Get("type"); s != "" {
+		t, err := strconv.ParseInt(s, 10, 8)
+		if err != nil {
+			return filter, fmt.Errorf("invalid type %q", s)
+		}
+		filter.Type, filter.HasType = int8(t), true
+	}
+	if s := query.Get("flags"); s != "" {
+		// Flags without a name, like Broken, are given as a number
+		if filter.Flags, err = strconv.ParseInt(s, 10, 64); err != nil {
+			err = nil
+			filter.Flags = AssetFlagsFromString(s)
+		}
+		if filter.Flags == 0 {
+			return filter, fmt.Errorf("invalid flags %q", s)
+		}
+	}
+	filter.Creator = query.Get("creator")
+	filter.NamePrefix = query.Get("name")
+	filter.Hash = query.Get("hash")
+	times := []struct {
+		name string
+		dest *int64
+	}{
+		{"created_after", &filter.CreatedAfter},
+		{"created_before", &filter.CreatedBefore},
+		{"accessed_after", &filter.AccessedAfter},
+		{"accessed_before", &filter.AccessedBefore},
+	}
+	for _, t := range times {
+		if s := query.Get(t.name); s != "" {
+			if *t.dest, err = parseTime(s); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// parseListLimit reads the page size of a listing.
+func parseListLimit(query url.Values) (int, error) {
+	s := query.Get("limit")
+	if s == "" {
+		return defaultListLimit, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 1 || limit > maxListLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+	}
+	return limit, nil
+}
+
+// wantsJSON reports whether the client asked for JSON rather than XML.
+func wantsJSON(req *http.Request) bool {
+	if format := req.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	return strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+func (h HTTPService) adminResponse(responseData interface{}, resp http.ResponseWriter, req *http.Request) {
+	if wantsJSON(req) {
+		h.jsonResponse(responseData, resp, req)
+	} else {
+		h.xmlResponse(responseData, resp, req)
+	}
+}
+
+func (h HTTPService) listAssets(resp http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	filter, err := parseAssetFilter(query)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseListLimit(query)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	after, err := decodeCursor(query.Get("cursor"))
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	assets, err := h.service.ListAssets(filter, after, limit)
+	if err != nil {
+		http.Error(resp, "listing failed", http.StatusInternalServerError)
+		log.Printf("Failed to list assets: %v\n", err)
+		return
+	}
+	list := AssetList{Assets: make([]ListedAsset, len(assets))}
+	for i, asset := range assets {
+		list.Assets[i] = ListedAsset{AssetBase: asset, Hash: asset.Hash}
+	}
+	if len(assets) == limit {
+		list.Next = encodeCursor(assets[len(assets)-1].Id)
+	}
+	h.adminResponse(list, resp, req)
+}
+
+type SearchResults struct {
+	XMLName xml.Name       `xml:"SearchResults" json:"-"`
+	Results []SearchResult `xml:"Result" json:"results"`
+}
+
+func (h HTTPService) searchAssets(resp http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	q := SearchQuery{Text: query.Get("q")}
+	if s := query.Get("type"); s != "" {
+		t, err := strconv.ParseInt(s, 10, 8)
+		if err != nil {
+			http.Error(resp, "invalid type", http.StatusBadRequest)
+			return
+		}
+		q.Type, q.HasType = int8(t), true
+	}
+	var err error
+	if q.Limit, err = parseListLimit(query); err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s := query.Get("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil || q.Offset < 0 {
+			http.Error(resp, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	results, err := h.service.SearchAssets(q)
+	if err == errEmptyQuery {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	} else if err == ErrSearchDisabled {
+		http.Error(resp, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(resp, "search failed", http.StatusInternalServerError)
+		log.Printf("Failed to search assets for %q: %v\n", q.Text, err)
+		return
+	}
+	if results == nil {
+		results = []SearchResult{}
+	}
+	h.adminResponse(SearchResults{Results: results}, resp, req)
+}
+
+type AssetSiblings struct {
+	XMLName  xml.Name `xml:"AssetSiblings" json:"-"`
+	Id       string   `xml:"ID" json:"id"`
+	Hash     string   `xml:"Hash" json:"hash"`
+	Siblings []string `xml:"Siblings>ID" json:"siblings"`
+	Next     string   `xml:"Next,omitempty" json:"next,omitempty"`
+}
+
+// pageOfIds reads the cursor and limit of a page of asset ids.
+func pageOfIds(query url.Values) (after string, limit int, err error) {
+	if limit, err = parseListLimit(query); err != nil {
+		return
+	}
+	after, err = decodeCursor(query.Get("cursor"))
+	return
+}
+
+func (h HTTPService) getBlobInfo(resp http.ResponseWriter, req *http.Request) {
+	hash, ok := normalizeHash(mux.Vars(req)["hash"])
+	if !ok {
+		http.Error(resp, "invalid hash", http.StatusBadRequest)
+		return
+	}
+	after, limit, err := pageOfIds(req.URL.Query())
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info, err := h.service.GetBlobInfo(hash)
+	if err != nil {
+		http.Error(resp, "lookup failed", http.StatusInternalServerError)
+		log.Printf("Failed to look up blob %v: %v\n", hash, err)
+		return
+	}
+	if info.Assets, err = h.service.AssetsByHash(hash, after, limit); err != nil {
+		http.Error(resp, "lookup failed", http.StatusInternalServerError)
+		log.Printf("Failed to look up assets of blob %v: %v\n", hash, err)
+		return
+	}
+	if !info.Exists && len(info.Assets) == 0 && after == "" {
+		http.NotFound(resp, req)
+		return
+	}
+	if len(info.Assets) == limit {
+		info.Next = encodeCursor(info.Assets[limit-1])
+	}
+	if info.Assets == nil {
+		info.Assets = []string{}
+	}
+	h.adminResponse(info, resp, req)
+}
+
+func (h HTTPService) getSiblings(resp http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["asset_id"]
+	after, limit, err := pageOfIds(req.URL.Query())
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	meta, err := h.service.GetAssetMetaData(id)
+	if err != nil {
+		http.NotFound(resp, req)
+		return
+	}
+	ids, err := h.service.AssetsByHash(meta.Hash, after, limit)
+	if err != nil {
+		http.Error(resp, "lookup failed", http.StatusInternalServerError)
+		log.Printf("Failed to look up siblings of %v: %v\n", id, err)
+		return
+	}
+	siblings := AssetSiblings{Id: meta.Id, Hash: meta.Hash, Siblings: []string{}}
+	for _, sibling := range ids {
+		if sibling != meta.Id {
+			siblings.Siblings = append(siblings.Siblings, sibling)
+		}
+	}
+	if len(ids) == limit {
+		siblings.Next = encodeCursor(ids[limit-1])
+	}
+	h.adminResponse(siblings, resp, req)
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAdmin_ListAssetsPages(t *testing.T) {
+	ids := []string{}
+	cursor := ""
+	for pages := 0; pages < 5; pages++ {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/admin/assets?limit=2&cursor="+cursor, nil)
+		httpTestServiceInstance.AdminRouter().ServeHTTP(recorder, request)
+		var list AssetList
+		if err := xml.Unmarshal(recorder.Body.Bytes(), &list); err != nil {
+			t.Fatalf("Failed to decode listing: %v %s", err, recorder.Body)
+		}
+		for _, asset := range list.Assets {
+			ids = append(ids, asset.Id)
+			if asset.Hash != testFileDataContentHash {
+				t.Fail()
+				t.Logf("Expected the hash to be listed. Got: %q", asset.Hash)
+			}
+		}
+		if cursor = list.Next; cursor == "" {
+			break
+		}
+	}
+	if len(ids) != 3 || ids[0] != "a1" || ids[2] != "a3" {
+		t.Fail()
+		t.Logf("Expected every asset once. Got: %v", ids)
+	}
+}
+
+func TestAdmin_ListAssetsJSON(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/admin/assets?type=7", nil)
+	request.Header.Set("Accept", "application/json")
+	httpTestServiceInstance.AdminRouter().ServeHTTP(recorder, request)
+	var list struct {
+		Assets []map[string]interface{} `json:"assets"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &list); err != nil || list.Assets == nil || len(list.Assets) != 0 {
+		t.Fail()
+		t.Logf("Expected an empty JSON listing. Got: %s (%v)", recorder.Body, err)
+	}
+}
+
+func TestAdmin_ListAssetsBadRequest(t *testing.T) {
+	for _, query := range []string{"type=x", "limit=0", "limit=5000", "cursor=%25", "created_after=yesterday", "flags=none"} {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/admin/assets?"+query, nil)
+		httpTestServiceInstance.AdminRouter().ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusBadRequest {
+			t.Fail()
+			t.Logf("Expected %q to be rejected. Got: %d", query, recorder.Code)
+		}
+	}
+}
+
+func TestAdmin_SeparateRouter(t *testing.T) {
+	for _, url := range []string{"/admin/assets", "/admin/search?q=x", "/admin/blobs/" + testFileDataContentHash, "/debug/vars"} {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", url, nil)
+		httpTestServiceInstance.Router().ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusNotFound {
+			t.Fail()
+			t.Logf("Expected %v not to be served by the API router. Got: %d", url, recorder.Code)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/debug/vars", nil)
+	httpTestServiceInstance.AdminRouter().ServeHTTP(recorder, request)
+	if recorder.Code != 200 {
+		t.Fail()
+		t.Logf("Expected metrics on the admin router. Got: %d", recorder.Code)
+	}
+}
+
+func TestAdmin_ParseAssetFilter(t *testing.T) {
+	query, _ := url.ParseQuery("type=49&flags=Maptile,Collectable&creator=c1&name=Tree&created_after=2018-01-02T00:00:00Z&accessed_before=1500000000")
+	filter, err := parseAssetFilter(query)
+	if err != nil || !filter.HasType || filter.Type != 49 || filter.Flags != Maptile|Collectable ||
+		filter.Creator != "c1" || filter.NamePrefix != "Tree" || filter.CreatedAfter != 1514851200 || filter.AccessedBefore != 1500000000 {
+		t.Fail()
+		t.Logf("Unexpected filter: %+v (%v)", filter, err)
+	}
+	where, args := filter.where()
+	if where != "`type` = ? AND `asset_flags` & ? = ? AND `creator_id` = ? AND `name` LIKE ? AND `create_time` >= ? AND `access_time` <= ?" || len(args) != 7 {
+		t.Fail()
+		t.Logf("Unexpected conditions: %v %v", where, args)
+	}
+	filter = AssetFilter{NamePrefix: `50%_off\`}
+	if _, args := filter.where(); args[0] != `50\%\_off\\%` {
+		t.Fail()
+		t.Logf("Expected the name prefix to be escaped. Got: %v", args[0])
+	}
+}
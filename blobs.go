@@ -0,0 +1,139 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Formats of blobs not stored as a file of their own
+const (
+	formatChunked  = "chunked"
+	formatPacked   = "pack"
+	formatExternal = "external"
+)
+
+// normalizeHash returns hash in the upper case form blobs are addressed
+// by, ok is false if it is not a SHA-256 hash.
+func normalizeHash(hash string) (string, bool) {
+	hash = strings.ToUpper(hash)
+	_, ok := hashKey(hash)
+	return hash, ok
+}
+
+// BlobInfo describes how a blob is stored and which assets refer to it.
+type BlobInfo struct {
+	XMLName xml.Name `xml:"Blob" json:"-"`
+	Hash    string   `xml:"Hash" json:"hash"`
+	Exists  bool     `xml:"Exists" json:"exists"`
+	// Size is the size of the content, StoredSize what it takes in the
+	// store after compression and encryption
+	Size       int64  `xml:"Size" json:"size"`
+	StoredSize int64  `xml:"StoredSize" json:"storedSize"`
+	Format     string `xml:"Format" json:"format"`
+	Path       string `xml:"Path,omitempty" json:"path,omitempty"`
+	Chunks     int    `xml:"Chunks,omitempty" json:"chunks,omitempty"`
+	// MissingChunks counts the chunks of a chunked blob that are lost
+	MissingChunks int      `xml:"MissingChunks,omitempty" json:"missingChunks,omitempty"`
+	Assets        []string `xml:"Assets>ID" json:"assets"`
+	Next          string   `xml:"Next,omitempty" json:"next,omitempty"`
+}
+
+// blobInfo looks up how the blob hash is stored in store. Exists is false
+// if the blob is not found.
+func blobInfo(store AssetStore, hash string) (info BlobInfo, err error) {
+	info.Hash = hash
+	if info.Exists, err = locateBlob(store, hash, &info); err != nil {
+		return
+	}
+	if !info.Exists && store.Exists(hash) {
+		// Blobs of remote stores or the FSAssets tree
+		info.Exists, info.Format = true, formatExternal
+	}
+	if !info.Exists || info.Format == formatChunked {
+		return
+	}
+	reader, err := store.Load(hash)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	info.Size, err = io.Copy(ioutil.Discard, reader)
+	return
+}
+
+// locateBlob fills in the format and stored size of the blob hash and
+// reports whether it found the blob.
+func locateBlob(store AssetStore, hash string, info *BlobInfo) (bool, error) {
+	switch s := store.(type) {
+	case *verifyStore:
+		return locateBlob(s.AssetStore, hash, info)
+	case *chunkStore:
+		size, chunks, err := readManifest(s.manifestPath(hash))
+		if os.IsNotExist(err) {
+			return locateBlob(s.inner, hash, info)
+		}
+		if err != nil {
+			return false, err
+		}
+		info.Format, info.Size, info.Chunks = formatChunked, size, len(chunks)
+		for _, chunk := range chunks {
+			var part BlobInfo
+			found, err := locateBlob(s.inner, chunk.hash, &part)
+			if err != nil {
+				return false, err
+			}
+			if !found {
+				info.MissingChunks++
+			}
+			info.StoredSize += part.StoredSize
+		}
+		return true, nil
+	case *packStore:
+		s.mu.RLock()
+		entry, found := s.index[hash]
+		s.mu.RUnlock()
+		if !found {
+			return locateBlob(s.large, hash, info)
+		}
+		info.Format, info.StoredSize = formatPacked, int64(entry.length)
+		return true, nil
+	}
+
+	for _, disk := range localDisks(store) {
+		p, found := disk.findOwn(hash)
+		if !found {
+			continue
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return false, err
+		}
+		info.Format, info.StoredSize, info.Path = blobFormat(p), fi.Size(), p
+		if info.Format == formatRaw {
+			info.Format = "raw"
+		}
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlobs_Info(t *testing.T) {
+	packs, _, cleanup := testPackStore(t, 1<<20)
+	defer cleanup()
+	store := CreateChunkStore(ChunkOptions{
+		Dir:          path.Join(path.Dir(packs.large.(*assetStore).dataDir), "manifests"),
+		MinBlobSize:  16 << 10,
+		AvgChunkSize: 4 << 10,
+		DirMode:      0755,
+		FileMode:     0644,
+	}, packs)
+
+	small, _ := store.Store(base64Of("a small blob"))
+	medium, _ := store.Store(base64Of(strings.Repeat("a medium sized blob ", 100)))
+	large, _ := store.Store(base64.StdEncoding.EncodeToString(randomBytes(3, 64<<10)))
+
+	info, err := blobInfo(store, small)
+	if err != nil || !info.Exists || info.Format != formatPacked || info.Size != 12 || info.StoredSize == 0 {
+		t.Fail()
+		t.Logf("Unexpected info of a packed blob: %+v (%v)", info, err)
+	}
+	info, err = blobInfo(store, medium)
+	if err != nil || !info.Exists || info.Format != formatSnappy || info.Size != 2000 || info.StoredSize >= 2000 || info.Path == "" {
+		t.Fail()
+		t.Logf("Unexpected info of a blob file: %+v (%v)", info, err)
+	}
+	info, err = blobInfo(store, large)
+	if err != nil || !info.Exists || info.Format != formatChunked || info.Size != 64<<10 || info.Chunks < 2 || info.MissingChunks != 0 {
+		t.Fail()
+		t.Logf("Unexpected info of a chunked blob: %+v (%v)", info, err)
+	}
+	info, err = blobInfo(store, makeHash([]byte("never stored")))
+	if err != nil || info.Exists {
+		t.Fail()
+		t.Logf("Expected a missing blob not to exist: %+v (%v)", info, err)
+	}
+}
+
+func TestAdmin_GetBlob(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/admin/blobs/"+strings.ToLower(testFileDataContentHash)+"?format=json&limit=2", nil)
+	httpTestServiceInstance.AdminRouter().ServeHTTP(recorder, request)
+	body := recorder.Body.String()
+	if recorder.Code != 200 || !strings.Contains(body, `"assets":["`+testContentId+`","a1"]`) || !strings.Contains(body, `"next":"`) {
+		t.Fail()
+		t.Logf("Unexpected response: %d %s", recorder.Code, body)
+	}
+
+	for query, code := range map[string]int{"xyz": http.StatusBadRequest, makeHash([]byte("unknown")): http.StatusNotFound} {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/admin/blobs/"+query, nil)
+		httpTestServiceInstance.AdminRouter().ServeHTTP(recorder, request)
+		if recorder.Code != code {
+			t.Fail()
+			t.Logf("Expected %d for %v. Got: %d", code, query, recorder.Code)
+		}
+	}
+}
+
+func TestAdmin_GetSiblings(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/admin/assets/"+testContentId+"/siblings?format=json", nil)
+	httpTestServiceInstance.AdminRouter().ServeHTTP(recorder, request)
+	if body := recorder.Body.String(); recorder.Code != 200 || !strings.Contains(body, `"siblings":["a1","f1"]`) {
+		t.Fail()
+		t.Logf("Expected the other assets of the blob. Got: %d %s", recorder.Code, body)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/admin/assets/unknown/siblings", nil)
+	httpTestServiceInstance.AdminRouter().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Fail()
+		t.Logf("Expected an unknown asset not to be found. Got: %d", recorder.Code)
+	}
+}
+
+func TestHTTP_GetBlob(t *testing.T) {
+	for _, method := range []string{"GET", "HEAD"} {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, "/blobs/"+strings.ToLower(testFileDataContentHash), nil)
+		httpTestServiceInstance.Router().ServeHTTP(recorder, request)
+		expected := testFileDataContent
+		if method == "HEAD" {
+			expected = ""
+		}
+		if recorder.Code != 200 || recorder.Body.String() != expected || recorder.Header().Get("ETag") != `"`+testFileDataContentHash+`"` {
+			t.Fail()
+			t.Logf("%v: unexpected response: %d %v %q", method, recorder.Code, recorder.Header(), recorder.Body)
+		}
+
+		for hash, code := range map[string]int{"xyz": http.StatusBadRequest, makeHash([]byte("unknown")): http.StatusNotFound} {
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest(method, "/blobs/"+hash, nil)
+			httpTestServiceInstance.Router().ServeHTTP(recorder, request)
+			if recorder.Code != code {
+				t.Fail()
+				t.Logf("%v: expected %d for %v. Got: %d", method, code, hash, recorder.Code)
+			}
+		}
+	}
+}
+
+func TestHTTP_BlobsExist(t *testing.T) {
+	body := `<ArrayOfStrings><string>` + testFileDataContentHash + `</string><string>xyz</string><string>` + makeHash([]byte("unknown")) + `</string></ArrayOfStrings>`
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/blobs/exist", strings.NewReader(body))
+	httpTestServiceInstance.Router().ServeHTTP(recorder, request)
+	if !strings.Contains(recorder.Body.String(), "<boolean>true</boolean><boolean>false</boolean><boolean>false</boolean>") {
+		t.Fail()
+		t.Logf("Unexpected response: %d %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestService_BlobsExist(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+	hash, _ := store.Store(testFileDataContentB64)
+	svc := &service{model: &mockModel{}, store: store}
+	result := svc.BlobsExist([]string{strings.ToLower(hash), "abc", makeHash([]byte("unknown"))})
+	if !result[0] || result[1] || result[2] {
+		t.Fail()
+		t.Logf("Unexpected result: %v", result)
+	}
+	if _, err := svc.GetBlob("../" + hash); err != ErrInvalidHash {
+		t.Fail()
+		t.Logf("Expected an invalid hash to be refused. Got: %v", err)
+	}
+}
+
+func TestService_CreateAssetByHash(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+	hash, _ := store.Store(testFileDataContentB64)
+	model := &mockModel{}
+	temp, _ := createTemporaryStore(TemporaryOptions{MaxBytes: 1 << 20, TTL: time.Hour})
+	svc := &service{model: model, store: store, guard: &mockGuard{readOnly: true}, temporary: temp}
+
+	data := FullAssetData{BlobHash: strings.ToLower(hash)}
+	data.AssetBase = testServiceAssetInstance()
+	data.Hash = ""
+	if err := svc.CreateAsset(&data); err != nil || data.Hash != hash || model.PutCalls != 1 {
+		t.Fail()
+		t.Logf("Expected the row to be written for a stored blob. Got: %v %v", err, data.Hash)
+	}
+
+	for blobHash, expected := range map[string]error{makeHash([]byte("unknown")): ErrUnknownBlob, "abc": ErrInvalidHash} {
+		data := FullAssetData{BlobHash: blobHash}
+		data.AssetBase = testServiceAssetInstance()
+		if err := svc.CreateAsset(&data); err != expected || model.PutCalls != 1 {
+			t.Fail()
+			t.Logf("Expected %v for %v. Got: %v", expected, blobHash, err)
+		}
+	}
+
+	data = FullAssetData{BlobHash: hash}
+	data.Id, data.Temporary = "bake", true
+	if err := svc.CreateAsset(&data); err != nil {
+		t.Fail()
+		t.Logf("Expected a temporary asset to be created from a blob. Got: %v", err)
+	}
+	if _, content, ok := temp.Get("bake"); !ok || string(content) != testFileDataContent {
+		t.Fail()
+		t.Log("Expected the temporary asset to hold the blob content")
+	}
+}
+
+// slowPutModel holds Put until release is closed, with the asset only
+// referring to its blob after that.
+type slowPutModel struct {
+	mockRefModel
+	entered chan bool
+	release chan bool
+}
+
+func (m *slowPutModel) Put(asset AssetBase) error {
+	m.entered <- true
+	<-m.release
+	m.refs = append(m.refs, AssetRef{Id: asset.Id, Hash: asset.Hash})
+	return nil
+}
+
+func TestService_CreateAssetByHashDuringGC(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+	hash, _ := store.Store(testFileDataContentB64)
+	backdateFiles(t, store.dataDir)
+
+	model := &slowPutModel{entered: make(chan bool), release: make(chan bool)}
+	svc := &service{model: model, store: store}
+	created := make(chan error)
+	go func() {
+		data := FullAssetData{BlobHash: hash}
+		data.AssetBase = testServiceAssetInstance()
+		created <- svc.CreateAsset(&data)
+	}()
+
+	// The blob is confirmed but not referred to yet while GC runs
+	<-model.entered
+	gc := createGarbageCollector(model, store, GCOptions{Grace: time.Hour})
+	report, err := gc.Collect(nil)
+	close(model.release)
+	if err := <-created; err != nil {
+		t.Fatalf("Unexpected create error: %v", err)
+	}
+	if err != nil || report.Deleted != 0 || !store.Exists(hash) {
+		t.Fail()
+		t.Logf("Expected the blob of an asset being created to be kept. Got: %+v (%v)", report, err)
+	}
+}
+
+func TestHTTP_CreateUnknownBlob(t *testing.T) {
+	body := `<AssetBase><ID>c1</ID><Name>Clone</Name><Type>0</Type><Hash>` + makeHash([]byte("unknown")) + `</Hash></AssetBase>`
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/assets", strings.NewReader(body))
+	httpTestServiceInstance.Router().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnprocessableEntity || !strings.Contains(recorder.Body.String(), "upload") {
+		t.Fail()
+		t.Logf("Expected a hint to upload the data. Got: %d %s", recorder.Code, recorder.Body)
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path"
+	"strings"
+)
+
+// A chunked blob is stored as a manifest listing its chunks, which are
+// stored as blobs of their own:
+//
+//	magic "SNPCHNK1" | blob size (8) | { chunk sha256 (32) | chunk size (4) }...
+const (
+	manifestMagic     = "SNPCHNK1"
+	manifestExt       = ".manifest"
+	manifestEntrySize = sha256.Size + 4
+)
+
+// gearTable holds the random values the rolling hash of the chunker adds
+// for every byte. It is generated from a fixed seed, chunk boundaries and
+// with them deduplication depend on it staying the same.
+var gearTable = func() (table [256]uint64) {
+	seed := uint64(0x736e6170706572)
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// chunker splits data at content defined boundaries following FastCDC:
+// a gear hash is rolled over the data and a chunk ends where its top bits
+// are zero, with a stricter mask before and a looser one after the average
+// size to keep chunk sizes close to it.
+type chunker struct {
+	min, avg, max int
+	maskS, maskL  uint64
+}
+
+func newChunker(avg int) chunker {
+	n := bits.Len(uint(avg)) - 1
+	topBits := func(n int) uint64 {
+		return ^uint64(0) << uint(64-n)
+	}
+	return chunker{
+		min:   avg / 4,
+		avg:   avg,
+		max:   avg * 4,
+		maskS: topBits(n + 2),
+		maskL: topBits(n - 2),
+	}
+}
+
+// cut returns the length of the first chunk of data.
+func (c chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if normal > n {
+		normal = n
+	}
+	var h uint64
+	i := c.min
+	for ; i < normal; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// split returns the chunks of data.
+func (c chunker) split(data []byte) [][]byte {
+	chunks := [][]byte{}
+	for len(data) > 0 {
+		n := c.cut(data)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+type ChunkOptions struct {
+	// Dir holds the manifests of chunked blobs
+	Dir string
+	// Blobs of at least MinBlobSize bytes are chunked
+	MinBlobSize  int
+	AvgChunkSize int
+	DirMode      os.FileMode
+	FileMode     os.FileMode
+}
+
+type manifestChunk struct {
+	hash string
+	size uint32
+}
+
+// chunkStore stores large blobs as chunks in the inner store, so versions of
+// a blob that differ in a few places share most of their chunks. Blobs keep
+// being addressed and read by the hash of their complete content.
+type chunkStore struct {
+	ChunkOptions
+	inner   placer
+	chunker chunker
+}
+
+func CreateChunkStore(opts ChunkOptions, inner placer) *chunkStore {
+	return &chunkStore{
+		ChunkOptions: opts,
+		inner:        inner,
+		chunker:      newChunker(opts.AvgChunkSize),
+	}
+}
+
+func (c *chunkStore) manifestPath(hash string) string {
+	return path.Join(c.Dir, defaultLayout.Path(hash)) + manifestExt
+}
+
+func (c *chunkStore) placeBlob(hash string) *assetStore {
+	return c.inner.placeBlob(hash)
+}
+
+func (c *chunkStore) dataDisks() []*assetStore {
+	return c.inner.dataDisks()
+}
+
+func (c *chunkStore) Exists(hash string) bool {
+	if _, err := os.Stat(c.manifestPath(hash)); err == nil {
+		return true
+	}
+	return c.inner.Exists(hash)
+}
+
+func (c *chunkStore) Load(hash string) (io.ReadCloser, error) {
+	_, chunks, err := readManifest(c.manifestPath(hash))
+	if os.IsNotExist(err) {
+		return c.inner.Load(hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Fail before the first byte is sent rather than in the middle
+	for _, chunk := range chunks {
+		if !c.inner.Exists(chunk.hash) {
+			return nil, &os.PathError{Op: "open", Path: hash, Err: os.ErrNotExist}
+		}
+	}
+	return &chunkReader{store: c.inner, chunks: chunks}, nil
+}
+
+func (c *chunkStore) Store(data string) (string, error) {
+	buffer, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+	return c.storeBytes(buffer)
+}
+
+func (c *chunkStore) storeBytes(buffer []byte) (string, error) {
+	if len(buffer) < c.MinBlobSize {
+		return c.inner.storeBytes(buffer)
+	}
+	hash := makeHash(buffer)
+	if touchBlob(c, hash) {
+		return hash, nil
+	}
+	chunks := []manifestChunk{}
+	for _, data := range c.chunker.split(buffer) {
+		chunkHash := makeHash(data)
+		if touchBlob(c.inner, chunkHash) {
+			statAdd("chunks.dedup_bytes", int64(len(data)))
+		} else if _, err := c.inner.storeBytes(data); err != nil {
+			return hash, err
+		}
+		chunks = append(chunks, manifestChunk{hash: chunkHash, size: uint32(len(data))})
+	}
+	statAdd("chunks.blobs", 1)
+	// The chunks are complete before the manifest makes them visible
+	return hash, c.writeManifest(hash, int64(len(buffer)), chunks)
+}
+
+func (c *chunkStore) GetAsBase64(hash string) (string, error) {
+	return loadAsBase64(c, hash)
+}
+
+func (c *chunkStore) writeManifest(hash string, size int64, chunks []manifestChunk) error {
+	buf := bytes.NewBufferString(manifestMagic)
+	binary.Write(buf, binary.BigEndian, size)
+	for _, chunk := range chunks {
+		raw, _ := hex.DecodeString(chunk.hash)
+		buf.Write(raw)
+		binary.Write(buf, binary.BigEndian, chunk.size)
+	}
+
+	name := c.manifestPath(hash)
+	if err := os.MkdirAll(path.Dir(name), c.DirMode); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(path.Dir(name), path.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Chmod(c.FileMode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = commitFile(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func readManifest(name string) (int64, []manifestChunk, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	header := len(manifestMagic) + 8
+	if len(data) < header || string(data[:len(manifestMagic)]) != manifestMagic || (len(data)-header)%manifestEntrySize != 0 {
+		return 0, nil, fmt.Errorf("%v: corrupt manifest", name)
+	}
+	size := int64(binary.BigEndian.Uint64(data[len(manifestMagic):]))
+	chunks := []manifestChunk{}
+	total := int64(0)
+	for off := header; off < len(data); off += manifestEntrySize {
+		chunk := manifestChunk{
+			hash: strings.ToUpper(hex.EncodeToString(data[off : off+sha256.Size])),
+			size: binary.BigEndian.Uint32(data[off+sha256.Size:]),
+		}
+		total += int64(chunk.size)
+		chunks = append(chunks, chunk)
+	}
+	if total != size {
+		return 0, nil, fmt.Errorf("%v: chunks add up to %d bytes instead of %d", name, total, size)
+	}
+	return size, chunks, nil
+}
+
+// chunkReader streams the chunks of a blob one after the other.
+type chunkReader struct {
+	store   AssetStore
+	chunks  []manifestChunk
+	current io.ReadCloser
+	left    int64
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			reader, err := r.store.Load(r.chunks[0].hash)
+			if err != nil {
+				return 0, err
+			}
+			r.current, r.left = reader, int64(r.chunks[0].size)
+			r.chunks = r.chunks[1:]
+		}
+		n, err := r.current.Read(p)
+		r.left -= int64(n)
+		if r.left < 0 {
+			return n, fmt.Errorf("chunk larger than listed in its manifest")
+		}
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if r.left != 0 {
+				return n, io.ErrUnexpectedEOF
+			}
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
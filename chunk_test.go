@@ -0,0 +1,164 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func testChunkStore(t *testing.T) (*chunkStore, func()) {
+	inner, cleanup := testSpoolStore(t)
+	return CreateChunkStore(ChunkOptions{
+		Dir:          path.Join(path.Dir(inner.dataDir), "manifests"),
+		MinBlobSize:  16 << 10,
+		AvgChunkSize: 4 << 10,
+		DirMode:      0755,
+		FileMode:     0644,
+	}, inner), cleanup
+}
+
+func countBlobs(t *testing.T, dir string) int {
+	count := 0
+	walkBlobs(dir, func(p, hash, ext string, info os.FileInfo) error {
+		count++
+		return nil
+	})
+	return count
+}
+
+func TestChunk_Chunker(t *testing.T) {
+	c := newChunker(4 << 10)
+	data := randomBytes(1, 1<<20)
+	chunks := c.split(data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("Expected chunks to add up to the data")
+	}
+	for i, chunk := range chunks[:len(chunks)-1] {
+		if len(chunk) < c.min || len(chunk) > c.max {
+			t.Fail()
+			t.Logf("Chunk %d has size %d outside of [%d, %d]", i, len(chunk), c.min, c.max)
+		}
+	}
+	if avg := len(data) / len(chunks); avg < 2<<10 || avg > 8<<10 {
+		t.Fail()
+		t.Logf("Expected an average chunk size near 4K. Got: %d", avg)
+	}
+
+	// Inserting a few bytes only changes the chunks around them
+	edited := append(append(append([]byte{}, data[:500000]...), "edit"...), data[500000:]...)
+	known := map[string]bool{}
+	for _, chunk := range chunks {
+		known[makeHash(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range c.split(edited) {
+		if !known[makeHash(chunk)] {
+			changed++
+		}
+	}
+	if changed > 3 {
+		t.Fail()
+		t.Logf("Expected an insertion to change at most 3 chunks. Got: %d", changed)
+	}
+}
+
+func TestChunk_StoreAndLoad(t *testing.T) {
+	store, cleanup := testChunkStore(t)
+	defer cleanup()
+	inner := store.inner.(*assetStore)
+
+	data := randomBytes(2, 256<<10)
+	hash, err := store.Store(base64.StdEncoding.EncodeToString(data))
+	if err != nil || hash != makeHash(data) {
+		t.Fatalf("Unexpected store result: %v (%v)", hash, err)
+	}
+	if inner.Exists(hash) {
+		t.Fail()
+		t.Log("Expected chunked blob not to be stored as a whole")
+	}
+	chunks := countBlobs(t, inner.dataDir)
+
+	// A revision differing in a few bytes shares most chunks
+	revision := append([]byte{}, data...)
+	copy(revision[100000:], "changed")
+	store.Store(base64.StdEncoding.EncodeToString(revision))
+	if added := countBlobs(t, inner.dataDir) - chunks; added > 2 {
+		t.Fail()
+		t.Logf("Expected at most 2 new chunks for the revision. Got: %d", added)
+	}
+
+	for _, expected := range [][]byte{data, revision} {
+		if !store.Exists(makeHash(expected)) {
+			t.Fail()
+			t.Log("Expected chunked blob to exist")
+		}
+		reader, err := store.Load(makeHash(expected))
+		if err != nil {
+			t.Fatalf("Unexpected load error: %v", err)
+		}
+		loaded, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil || !bytes.Equal(loaded, expected) {
+			t.Fail()
+			t.Logf("Expected chunked blob to read back unchanged: %v", err)
+		}
+	}
+
+	// Small blobs are stored as they are
+	hash, _ = store.Store(testFileDataContentB64)
+	if _, found := inner.findOwn(hash); !found {
+		t.Fail()
+		t.Log("Expected small blob in the inner store")
+	}
+	if data, err := store.GetAsBase64(hash); err != nil || data != testFileDataContentB64 {
+		t.Fail()
+		t.Logf("Unexpected data: %v (%v)", data, err)
+	}
+}
+
+func TestChunk_MissingChunk(t *testing.T) {
+	store, cleanup := testChunkStore(t)
+	defer cleanup()
+	inner := store.inner.(*assetStore)
+
+	data := randomBytes(3, 64<<10)
+	hash, _ := store.Store(base64.StdEncoding.EncodeToString(data))
+	_, chunks, err := readManifest(store.manifestPath(hash))
+	if err != nil {
+		t.Fatalf("Unable to read manifest: %v", err)
+	}
+	p, _ := inner.findOwn(chunks[1].hash)
+	os.Remove(p)
+	if _, err := store.Load(hash); !os.IsNotExist(err) {
+		t.Fail()
+		t.Logf("Expected blob with a missing chunk not to be found. Got: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Command is a maintenance task run instead of the server, e.g.
+// snapper -datastore asset/data reshard -depth 3 -width 2
+// Commands that open -pack-dir refuse to run while a server has it open.
+type Command struct {
+	Name  string
+	Usage string
+	Run   func(config *Config, args []string) error
+}
+
+var commands = []Command{
+	{"migrate", "Apply pending database migrations", runMigrate},
+	{"reshard", "Move the data store to a new directory layout", runReshard},
+	{"rebalance", "Move blobs to the data store directory they are placed on", runRebalance},
+	{"rewrap", "Encrypt all blobs with the current encryption key", runRewrap},
+	{"compact", "Compact pack segments, only while no server uses them", runCompact},
+	{"scrub", "Check every blob file and packed blob against its hash and quarantine corrupt ones", runScrub},
+	{"fsck", "Cross-check the assets table and the store and repair what is found", runFsck},
+	{"gc", "Delete blobs no asset refers to any more", runGC},
+	{"expire", "Delete collectable assets that were not accessed for their expiry period", runExpire},
+	{"reindex", "Build the search index over the stored assets", runReindex},
+}
+
+func findCommand(name string) *Command {
+	for i := range commands {
+		if commands[i].Name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: snapper [flags] [command [command flags]]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-12s %s\n", c.Name, c.Usage)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
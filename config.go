@@ -0,0 +1,362 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+type Config struct {
+	Address      string
+	AdminAddress string
+	DataStore    string
+	SpoolStore   string
+	DirMode      os.FileMode
+	FileMode     os.FileMode
+	Layout       Layout
+
+	SpoolMaxAge        time.Duration
+	SpoolSweepInterval time.Duration
+	SpoolPromote       bool
+
+	Watermarks         Watermarks
+	SpaceCheckInterval time.Duration
+
+	StoreBackend string
+	S3           S3Options
+
+	FSAssets FSAssetsOptions
+
+	EncryptionKeys  string
+	EncryptionKeyID string
+
+	Pack                PackOptions
+	PackCompactInterval time.Duration
+
+	Chunk ChunkOptions
+
+	ColdStore    string
+	TierAfter    time.Duration
+	TierInterval time.Duration
+	TierPromote  bool
+
+	VerifyReads   bool
+	VerifyBuffer  int
+	QuarantineDir string
+
+	Scrub ScrubOptions
+
+	GC GCOptions
+
+	Expiry ExpiryOptions
+
+	AccessGranularity   time.Duration
+	AccessFlushInterval time.Duration
+
+	AutoMigrate bool
+
+	Temporary TemporaryOptions
+
+	Search bool
+
+	Uploads UploadOptions
+}
+
+// fileModeValue is a flag.Value for octal permission bits like 0755.
+type fileModeValue struct {
+	mode *os.FileMode
+}
+
+func (v fileModeValue) String() string {
+	if v.mode == nil {
+		return ""
+	}
+	return "0" + strconv.FormatUint(uint64(*v.mode), 8)
+}
+
+func (v fileModeValue) Set(s string) error {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return err
+	}
+	if mode&^uint64(os.ModePerm) != 0 {
+		return strconv.ErrRange
+	}
+	*v.mode = os.FileMode(mode)
+	return nil
+}
+
+func RegisterFlags(fs *flag.FlagSet) *Config {
+	c := &Config{
+		DirMode:  0755,
+		FileMode: 0644,
+		Layout:   defaultLayout,
+		FSAssets: FSAssetsOptions{
+			Layout: defaultFSAssetsLayout,
+		},
+		Expiry: ExpiryOptions{
+			ByType: ExpiryPeriods{},
+		},
+		Watermarks: Watermarks{
+			LowSpace:       Threshold{Percent: 10},
+			CriticalSpace:  Threshold{Percent: 2},
+			LowInodes:      Threshold{Percent: 10},
+			CriticalInodes: Threshold{Percent: 2},
+		},
+	}
+	fs.StringVar(&c.DataStore, "datastore", "asset/data", "Path to asset data store, or comma separated dir[:weight] list to spread blobs over several disks")
+	fs.StringVar(&c.SpoolStore, "spoolstore", "asset/tmp", "Path to asset temporary data store")
+	fs.StringVar(&c.Address, "address", "0.0.0.0:8003", "Address to listen to. Default: 0.0.0.0:8003")
+	fs.StringVar(&c.AdminAddress, "admin-address", "127.0.0.1:8004", "Address the unauthenticated /admin endpoints and /debug/vars metrics are served on, keep it private. Empty to disable them")
+	fs.Var(fileModeValue{&c.DirMode}, "dirmode", "Permissions for directories created in the stores")
+	fs.Var(fileModeValue{&c.FileMode}, "filemode", "Permissions for files created in the stores")
+	fs.IntVar(&c.Layout.Depth, "layout-depth", defaultLayout.Depth, "Directory levels of a new data store")
+	fs.IntVar(&c.Layout.Width, "layout-width", defaultLayout.Width, "Hash characters per directory level of a new data store")
+	fs.DurationVar(&c.SpoolMaxAge, "spool-max-age", time.Hour, "Age after which files left in the spool store are cleaned up")
+	fs.DurationVar(&c.SpoolSweepInterval, "spool-sweep-interval", time.Hour, "Interval between spool store sweeps, 0 to only sweep on startup")
+	fs.BoolVar(&c.SpoolPromote, "spool-promote", false, "Move complete spool files whose content matches their hash into the data store instead of deleting them")
+	fs.Var(&c.Watermarks.LowSpace, "low-space", "Free space below which a warning is logged, as percentage or size like 20G")
+	fs.Var(&c.Watermarks.CriticalSpace, "critical-space", "Free space below which new assets are rejected, as percentage or size like 2G")
+	fs.Var(&c.Watermarks.LowInodes, "low-inodes", "Free inodes below which a warning is logged, as percentage or count")
+	fs.Var(&c.Watermarks.CriticalInodes, "critical-inodes", "Free inodes below which new assets are rejected, as percentage or count")
+	fs.DurationVar(&c.SpaceCheckInterval, "space-check-interval", 30*time.Second, "Interval between free space checks, 0 to disable")
+	fs.StringVar(&c.StoreBackend, "store-backend", "fs", "Blob storage backend: fs or s3")
+	fs.StringVar(&c.S3.Endpoint, "s3-endpoint", "http://127.0.0.1:9000", "S3 endpoint URL")
+	fs.StringVar(&c.S3.Bucket, "s3-bucket", "assets", "S3 bucket to store blobs in")
+	fs.StringVar(&c.S3.Region, "s3-region", "us-east-1", "S3 region used for request signing")
+	fs.StringVar(&c.S3.Prefix, "s3-prefix", "", "Key prefix for blobs in the S3 bucket")
+	fs.BoolVar(&c.S3.PathStyle, "s3-path-style", true, "Address the bucket in the URL path instead of the host name")
+	fs.IntVar(&c.S3.PartSize, "s3-part-size", defaultS3PartSize, "Blobs larger than this many bytes are uploaded in parts")
+	fs.StringVar(&c.FSAssets.BaseDir, "fsassets-base", "", "OpenSimulator FSAssets base directory to serve existing assets from")
+	fs.StringVar(&c.FSAssets.SpoolDir, "fsassets-spool", "", "OpenSimulator FSAssets spool directory to drain into the data store")
+	fs.Var(&c.FSAssets.Layout, "fsassets-layout", "Comma separated directory widths of the FSAssets tree")
+	fs.BoolVar(&c.FSAssets.Adopt, "fsassets-adopt", false, "Move FSAssets blobs into the data store when they are first read")
+	fs.StringVar(&c.EncryptionKeys, "encryption-keys", "", "Key file to encrypt new blobs with, one \"id key\" line per key")
+	fs.StringVar(&c.EncryptionKeyID, "encryption-key-id", "", "Id of the key new blobs are encrypted with, default the last key of the key file")
+	fs.StringVar(&c.Pack.Dir, "pack-dir", "", "Directory to pack small blobs into segment files, empty to store every blob as a file")
+	fs.IntVar(&c.Pack.MaxBlobSize, "pack-max-blob", 4096, "Blobs up to this many bytes are packed")
+	fs.Int64Var(&c.Pack.SegmentSize, "pack-segment-size", 256<<20, "Size at which a pack segment is sealed and a new one started")
+	fs.Float64Var(&c.Pack.CompactRatio, "pack-compact-ratio", 0.5, "Share of unused space at which a pack segment is compacted")
+	fs.DurationVar(&c.PackCompactInterval, "pack-compact-interval", 24*time.Hour, "Interval between pack compactions, 0 to disable")
+	fs.StringVar(&c.Chunk.Dir, "chunk-dir", "", "Directory for manifests of blobs stored in content defined chunks, empty to disable chunking")
+	fs.IntVar(&c.Chunk.MinBlobSize, "chunk-min-blob", 256<<10, "Blobs of at least this many bytes are chunked")
+	fs.IntVar(&c.Chunk.AvgChunkSize, "chunk-avg", 64<<10, "Average chunk size in bytes")
+	fs.StringVar(&c.ColdStore, "coldstore", "", "Path to a cold data store for blobs that were not accessed for -tier-after")
+	fs.DurationVar(&c.TierAfter, "tier-after", 30*24*time.Hour, "Time without access after which blobs are moved to the cold store. The access granularity and flush interval are added to it")
+	fs.DurationVar(&c.TierInterval, "tier-interval", 6*time.Hour, "Interval between moves of blobs to the cold store, 0 to disable")
+	fs.BoolVar(&c.TierPromote, "tier-promote", true, "Move blobs read from the cold store back to the data store")
+	fs.BoolVar(&c.VerifyReads, "verify-reads", false, "Check that blobs still match their hash when they are read and quarantine corrupt ones")
+	fs.IntVar(&c.VerifyBuffer, "verify-buffer", 1<<20, "Blobs up to this many bytes are verified before the first byte is sent, larger ones fail at the end")
+	fs.StringVar(&c.QuarantineDir, "quarantine-dir", "asset/quarantine", "Directory corrupt blobs are moved to")
+	fs.StringVar(&c.Scrub.StateFile, "scrub-state", "asset/scrub-state.json", "File the progress of a scrub pass is kept in to resume it after a restart")
+	fs.StringVar(&c.Scrub.ReportFile, "scrub-report", "asset/scrub-report.json", "File the report of the last finished scrub pass is written to")
+	fs.Int64Var(&c.Scrub.Rate, "scrub-rate", 16<<20, "Bytes per second the scrubber reads at most, 0 for no limit")
+	fs.DurationVar(&c.Scrub.Interval, "scrub-interval", 0, "Interval between background scrub passes, 0 to disable")
+	fs.DurationVar(&c.GC.Interval, "gc-interval", 0, "Interval between deletions of blobs no asset refers to, 0 to disable")
+	fs.DurationVar(&c.GC.Grace, "gc-grace", 24*time.Hour, "Age below which blobs are never deleted by garbage collection")
+	fs.IntVar(&c.GC.Rate, "gc-rate", 100, "Blobs garbage collection deletes per second at most, 0 for no limit")
+	fs.DurationVar(&c.Expiry.After, "expire-after", 0, "Time without access after which collectable assets are deleted, 0 to keep them. The access granularity and flush interval are added to it")
+	fs.Var(c.Expiry.ByType, "expire-types", "Expiry periods of asset types overriding -expire-after, as in 49:24h,0:0")
+	fs.StringVar(&c.Expiry.PinnedFile, "expire-pinned", "", "File listing ids of assets that never expire, one per line")
+	fs.StringVar(&c.Expiry.AuditFile, "expire-audit", "asset/expiry-audit.log", "File a JSON record of every expired asset is appended to")
+	fs.IntVar(&c.Expiry.Batch, "expire-batch", 500, "Assets looked at per batch")
+	fs.DurationVar(&c.Expiry.Pause, "expire-pause", time.Second, "Pause between batches")
+	fs.DurationVar(&c.Expiry.Interval, "expire-interval", time.Hour, "Interval between runs of the expiry")
+	fs.DurationVar(&c.AccessGranularity, "access-granularity", 24*time.Hour, "An asset's access time is updated at most once per this period")
+	fs.DurationVar(&c.AccessFlushInterval, "access-flush-interval", time.Minute, "Interval between writes of recorded access times, 0 to not record reads")
+	fs.Var(&c.Temporary.Mode, "temporary-mode", "What to do with assets marked Temporary or Local: cache, reject or persist")
+	fs.Int64Var(&c.Temporary.MaxBytes, "temporary-max-memory", 64<<20, "Bytes of memory temporary assets may use")
+	fs.DurationVar(&c.Temporary.TTL, "temporary-ttl", time.Hour, "Time temporary assets are kept")
+	fs.StringVar(&c.Temporary.SpillDir, "temporary-spill-dir", "", "Directory temporary assets spill to when memory is full, in a snapper-temporary subdirectory, empty to drop them")
+	fs.Int64Var(&c.Temporary.SpillMaxBytes, "temporary-spill-max", 1<<30, "Bytes of temporary assets the spill directory may hold")
+	fs.BoolVar(&c.Search, "search", false, "Index new assets for /admin/search, run reindex to index existing ones. Text contents are left out with -encryption-keys")
+	fs.DurationVar(&c.Uploads.TTL, "upload-ttl", 24*time.Hour, "Time after its last write an unfinished upload session is deleted, 0 to disable upload sessions. They are disabled with -encryption-keys")
+	fs.Int64Var(&c.Uploads.MaxSize, "upload-max-size", 64<<20, "Largest asset in bytes that can be uploaded in a session. Finalizing one takes about three times as much memory, one is finalized at a time")
+	fs.IntVar(&c.Uploads.MaxSessions, "upload-max-sessions", 100, "Upload sessions that may be open at the same time")
+	fs.BoolVar(&c.AutoMigrate, "auto-migrate", false, "Apply pending database migrations on startup")
+	c.S3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	c.S3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	return c
+}
+
+func (c *Config) StoreOptions() StoreOptions {
+	opts := StoreOptions{
+		DataDir:  c.DataStore,
+		SpoolDir: c.SpoolStore,
+		DirMode:  c.DirMode,
+		FileMode: c.FileMode,
+	}
+	if c.FSAssets.BaseDir != "" || c.FSAssets.SpoolDir != "" {
+		fsassets := c.FSAssets
+		opts.FSAssets = &fsassets
+	}
+	return opts
+}
+
+// OpenStore creates the blob store selected by -store-backend.
+func (c *Config) OpenStore() (AssetStore, error) {
+	switch c.StoreBackend {
+	case "fs":
+		if err := c.Layout.Validate(); err != nil {
+			return nil, err
+		}
+		dirs, err := ParseDataDirs(c.DataStore)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := c.LoadKeys()
+		if err != nil {
+			return nil, err
+		}
+		disks := []*assetStore{}
+		weights := []float64{}
+		for i, dir := range dirs {
+			opts := c.StoreOptions()
+			opts.Keys = keys
+			if i > 0 {
+				// The FSAssets tree is served through the first disk
+				opts.FSAssets = nil
+			}
+			disk, err := c.openDataDir(opts, dir.Path)
+			if err != nil {
+				return nil, err
+			}
+			disks = append(disks, disk)
+			weights = append(weights, dir.Weight)
+		}
+		var store placer = disks[0]
+		if len(disks) > 1 {
+			store = CreateMultiStore(disks, weights)
+		}
+		if c.ColdStore == "" {
+			return store, nil
+		}
+		opts := c.StoreOptions()
+		opts.FSAssets, opts.Keys = nil, keys
+		cold, err := c.openDataDir(opts, c.ColdStore)
+		if err != nil {
+			return nil, err
+		}
+		return CreateTieredStore(store, cold, c.TierPromote), nil
+	case "s3":
+		if c.EncryptionKeys != "" {
+			// Blobs would be uploaded in plain text
+			return nil, fmt.Errorf("-encryption-keys is not supported by the s3 store backend")
+		}
+		return CreateS3Store(c.S3)
+	}
+	return nil, fmt.Errorf("unknown store backend %q", c.StoreBackend)
+}
+
+// AccessSlack is how much older the recorded access time of an asset may be
+// than its last read: it is written at most once per -access-granularity
+// and up to -access-flush-interval after the read.
+func (c *Config) AccessSlack() time.Duration {
+	return c.AccessGranularity + c.AccessFlushInterval
+}
+
+// ExpiryOptions returns the expiry options with the access slack. Expiry
+// is refused when reads are not recorded, every asset would look unused.
+func (c *Config) ExpiryOptions() (ExpiryOptions, error) {
+	if c.AccessFlushInterval == 0 {
+		return ExpiryOptions{}, fmt.Errorf("expiry needs reads to be recorded, -access-flush-interval is 0")
+	}
+	opts := c.Expiry
+	opts.Slack = c.AccessSlack()
+	return opts, nil
+}
+
+// LoadKeys reads the -encryption-keys file, nil if encryption is off.
+func (c *Config) LoadKeys() (*keyRing, error) {
+	if c.EncryptionKeys == "" {
+		return nil, nil
+	}
+	return LoadKeyFile(c.EncryptionKeys, c.EncryptionKeyID)
+}
+
+// openDataDir creates the file system store for dir in the layout recorded
+// there.
+func (c *Config) openDataDir(opts StoreOptions, dir string) (*assetStore, error) {
+	layout, previous, err := LoadLayout(dir, c.Layout, c.DirMode, c.FileMode)
+	if err != nil {
+		return nil, err
+	}
+	if layout != c.Layout {
+		log.Printf("Data store %v uses layout %v, run reshard to change it\n", dir, layout)
+	}
+	opts.DataDir = dir
+	opts.Layout, opts.PreviousLayout = layout, previous
+	return CreateAssetStore(opts).(*assetStore), nil
+}
+
+// OpenPacks puts a pack store for small blobs in front of store.
+func (c *Config) OpenPacks(store AssetStore) (*packStore, error) {
+	large, ok := store.(placer)
+	if !ok {
+		return nil, fmt.Errorf("pack files need the fs store backend")
+	}
+	keys, err := c.LoadKeys()
+	if err != nil {
+		return nil, err
+	}
+	opts := c.Pack
+	opts.DirMode, opts.FileMode, opts.Keys = c.DirMode, c.FileMode, keys
+	return OpenPackStore(opts, large)
+}
+
+// OpenChunks puts a chunk store for large blobs in front of store.
+func (c *Config) OpenChunks(store AssetStore) (*chunkStore, error) {
+	inner, ok := store.(placer)
+	if !ok {
+		return nil, fmt.Errorf("chunking needs the fs store backend")
+	}
+	if c.Chunk.AvgChunkSize < 1024 || c.Chunk.AvgChunkSize > 16<<20 {
+		return nil, fmt.Errorf("average chunk size must be between 1K and 16M")
+	}
+	opts := c.Chunk
+	opts.DirMode, opts.FileMode = c.DirMode, c.FileMode
+	return CreateChunkStore(opts, inner), nil
+}
+
+// OpenStack opens the store with the pack and chunk stores configured in
+// front of it, the way the server uses it. packs is nil without -pack-dir.
+func (c *Config) OpenStack() (store AssetStore, packs *packStore, err error) {
+	if store, err = c.OpenStore(); err != nil {
+		return
+	}
+	if c.Pack.Dir != "" {
+		if packs, err = c.OpenPacks(store); err != nil {
+			return
+		}
+		store = packs
+	}
+	if c.Chunk.Dir != "" {
+		var chunks *chunkStore
+		if chunks, err = c.OpenChunks(store); err != nil {
+			return
+		}
+		store = chunks
+	}
+	return
+}
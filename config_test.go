@@ -0,0 +1,79 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"testing"
+)
+
+func testConfig(args ...string) (*Config, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	c := RegisterFlags(fs)
+	return c, fs.Parse(args)
+}
+
+func TestConfig_Defaults(t *testing.T) {
+	c, err := testConfig()
+	if err != nil {
+		t.Fail()
+		t.Logf("Unexpected parse error: %v", err)
+	}
+	if c.DirMode != 0755 || c.FileMode != 0644 {
+		t.Fail()
+		t.Logf("Unexpected default modes: %v %v", c.DirMode, c.FileMode)
+	}
+	if c.AdminAddress != "127.0.0.1:8004" {
+		t.Fail()
+		t.Logf("Expected the admin endpoints to be served on loopback. Got: %v", c.AdminAddress)
+	}
+}
+
+func TestConfig_FileModes(t *testing.T) {
+	c, err := testConfig("-dirmode", "0750", "-filemode", "640")
+	if err != nil {
+		t.Fail()
+		t.Logf("Unexpected parse error: %v", err)
+	}
+	if c.DirMode != 0750 || c.FileMode != 0640 {
+		t.Fail()
+		t.Logf("Expected 0750 and 0640 Got: %v %v", c.DirMode, c.FileMode)
+	}
+	if _, err := testConfig("-dirmode", "0999"); err == nil {
+		t.Fail()
+		t.Log("Expected non octal mode to be rejected")
+	}
+	if _, err := testConfig("-filemode", "17777"); err == nil {
+		t.Fail()
+		t.Log("Expected mode with non permission bits to be rejected")
+	}
+}
+
+func TestConfig_S3Encryption(t *testing.T) {
+	c, err := testConfig("-store-backend", "s3", "-encryption-keys", "keys")
+	if err != nil {
+		t.Skipf("Unexpected parse error: %v", err)
+	}
+	if _, err := c.OpenStore(); err == nil {
+		t.Fail()
+		t.Log("Expected encryption keys to be rejected with the s3 backend")
+	}
+}
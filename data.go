@@ -37,23 +37,25 @@ type ArrayOfBoolean struct {
 }
 
 type AssetBase struct {
-	XMLName     xml.Name `xml:"AssetBase" db:"-"`
-	FullId      string   `xml:"FullID>Guid,omitempty" db:"-"`
-	Id          string   `xml:"ID" db:"id"`
-	Name        string   `xml:"Name" db:"name"`
-	Description string   `xml:"Description" db:"description"`
-	Flags       string   `xml:"Flags" db:"-"`
-	DBFlags     int64    `xml:"-" db:"asset_flags"`
-	Type        int8     `xml:"Type" db:"type"`
-	CreatorID   string   `xml:"CreatorID,omitempty" db:"-"`
-	Temporary   bool     `xml:"Temporary,omitempty" db:"-"`
-	Local       bool     `xml:"Local,omitempty" db:"-"`
-	AccessTime  int64    `xml:"-" db:"create_time"`
-	CreateTime  int64    `xml:"-" db:"access_time"`
-	Hash        string   `xml:"-" db:"hash"`
+	XMLName     xml.Name `xml:"AssetBase" db:"-" json:"-"`
+	FullId      string   `xml:"FullID>Guid,omitempty" db:"-" json:"-"`
+	Id          string   `xml:"ID" db:"id" json:"id"`
+	Name        string   `xml:"Name" db:"name" json:"name"`
+	Description string   `xml:"Description" db:"description" json:"description"`
+	Flags       string   `xml:"Flags" db:"-" json:"flags"`
+	DBFlags     int64    `xml:"-" db:"asset_flags" json:"-"`
+	Type        int8     `xml:"Type" db:"type" json:"type"`
+	CreatorID   string   `xml:"CreatorID,omitempty" db:"creator_id" json:"creatorId,omitempty"`
+	Temporary   bool     `xml:"Temporary,omitempty" db:"temporary" json:"temporary,omitempty"`
+	Local       bool     `xml:"Local,omitempty" db:"local" json:"local,omitempty"`
+	AccessTime  int64    `xml:"AccessTime,omitempty" db:"access_time" json:"accessTime,omitempty"`
+	CreateTime  int64    `xml:"CreateTime,omitempty" db:"create_time" json:"createTime,omitempty"`
+	Hash        string   `xml:"-" db:"hash" json:"-"`
 }
 
 type FullAssetData struct {
 	AssetBase
 	Data string `xml:"Data,omitempty" db:"-"`
+	// BlobHash creates an asset from a stored blob instead of Data
+	BlobHash string `xml:"Hash,omitempty" db:"-"`
 }
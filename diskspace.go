@@ -0,0 +1,45 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+
+package main
+
+import (
+	"syscall"
+)
+
+type DiskUsage struct {
+	FreeBytes   uint64
+	TotalBytes  uint64
+	FreeInodes  uint64
+	TotalInodes uint64
+}
+
+func diskUsage(dir string) (DiskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return DiskUsage{}, err
+	}
+	return DiskUsage{
+		FreeBytes:   uint64(st.Bavail) * uint64(st.Bsize),
+		TotalBytes:  uint64(st.Blocks) * uint64(st.Bsize),
+		FreeInodes:  uint64(st.Ffree),
+		TotalInodes: uint64(st.Files),
+	}, nil
+}
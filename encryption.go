@@ -0,0 +1,311 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Encrypted blobs start with a header naming the key they are encrypted
+// with, followed by the compressed blob split into chunks that are sealed
+// with AES-256-GCM one by one:
+//
+//	magic "SNPRENC" | version 1 | key id length | key id | salt (32) | chunk size (4)
+//
+// Every blob is sealed with its own subkey, derived from the key and the
+// random salt with HKDF-SHA256, so blobs never share a nonce stream. The
+// nonce of every chunk is the chunk counter and a flag for the last chunk,
+// so chunks cannot be reordered and truncation is detected. The header is
+// authenticated as additional data of every chunk.
+const (
+	encryptionMagic     = "SNPRENC"
+	encryptionVersion   = 1
+	encryptionChunkSize = 64 << 10
+	encryptionKeySize   = 32
+	encryptionSaltSize  = 32
+)
+
+// encryptionInfo binds derived subkeys to their use
+const encryptionInfo = "snapper blob encryption v1"
+
+var ErrBlobAuthentication = errors.New("blob failed authentication")
+
+// keyRing holds the keys blobs may be encrypted with and the one new blobs
+// are encrypted with.
+type keyRing struct {
+	keys    map[string][]byte
+	current string
+}
+
+// LoadKeyFile reads a key file with one key per line: a key id followed by
+// 32 bytes of key, hex or base64 encoded. Empty lines and lines starting
+// with # are ignored. New blobs are encrypted with current, or with the last
+// key of the file if current is empty.
+func LoadKeyFile(name, current string) (*keyRing, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	ring := &keyRing{keys: map[string][]byte{}}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) > 255 {
+			return nil, fmt.Errorf("%v:%d: expected key id and key", name, n+1)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			key, err = base64.StdEncoding.DecodeString(fields[1])
+		}
+		if err != nil || len(key) != encryptionKeySize {
+			return nil, fmt.Errorf("%v:%d: key must be %d bytes, hex or base64 encoded", name, n+1, encryptionKeySize)
+		}
+		if _, dup := ring.keys[fields[0]]; dup {
+			return nil, fmt.Errorf("%v:%d: duplicate key id %v", name, n+1, fields[0])
+		}
+		ring.keys[fields[0]] = key
+		ring.current = fields[0]
+	}
+	if current != "" {
+		ring.current = current
+	}
+	if _, ok := ring.keys[ring.current]; !ok {
+		return nil, fmt.Errorf("%v: no key %q", name, ring.current)
+	}
+	return ring, nil
+}
+
+// aead returns the cipher of the subkey of key id for a blob with salt.
+func (k *keyRing) aead(id string, salt []byte) (cipher.AEAD, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", id)
+	}
+	block, err := aes.NewCipher(hkdfSHA256(key, salt, []byte(encryptionInfo), encryptionKeySize))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// hkdfSHA256 derives length bytes from secret and salt as in RFC 5869.
+func hkdfSHA256(secret, salt, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	out := make([]byte, 0, length+sha256.Size)
+	var block []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// encryptionNonce returns the nonce of a chunk. The rest of it is zero, the
+// subkey is used for one blob only.
+func encryptionNonce(counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptWriter seals everything written to it for w. Close writes the last
+// chunk but does not close w.
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	counter uint32
+	buf     []byte
+}
+
+func newEncryptWriter(w io.Writer, keys *keyRing) (*encryptWriter, error) {
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := keys.aead(keys.current, salt)
+	if err != nil {
+		return nil, err
+	}
+	header := []byte(encryptionMagic)
+	header = append(header, encryptionVersion, byte(len(keys.current)))
+	header = append(header, keys.current...)
+	header = append(header, salt...)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[len(header)-4:], encryptionChunkSize)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data follows, the last
+		// chunk has to carry the last flag
+		if len(e.buf) == encryptionChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := encryptionChunkSize - len(e.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, encryptionNonce(e.counter, last), e.buf, e.header)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// isEncrypted reports whether the blob read by r starts with an encryption
+// header, without consuming anything.
+func isEncrypted(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(encryptionMagic))
+	return bytes.Equal(magic, []byte(encryptionMagic))
+}
+
+// decryptReader opens the chunks written by encryptWriter.
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	keyID   string
+	header  []byte
+	counter uint32
+	chunk   []byte
+	plain   []byte
+	done    bool
+}
+
+func newDecryptReader(r *bufio.Reader, keys *keyRing) (*decryptReader, error) {
+	fixed := make([]byte, len(encryptionMagic)+2)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	if string(fixed[:len(encryptionMagic)]) != encryptionMagic || fixed[len(encryptionMagic)] != encryptionVersion {
+		return nil, errors.New("unsupported encryption header")
+	}
+	rest := make([]byte, int(fixed[len(fixed)-1])+encryptionSaltSize+4)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	keyID := string(rest[:len(rest)-encryptionSaltSize-4])
+	salt := rest[len(keyID) : len(keyID)+encryptionSaltSize]
+	chunkSize := binary.BigEndian.Uint32(rest[len(rest)-4:])
+	if chunkSize == 0 || chunkSize > 16<<20 {
+		return nil, fmt.Errorf("invalid encryption chunk size %d", chunkSize)
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("blob is encrypted with key %q but no key file is configured", keyID)
+	}
+	aead, err := keys.aead(keyID, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:      r,
+		aead:   aead,
+		keyID:  keyID,
+		header: append(fixed, rest...),
+		chunk:  make([]byte, int(chunkSize)+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	last := false
+	switch err {
+	case nil:
+		if _, perr := d.r.Peek(1); perr == io.EOF {
+			last = true
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+	plain, err := d.aead.Open(d.chunk[:0], encryptionNonce(d.counter, last), d.chunk[:n], d.header)
+	if err != nil {
+		return ErrBlobAuthentication
+	}
+	d.counter++
+	d.plain = plain
+	d.done = last
+	return nil
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const (
+	testKey1 = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKey2 = "ICEiIyQlJicoKSorLC0uLzAxMjM0NTY3ODk6Ozw9Pj8="
+)
+
+func testKeyRing(t *testing.T, content, current string) *keyRing {
+	f, err := ioutil.TempFile("", "keys")
+	if err != nil {
+		t.Skipf("Unable to create key file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(content)
+	f.Close()
+	keys, err := LoadKeyFile(f.Name(), current)
+	if err != nil {
+		t.Fatalf("Unable to load key file: %v", err)
+	}
+	return keys
+}
+
+func encryptBytes(t *testing.T, keys *keyRing, data []byte) []byte {
+	var out bytes.Buffer
+	w, err := newEncryptWriter(&out, keys)
+	if err != nil {
+		t.Fatalf("Unable to create encrypter: %v", err)
+	}
+	w.Write(data)
+	w.Close()
+	return out.Bytes()
+}
+
+func decryptBytes(keys *keyRing, data []byte) ([]byte, error) {
+	r, err := newDecryptReader(bufio.NewReader(bytes.NewReader(data)), keys)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestEncryption_LoadKeyFile(t *testing.T) {
+	keys := testKeyRing(t, "# rotated yearly\nk1 "+testKey1+"\n\nk2 "+testKey2+"\n", "")
+	if keys.current != "k2" || len(keys.keys) != 2 || keys.keys["k2"][0] != 0x20 {
+		t.Fail()
+		t.Logf("Unexpected key ring: %+v", keys)
+	}
+	if keys := testKeyRing(t, "k1 "+testKey1+"\nk2 "+testKey2+"\n", "k1"); keys.current != "k1" {
+		t.Fail()
+		t.Logf("Expected configured key to be current. Got: %v", keys.current)
+	}
+
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Skipf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cases := map[string]string{
+		"short":     "k1 0001020304\n",
+		"duplicate": "k1 " + testKey1 + "\nk1 " + testKey1 + "\n",
+		"missing":   "k1\n",
+	}
+	for name, content := range cases {
+		p := path.Join(dir, name)
+		ioutil.WriteFile(p, []byte(content), 0600)
+		if _, err := LoadKeyFile(p, ""); err == nil {
+			t.Fail()
+			t.Logf("Expected %v key file to be rejected", name)
+		}
+	}
+	p := path.Join(dir, "ok")
+	ioutil.WriteFile(p, []byte("k1 "+testKey1), 0600)
+	if _, err := LoadKeyFile(p, "k9"); err == nil {
+		t.Fail()
+		t.Log("Expected unknown current key to be rejected")
+	}
+}
+
+func TestEncryption_RoundTrip(t *testing.T) {
+	keys := testKeyRing(t, "k1 "+testKey1+"\n", "")
+	for _, size := range []int{0, 1, encryptionChunkSize, 2*encryptionChunkSize + 5} {
+		data := bytes.Repeat([]byte{'x'}, size)
+		sealed := encryptBytes(t, keys, data)
+		plain, err := decryptBytes(keys, sealed)
+		if err != nil || !bytes.Equal(plain, data) {
+			t.Fail()
+			t.Logf("Round trip of %d bytes failed: %v", size, err)
+		}
+	}
+}
+
+func TestEncryption_SubkeyPerBlob(t *testing.T) {
+	keys := testKeyRing(t, "k1 "+testKey1+"\n", "")
+	data := []byte("the same content")
+	a, b := encryptBytes(t, keys, data), encryptBytes(t, keys, data)
+	header := len(encryptionMagic) + 2 + len("k1")
+	if a[len(encryptionMagic)] != encryptionVersion || bytes.Equal(a[header:header+encryptionSaltSize], b[header:header+encryptionSaltSize]) {
+		t.Fail()
+		t.Log("Expected every blob to get a fresh salt")
+	}
+	if bytes.Equal(a[len(a)-len(data)-16:], b[len(b)-len(data)-16:]) {
+		t.Fail()
+		t.Log("Expected the same content to be sealed differently")
+	}
+
+	// RFC 5869 test case 1
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	okm := hex.EncodeToString(hkdfSHA256(ikm, salt, info, 42))
+	if okm != "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865" {
+		t.Fail()
+		t.Logf("Unexpected HKDF output: %v", okm)
+	}
+}
+
+func TestEncryption_Tampering(t *testing.T) {
+	keys := testKeyRing(t, "k1 "+testKey1+"\n", "")
+	data := bytes.Repeat([]byte{'x'}, 2*encryptionChunkSize)
+	sealed := encryptBytes(t, keys, data)
+
+	flipped := append([]byte{}, sealed...)
+	flipped[len(flipped)-20] ^= 1
+	if _, err := decryptBytes(keys, flipped); err != ErrBlobAuthentication {
+		t.Fail()
+		t.Logf("Expected modified blob to fail authentication. Got: %v", err)
+	}
+	// Cut off the last chunk at a chunk boundary
+	truncated := sealed[:len(sealed)-(encryptionChunkSize+16)]
+	if _, err := decryptBytes(keys, truncated); err != ErrBlobAuthentication {
+		t.Fail()
+		t.Logf("Expected truncated blob to fail authentication. Got: %v", err)
+	}
+	other := testKeyRing(t, "k2 "+testKey2+"\n", "")
+	if _, err := decryptBytes(other, sealed); err == nil || !strings.Contains(err.Error(), "k1") {
+		t.Fail()
+		t.Logf("Expected unknown key to be reported. Got: %v", err)
+	}
+}
+
+func TestEncryption_StoreAndRewrap(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+
+	// Stored before encryption was turned on
+	store.Store(emptyTestFileDataContentB64)
+	store.keys = testKeyRing(t, "k1 "+testKey1+"\n", "")
+	store.Store(testFileDataContentB64)
+
+	blob, _ := ioutil.ReadFile(store.makePath(testFileDataContentHash) + ".snappy")
+	if !bytes.HasPrefix(blob, []byte(encryptionMagic)) || bytes.Contains(blob, []byte("sNaPpY")) {
+		t.Fail()
+		t.Log("Expected blob to be encrypted after compression")
+	}
+	for hash, expected := range map[string]string{
+		testFileDataContentHash:      testFileDataContentB64,
+		emptyTestFileDataContentHash: emptyTestFileDataContentB64,
+	} {
+		data, err := store.GetAsBase64(hash)
+		if err != nil || data != expected {
+			t.Fail()
+			t.Logf("Expected %v to be readable. Got: %v (%v)", hash, data, err)
+		}
+	}
+
+	// An uncompressed blob, as adopted from FSAssets
+	raw := []byte("an uncompressed asset")
+	rawHash := makeHash(raw)
+	rawPath := store.makePath(rawHash)
+	os.MkdirAll(path.Dir(rawPath), 0755)
+	if err := ioutil.WriteFile(rawPath, raw, 0644); err != nil {
+		t.Fatalf("Failed to write raw blob: %v", err)
+	}
+
+	// Rotate to a new key
+	store.keys = testKeyRing(t, "k1 "+testKey1+"\nk2 "+testKey2+"\n", "")
+	report, err := Rewrap([]*assetStore{store}, store.keys, false)
+	if err != nil || report.Rewrapped != 3 || report.Current != 0 || report.Failed != 0 {
+		t.Fail()
+		t.Logf("Unexpected rewrap report: %+v (%v)", report, err)
+	}
+	report, _ = Rewrap([]*assetStore{store}, store.keys, false)
+	if report.Rewrapped != 0 || report.Current != 3 {
+		t.Fail()
+		t.Logf("Expected all blobs to be current after rewrap. Got: %+v", report)
+	}
+
+	// The old key can be dropped now
+	store.keys = testKeyRing(t, "k2 "+testKey2+"\n", "")
+	data, err := store.GetAsBase64(emptyTestFileDataContentHash)
+	if err != nil || data != emptyTestFileDataContentB64 {
+		t.Fail()
+		t.Logf("Expected rewrapped blob to be readable with the new key. Got: %v (%v)", data, err)
+	}
+
+	if _, err := os.Stat(rawPath); !os.IsNotExist(err) {
+		t.Fail()
+		t.Log("Expected raw blob to be replaced")
+	}
+	blob, _ = ioutil.ReadFile(rawPath + ".snappy")
+	if !bytes.HasPrefix(blob, []byte(encryptionMagic)) {
+		t.Fail()
+		t.Log("Expected raw blob to be encrypted")
+	}
+	data, err = store.GetAsBase64(rawHash)
+	if err != nil || data != base64.StdEncoding.EncodeToString(raw) {
+		t.Fail()
+		t.Logf("Expected rewrapped raw blob to be readable. Got: %v (%v)", data, err)
+	}
+
+	store.keys = nil
+	if _, err := store.GetAsBase64(testFileDataContentHash); err == nil {
+		t.Fail()
+		t.Log("Expected encrypted blob not to be readable without keys")
+	}
+}
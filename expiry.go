@@ -0,0 +1,307 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errExpiryStopped = errors.New("expiry stopped")
+
+// ExpiryPeriods overrides the expiry period for asset types, as in
+// "49:24h,0:0". A period of 0 keeps assets of that type.
+type ExpiryPeriods map[int8]time.Duration
+
+func (p ExpiryPeriods) String() string {
+	types := []int{}
+	for t := range p {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	parts := make([]string, len(types))
+	for i, t := range types {
+		parts[i] = fmt.Sprintf("%d:%v", t, p[int8(t)])
+	}
+	return strings.Join(parts, ",")
+}
+
+func (p ExpiryPeriods) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("expected type:period, got %q", part)
+		}
+		t, err := strconv.ParseInt(fields[0], 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid asset type %q", fields[0])
+		}
+		d, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("negative expiry period for type %d", t)
+		}
+		p[int8(t)] = d
+	}
+	return nil
+}
+
+type ExpiryOptions struct {
+	// After is the time without access after which collectable assets are
+	// deleted, 0 to keep them
+	After  time.Duration
+	ByType ExpiryPeriods
+	// PinnedFile lists ids of assets that are never deleted, one per line
+	PinnedFile string
+	// AuditFile receives a JSON line for every deleted asset
+	AuditFile string
+	Batch     int
+	// Pause between batches keeps the assets table available
+	Pause    time.Duration
+	Interval time.Duration
+	// Slack is added to every period, as the recorded access time of an
+	// asset may be that much older than its last read
+	Slack time.Duration
+}
+
+type ExpiryReport struct {
+	Expired   int
+	Pinned    int
+	Reclaimed int
+	Failed    int
+	Bytes     int64
+}
+
+type expiryAudit struct {
+	Time       time.Time `json:"time"`
+	Id         string    `json:"id"`
+	Type       int8      `json:"type"`
+	Name       string    `json:"name"`
+	Hash       string    `json:"hash"`
+	AccessTime int64     `json:"access_time"`
+}
+
+// expirer deletes collectable assets that were not accessed for their
+// expiry period and reclaims the blobs no other asset refers to.
+type expirer struct {
+	ExpiryOptions
+	model AssetModel
+	store AssetStore
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func createExpirer(model AssetModel, store AssetStore, opts ExpiryOptions) *expirer {
+	return &expirer{
+		ExpiryOptions: opts,
+		model:         model,
+		store:         store,
+		now:           time.Now,
+		sleep:         time.Sleep,
+	}
+}
+
+// period returns the expiry period for assets of type t.
+func (e *expirer) period(t int8) time.Duration {
+	if d, ok := e.ByType[t]; ok {
+		return d
+	}
+	return e.After
+}
+
+// cutoff returns the access time before which assets expire after period.
+func (e *expirer) cutoff(now time.Time, period time.Duration) int64 {
+	return now.Add(-period - e.Slack).Unix()
+}
+
+// shortest returns the shortest expiry period in use, 0 if none is.
+func (e *expirer) shortest() time.Duration {
+	shortest := e.After
+	for _, d := range e.ByType {
+		if d > 0 && (shortest == 0 || d < shortest) {
+			shortest = d
+		}
+	}
+	return shortest
+}
+
+func loadPinned(name string) (map[string]bool, error) {
+	pinned := map[string]bool{}
+	if name == "" {
+		return pinned, nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			pinned[strings.ToLower(line)] = true
+		}
+	}
+	return pinned, nil
+}
+
+// Expire deletes the expired assets in batches of Batch. The pinned file is
+// read again on every run.
+func (e *expirer) Expire(stop <-chan struct{}) (report ExpiryReport, err error) {
+	shortest := e.shortest()
+	if shortest == 0 {
+		return
+	}
+	if e.Batch < 1 {
+		return report, errors.New("expiry batch size must be positive")
+	}
+	pinned, err := loadPinned(e.PinnedFile)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(path.Dir(e.AuditFile), 0755); err != nil {
+		return
+	}
+	audit, err := os.OpenFile(e.AuditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer audit.Close()
+
+	now := e.now()
+	after := ""
+	for {
+		var refs []AssetRef
+		refs, err = e.model.Collectable(e.cutoff(now, shortest), after, e.Batch)
+		if err != nil {
+			return
+		}
+		freed := map[string]bool{}
+		for _, ref := range refs {
+			period := e.period(ref.Type)
+			if period == 0 || ref.AccessTime >= e.cutoff(now, period) {
+				continue
+			}
+			if pinned[strings.ToLower(ref.Id)] {
+				report.Pinned++
+				continue
+			}
+			// The asset is only deleted if it was not read in the meantime
+			deleted, err := e.model.DeleteCollectable(ref.Id, e.cutoff(now, period))
+			if err != nil {
+				log.Printf("Expiry: failed to delete asset %v: %v\n", ref.Id, err)
+				report.Failed++
+				continue
+			}
+			if !deleted {
+				continue
+			}
+			report.Expired++
+			statAdd("expiry.deleted", 1)
+			freed[ref.Hash] = true
+			record, _ := json.Marshal(expiryAudit{
+				Time:       e.now().UTC(),
+				Id:         ref.Id,
+				Type:       ref.Type,
+				Name:       ref.Name,
+				Hash:       ref.Hash,
+				AccessTime: ref.AccessTime,
+			})
+			if _, err := audit.Write(append(record, '\n')); err != nil {
+				log.Printf("Expiry: failed to write audit record for %v: %v\n", ref.Id, err)
+			}
+		}
+		for hash := range freed {
+			size, err := reclaimBlob(e.model, e.store, hash)
+			if err != nil {
+				log.Printf("Expiry: failed to reclaim blob %v: %v\n", hash, err)
+				continue
+			}
+			if size > 0 {
+				report.Reclaimed++
+				report.Bytes += size
+			}
+		}
+		if len(refs) < e.Batch {
+			return
+		}
+		after = refs[len(refs)-1].Id
+
+		select {
+		case <-stop:
+			return report, errExpiryStopped
+		default:
+		}
+		e.sleep(e.Pause)
+	}
+}
+
+func (e *expirer) Run(interval time.Duration, stop <-chan struct{}) {
+	every(interval, stop, e.expireAndLog)
+}
+
+func (e *expirer) expireAndLog() {
+	report, err := e.Expire(nil)
+	if err != nil {
+		log.Printf("Expiry: %v\n", err)
+	}
+	log.Printf("Expiry: deleted %d collectable assets, kept %d pinned, reclaimed %d blobs (%d bytes), %d failed\n",
+		report.Expired, report.Pinned, report.Reclaimed, report.Bytes, report.Failed)
+}
+
+func runExpire(config *Config, args []string) error {
+	fs := flag.NewFlagSet("expire", flag.ExitOnError)
+	fs.Parse(args)
+	if config.Expiry.After == 0 && len(config.Expiry.ByType) == 0 {
+		return errors.New("expire needs -expire-after or -expire-types")
+	}
+	opts, err := config.ExpiryOptions()
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// Deleting assets deletes their search index entries too
+	if err := checkSchema(db, false); err != nil {
+		return err
+	}
+	store, packs, err := config.OpenStack()
+	if err != nil {
+		return err
+	}
+	if packs != nil {
+		defer packs.Close()
+	}
+	createExpirer(CreateAssetModel(db), store, opts).expireAndLog()
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockExpiryModel struct {
+	mockModel
+	assets []AssetRef
+}
+
+func (m *mockExpiryModel) Collectable(before int64, after string, limit int) ([]AssetRef, error) {
+	result := []AssetRef{}
+	for _, ref := range m.assets {
+		if ref.Id > after && ref.DBFlags&Collectable != 0 && ref.AccessTime < before && len(result) < limit {
+			result = append(result, ref)
+		}
+	}
+	return result, nil
+}
+
+func (m *mockExpiryModel) DeleteCollectable(id string, before int64) (bool, error) {
+	for i, ref := range m.assets {
+		if ref.Id == id && ref.AccessTime < before {
+			m.assets = append(m.assets[:i], m.assets[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *mockExpiryModel) HashReferenced(hash string) (bool, error) {
+	for _, ref := range m.assets {
+		if ref.Hash == hash {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestExpiry_Expire(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+	dir := path.Dir(store.dataDir)
+	ioutil.WriteFile(path.Join(dir, "pinned"), []byte("# kept forever\na4\n"), 0644)
+
+	now := time.Now()
+	daysAgo := func(days int) int64 {
+		return now.Add(-time.Duration(days) * 24 * time.Hour).Unix()
+	}
+	hash := func(content string) string {
+		h, _ := store.Store(base64Of(content))
+		return h
+	}
+	shared := hash("a shared texture")
+	model := &mockExpiryModel{assets: []AssetRef{
+		{Id: "a1", Type: 0, Hash: hash("an old texture"), AccessTime: daysAgo(60), DBFlags: Collectable},
+		{Id: "a2", Type: 49, Hash: hash("an old mesh"), AccessTime: daysAgo(2), DBFlags: Collectable},
+		{Id: "a3", Type: 0, Hash: shared, AccessTime: daysAgo(2), DBFlags: Collectable},
+		{Id: "a4", Type: 0, Hash: hash("a pinned texture"), AccessTime: daysAgo(60), DBFlags: Collectable},
+		{Id: "a5", Type: 7, Hash: hash("a notecard"), AccessTime: daysAgo(60), DBFlags: Collectable},
+		{Id: "a6", Type: 0, Hash: shared, AccessTime: daysAgo(60), DBFlags: Collectable},
+		{Id: "a7", Type: 0, Hash: hash("a permanent texture"), AccessTime: daysAgo(60)},
+	}}
+	types := ExpiryPeriods{}
+	types.Set("49:24h,7:0")
+	e := createExpirer(model, store, ExpiryOptions{
+		After:      30 * 24 * time.Hour,
+		ByType:     types,
+		PinnedFile: path.Join(dir, "pinned"),
+		AuditFile:  path.Join(dir, "audit", "expiry.log"),
+		Batch:      2,
+	})
+	e.now = func() time.Time { return now }
+	e.sleep = func(time.Duration) {}
+
+	report, err := e.Expire(nil)
+	if err != nil || report.Expired != 3 || report.Pinned != 1 || report.Reclaimed != 2 {
+		t.Fail()
+		t.Logf("Unexpected report: %+v (%v)", report, err)
+	}
+	ids := []string{}
+	for _, ref := range model.assets {
+		ids = append(ids, ref.Id)
+	}
+	if strings.Join(ids, ",") != "a3,a4,a5,a7" {
+		t.Fail()
+		t.Logf("Expected a1, a2 and a6 to expire. Left: %v", ids)
+	}
+	if !store.Exists(shared) {
+		t.Fail()
+		t.Log("Expected a blob still referred to to be kept")
+	}
+	audit, _ := ioutil.ReadFile(e.AuditFile)
+	if lines := strings.Split(strings.TrimSpace(string(audit)), "\n"); len(lines) != 3 || !strings.Contains(lines[0], `"id":"a1"`) {
+		t.Fail()
+		t.Logf("Expected an audit record per expired asset. Got: %s", audit)
+	}
+}
+
+func TestExpiry_Slack(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+	dir := path.Dir(store.dataDir)
+
+	now := time.Now()
+	hash, _ := store.Store(base64Of("a texture"))
+	model := &mockExpiryModel{assets: []AssetRef{
+		// Read within the period, but the access time was not written yet
+		{Id: "a1", Hash: hash, AccessTime: now.Add(-25 * time.Hour).Unix(), DBFlags: Collectable},
+		{Id: "a2", Hash: hash, AccessTime: now.Add(-50 * time.Hour).Unix(), DBFlags: Collectable},
+	}}
+	e := createExpirer(model, store, ExpiryOptions{
+		After:     24 * time.Hour,
+		Slack:     24*time.Hour + time.Minute,
+		AuditFile: path.Join(dir, "expiry.log"),
+		Batch:     10,
+	})
+	e.now = func() time.Time { return now }
+
+	report, err := e.Expire(nil)
+	if err != nil || report.Expired != 1 || len(model.assets) != 1 || model.assets[0].Id != "a1" {
+		t.Fail()
+		t.Logf("Expected only the asset older than period and slack to expire. Got: %+v (%v)", report, err)
+	}
+}
+
+func TestExpiry_Options(t *testing.T) {
+	c, _ := testConfig("-expire-after", "24h", "-access-granularity", "1h", "-access-flush-interval", "1m")
+	opts, err := c.ExpiryOptions()
+	if err != nil || opts.After != 24*time.Hour || opts.Slack != time.Hour+time.Minute {
+		t.Fail()
+		t.Logf("Unexpected options: %+v (%v)", opts, err)
+	}
+	c, _ = testConfig("-expire-after", "24h", "-access-flush-interval", "0")
+	if _, err := c.ExpiryOptions(); err == nil {
+		t.Fail()
+		t.Log("Expected expiry to be refused when reads are not recorded")
+	}
+}
+
+func TestExpiry_Periods(t *testing.T) {
+	p := ExpiryPeriods{}
+	if err := p.Set("49:24h, 0:0"); err != nil || p[49] != 24*time.Hour || p[0] != 0 || len(p) != 2 {
+		t.Fail()
+		t.Logf("Unexpected periods: %v (%v)", p, err)
+	}
+	if p.String() != "0:0s,49:24h0m0s" {
+		t.Fail()
+		t.Logf("Unexpected string: %v", p.String())
+	}
+	for _, bad := range []string{"49", "x:1h", "300:1h", "1:-1h"} {
+		if err := (ExpiryPeriods{}).Set(bad); err == nil {
+			t.Fail()
+			t.Logf("Expected %q to be rejected", bad)
+		}
+	}
+}
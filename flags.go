@@ -27,6 +27,9 @@ const (
 	Maptile     = 1
 	Rewritable  = 2
 	Collectable = 4
+	// Broken is set by fsck on assets whose blob is lost, it is not one of
+	// the flags exchanged with clients
+	Broken = 1 << 30
 )
 
 func AssetFlagsFromString(flags string) int64 {
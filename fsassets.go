@@ -0,0 +1,219 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// fsAssetsSpoolExt is the extension OpenSimulator gives to pending assets
+// in its FSAssets spool directory. Those files hold the raw asset data.
+const fsAssetsSpoolExt = ".asset"
+
+// fsAssetsDrainingExt is added to a spool file while it is drained.
+const fsAssetsDrainingExt = ".draining"
+
+// FSAssetsLayout lists the number of hash characters of every directory
+// level of an OpenSimulator FSAssets tree. Core OpenSimulator uses 2,2,2,4
+// while some grids run the 3,3 variant.
+type FSAssetsLayout []int
+
+var defaultFSAssetsLayout = FSAssetsLayout{2, 2, 2, 4}
+
+func (l FSAssetsLayout) String() string {
+	parts := make([]string, len(l))
+	for i, w := range l {
+		parts[i] = strconv.Itoa(w)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *FSAssetsLayout) Set(s string) error {
+	result := FSAssetsLayout{}
+	total := 0
+	for _, part := range strings.Split(s, ",") {
+		w, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return err
+		}
+		if w < 1 {
+			return fmt.Errorf("invalid directory width %d", w)
+		}
+		total += w
+		result = append(result, w)
+	}
+	if total >= 64 {
+		return fmt.Errorf("layout %v uses the whole hash", s)
+	}
+	*l = result
+	return nil
+}
+
+func (l FSAssetsLayout) Path(hash string) string {
+	p := ""
+	offset := 0
+	for _, w := range l {
+		p += hash[offset:offset+w] + "/"
+		offset += w
+	}
+	return p + hash
+}
+
+type FSAssetsOptions struct {
+	BaseDir  string
+	SpoolDir string
+	Layout   FSAssetsLayout
+	// Adopt moves blobs found in the FSAssets tree into the snapper layout
+	// the first time they are looked up.
+	Adopt bool
+}
+
+// fsAssetsTree gives read access to an OpenSimulator FSAssets data and
+// spool directory, so snapper can take over an existing installation
+// without copying its assets first.
+type fsAssetsTree struct {
+	FSAssetsOptions
+}
+
+// find returns the path of the blob for hash in the FSAssets tree.
+func (t *fsAssetsTree) find(hash string) (string, bool) {
+	if t.BaseDir != "" {
+		p := path.Join(t.BaseDir, t.Layout.Path(hash))
+		for _, candidate := range []string{p + ".gz", p} {
+			if _, err := os.Stat(candidate); err == nil {
+				return candidate, true
+			}
+		}
+	}
+	if t.SpoolDir != "" {
+		p := path.Join(t.SpoolDir, hash+fsAssetsSpoolExt)
+		if _, err := os.Stat(p); err == nil {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// adoptFSAssets moves a blob found in the FSAssets tree at p into the store
+// when adoption is enabled and returns its new location. On any failure
+// the blob is simply served from where it is.
+func (a assetStore) adoptFSAssets(hash, p string) string {
+	if !a.fsassets.Adopt || strings.HasSuffix(p, fsAssetsSpoolExt) {
+		// Spool files are only taken over after verification by the drain
+		return p
+	}
+	dst := a.makePath(hash)
+	if blobFormat(p) == formatGzip {
+		dst += ".gz"
+	}
+	err := os.MkdirAll(path.Dir(dst), a.dirMode)
+	if err == nil {
+		err = commitFile(p, dst)
+	}
+	if err != nil {
+		log.Printf("Failed to adopt FSAssets blob %v: %v\n", p, err)
+		return p
+	}
+	return dst
+}
+
+type DrainReport struct {
+	Drained int
+	Skipped int
+	Failed  int
+}
+
+// DrainFSAssetsSpool stores every pending asset of the OpenSimulator spool
+// directory of tree in store and removes it from the spool. store is the
+// whole store stack, so the assets are placed, packed and chunked like any
+// other. Files whose content does not match the hash in their name are
+// left alone.
+func DrainFSAssetsSpool(store placer, tree *fsAssetsTree) (report DrainReport, err error) {
+	if tree == nil || tree.SpoolDir == "" {
+		return
+	}
+	entries, err := ioutil.ReadDir(tree.SpoolDir)
+	if os.IsNotExist(err) {
+		return report, nil
+	}
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		// A draining file is left over from an interrupted drain
+		draining := strings.HasSuffix(name, fsAssetsSpoolExt+fsAssetsDrainingExt)
+		if entry.IsDir() || (!strings.HasSuffix(name, fsAssetsSpoolExt) && !draining) {
+			continue
+		}
+		p := path.Join(tree.SpoolDir, name)
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			log.Printf("FSAssets spool: failed to read %v: %v\n", p, err)
+			report.Failed++
+			continue
+		}
+		hash := makeHash(data)
+		if hash != strings.ToUpper(strings.TrimSuffix(strings.TrimSuffix(name, fsAssetsDrainingExt), fsAssetsSpoolExt)) {
+			log.Printf("FSAssets spool: content of %v hashes to %v, leaving it in place\n", p, hash)
+			report.Skipped++
+			continue
+		}
+		// The spool file itself must not count as the stored blob, so it
+		// is hidden from lookups while it is stored
+		if !draining {
+			if err := os.Rename(p, p+fsAssetsDrainingExt); err != nil {
+				log.Printf("FSAssets spool: failed to drain %v: %v\n", p, err)
+				report.Failed++
+				continue
+			}
+			p += fsAssetsDrainingExt
+		}
+		if _, err := store.storeBytes(data); err != nil {
+			log.Printf("FSAssets spool: failed to store %v: %v\n", p, err)
+			report.Failed++
+			// Serve it from the spool until the next drain
+			os.Rename(p, strings.TrimSuffix(p, fsAssetsDrainingExt))
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			log.Printf("FSAssets spool: failed to remove %v: %v\n", p, err)
+			report.Failed++
+			continue
+		}
+		report.Drained++
+	}
+	return
+}
+
+func drainAndLog(store placer, tree *fsAssetsTree) {
+	report, err := DrainFSAssetsSpool(store, tree)
+	if err != nil {
+		log.Printf("FSAssets spool drain failed: %v\n", err)
+	}
+	if report.Drained+report.Skipped+report.Failed > 0 {
+		log.Printf("FSAssets spool: drained %d skipped %d failed %d\n", report.Drained, report.Skipped, report.Failed)
+	}
+}
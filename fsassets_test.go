@@ -0,0 +1,200 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func testFSAssetsStore(t *testing.T, adopt bool) (*assetStore, func()) {
+	dir, err := ioutil.TempDir("", "fsassets")
+	if err != nil {
+		t.Skipf("Unable to create temp dir: %v", err)
+	}
+	store := CreateAssetStore(StoreOptions{
+		DataDir:  path.Join(dir, "data"),
+		SpoolDir: path.Join(dir, "tmp"),
+		DirMode:  0755,
+		FileMode: 0644,
+		FSAssets: &FSAssetsOptions{
+			BaseDir:  path.Join(dir, "fsassets", "data"),
+			SpoolDir: path.Join(dir, "fsassets", "spool"),
+			Layout:   defaultFSAssetsLayout,
+			Adopt:    adopt,
+		},
+	}).(*assetStore)
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func writeFSAssetsBlob(t *testing.T, store *assetStore, hash, content string) string {
+	p := path.Join(store.fsassets.BaseDir, store.fsassets.Layout.Path(hash)) + ".gz"
+	os.MkdirAll(path.Dir(p), 0755)
+	if err := ioutil.WriteFile(p, gzipEncode(content), 0644); err != nil {
+		t.Fatalf("Unable to write FSAssets blob: %v", err)
+	}
+	return p
+}
+
+func TestFSAssets_Layout(t *testing.T) {
+	var l FSAssetsLayout
+	if err := l.Set("3, 3"); err != nil || l.String() != "3,3" {
+		t.Fail()
+		t.Logf("Unexpected layout: %v (%v)", l, err)
+	}
+	if p := defaultFSAssetsLayout.Path(testFileDataContentHash); p != "D6/EC/68/98DE/"+testFileDataContentHash {
+		t.Fail()
+		t.Logf("Unexpected FSAssets path: %v", p)
+	}
+	for _, in := range []string{"", "2,x", "0,2", "32,32"} {
+		if err := l.Set(in); err == nil {
+			t.Fail()
+			t.Logf("Expected layout %q to be rejected", in)
+		}
+	}
+}
+
+func TestFSAssets_ServeInPlace(t *testing.T) {
+	store, cleanup := testFSAssetsStore(t, false)
+	defer cleanup()
+
+	p := writeFSAssetsBlob(t, store, testFileDataContentHash, testFileDataContent)
+	data, err := store.GetAsBase64(testFileDataContentHash)
+	if err != nil || data != testFileDataContentB64 {
+		t.Fail()
+		t.Logf("Expected FSAssets blob to be served. Got: %v (%v)", data, err)
+	}
+	if hash, err := store.Store(testFileDataContentB64); err != nil || hash != testFileDataContentHash {
+		t.Fail()
+		t.Logf("Unexpected store result: %v (%v)", hash, err)
+	}
+	if _, found := store.findOwn(testFileDataContentHash); found {
+		t.Fail()
+		t.Log("Expected content already in the FSAssets tree not to be written again")
+	}
+	if _, err := os.Stat(p); err != nil {
+		t.Fail()
+		t.Logf("Expected FSAssets blob to stay in place without adoption: %v", err)
+	}
+}
+
+func TestFSAssets_Adopt(t *testing.T) {
+	store, cleanup := testFSAssetsStore(t, true)
+	defer cleanup()
+
+	p := writeFSAssetsBlob(t, store, testFileDataContentHash, testFileDataContent)
+	data, err := store.GetAsBase64(testFileDataContentHash)
+	if err != nil || data != testFileDataContentB64 {
+		t.Fail()
+		t.Logf("Expected adopted blob to be served. Got: %v (%v)", data, err)
+	}
+	if spath, found := store.findOwn(testFileDataContentHash); !found || spath != store.makePath(testFileDataContentHash)+".gz" {
+		t.Fail()
+		t.Logf("Expected blob to be moved into the store. Got: %v %v", spath, found)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Fail()
+		t.Log("Expected adopted blob to be gone from the FSAssets tree")
+	}
+}
+
+func TestFSAssets_DrainSpool(t *testing.T) {
+	store, cleanup := testFSAssetsStore(t, false)
+	defer cleanup()
+
+	spool := store.fsassets.SpoolDir
+	os.MkdirAll(path.Join(spool, "spool"), 0755)
+	good := path.Join(spool, testFileDataContentHash+fsAssetsSpoolExt)
+	bad := path.Join(spool, emptyTestFileDataContentHash+fsAssetsSpoolExt)
+	pending := path.Join(spool, "spool", testFileDataContentHash+fsAssetsSpoolExt)
+	ioutil.WriteFile(good, []byte(testFileDataContent), 0644)
+	ioutil.WriteFile(bad, []byte(testFileDataContent), 0644)
+	ioutil.WriteFile(pending, []byte("partial"), 0644)
+
+	if !store.Exists(testFileDataContentHash) {
+		t.Fail()
+		t.Log("Expected blob in the FSAssets spool to exist")
+	}
+	report, err := DrainFSAssetsSpool(store, store.fsassets)
+	if err != nil || report.Drained != 1 || report.Skipped != 1 || report.Failed != 0 {
+		t.Fail()
+		t.Logf("Unexpected drain report: %+v (%v)", report, err)
+	}
+	if _, found := store.findOwn(testFileDataContentHash); !found {
+		t.Fail()
+		t.Log("Expected drained blob in the store")
+	}
+	if _, err := os.Stat(good); !os.IsNotExist(err) {
+		t.Fail()
+		t.Log("Expected drained spool file to be removed")
+	}
+	for _, p := range []string{bad, pending} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fail()
+			t.Logf("Expected %v to be left alone: %v", p, err)
+		}
+	}
+	data, err := store.GetAsBase64(testFileDataContentHash)
+	if err != nil || data != testFileDataContentB64 {
+		t.Fail()
+		t.Logf("Expected drained blob to be readable. Got: %v (%v)", data, err)
+	}
+}
+
+func TestFSAssets_DrainSpoolThroughStack(t *testing.T) {
+	store, cleanup := testFSAssetsStore(t, false)
+	defer cleanup()
+	packs, err := OpenPackStore(testPackOptions(path.Dir(store.dataDir), 1<<20), store)
+	if err != nil {
+		t.Fatalf("Unable to open pack store: %v", err)
+	}
+	defer packs.Close()
+
+	spool := store.fsassets.SpoolDir
+	os.MkdirAll(spool, 0755)
+	good := path.Join(spool, testFileDataContentHash+fsAssetsSpoolExt)
+	ioutil.WriteFile(good, []byte(testFileDataContent), 0644)
+
+	report, err := DrainFSAssetsSpool(packs, store.fsassets)
+	if err != nil || report.Drained != 1 || report.Failed != 0 {
+		t.Fail()
+		t.Logf("Unexpected drain report: %+v (%v)", report, err)
+	}
+	if _, found := packs.index[testFileDataContentHash]; !found {
+		t.Fail()
+		t.Log("Expected drained blob to be packed")
+	}
+	if _, found := store.findOwn(testFileDataContentHash); found {
+		t.Fail()
+		t.Log("Expected drained blob not to bypass the pack store")
+	}
+	for _, p := range []string{good, good + fsAssetsDrainingExt} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fail()
+			t.Logf("Expected %v to be removed", p)
+		}
+	}
+	data, err := packs.GetAsBase64(testFileDataContentHash)
+	if err != nil || data != testFileDataContentB64 {
+		t.Fail()
+		t.Logf("Expected drained blob to be readable. Got: %v (%v)", data, err)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// fsckMaxFetch limits the size of a blob fetched from upstream
+const fsckMaxFetch = 1 << 30
+
+type FsckOptions struct {
+	DeleteOrphans bool
+	// Orphan files younger than OrphanMinAge may belong to an asset that is
+	// being created and are left alone
+	OrphanMinAge time.Duration
+	// FetchFrom is the URL of an asset server to fetch missing blobs from
+	FetchFrom  string
+	MarkBroken bool
+}
+
+type FsckReport struct {
+	Rows      int
+	Blobs     int
+	Dangling  int
+	Orphans   int
+	BadHashes int
+	BadFiles  int
+	Fetched   int
+	Deleted   int
+	Marked    int
+	// Broken counts missing blobs of assets already marked as broken
+	Broken int
+	Failed int
+}
+
+// Problems returns the number of problems found that were neither repaired
+// nor marked.
+func (r FsckReport) Problems() int {
+	return r.Dangling - r.Fetched - r.Marked - r.Broken + r.Orphans - r.Deleted + r.BadHashes + r.BadFiles
+}
+
+// fsck cross-checks the assets table and the store: every asset must have
+// its blob and every blob must belong to an asset.
+type fsck struct {
+	FsckOptions
+	model  AssetModel
+	store  AssetStore
+	client *http.Client
+	now    func() time.Time
+}
+
+func createFsck(model AssetModel, store AssetStore, opts FsckOptions) *fsck {
+	return &fsck{
+		FsckOptions: opts,
+		model:       model,
+		store:       store,
+		client:      &http.Client{Timeout: 5 * time.Minute},
+		now:         time.Now,
+	}
+}
+
+func (f *fsck) Check() (report FsckReport, err error) {
+	live, err := f.checkRows(&report)
+	if err != nil {
+		return
+	}
+	if localDisks(f.store) == nil {
+		log.Printf("Fsck: the store backend cannot be listed, not looking for orphan blobs\n")
+		return
+	}
+	orphans, blobs, badFiles, err := findOrphans(f.store, live, f.OrphanMinAge, f.now())
+	report.Blobs, report.BadFiles = blobs, badFiles
+	if err != nil {
+		return
+	}
+	for _, o := range orphans {
+		log.Printf("Fsck: orphan %v %v\n", o.kind, o.hash)
+	}
+	report.Orphans = len(orphans)
+	if len(orphans) == 0 || !f.DeleteOrphans {
+		return
+	}
+
+	if orphans, err = stillOrphans(f.model, orphans); err != nil {
+		return
+	}
+	report.Orphans = len(orphans)
+	for _, o := range orphans {
+		if err := o.remove(); err != nil {
+			log.Printf("Fsck: failed to delete orphan blob %v: %v\n", o.hash, err)
+			report.Failed++
+			continue
+		}
+		report.Deleted++
+	}
+	return
+}
+
+// checkRows checks that the blob of every asset exists and returns the set
+// of hashes referred to.
+func (f *fsck) checkRows(report *FsckReport) (map[[32]byte]bool, error) {
+	live := map[[32]byte]bool{}
+	err := eachRef(f.model, func(ref AssetRef) error {
+		report.Rows++
+		hash := ref.Hash
+		if !isValidHash(hash) {
+			report.BadHashes++
+			log.Printf("Fsck: asset %v has malformed hash %q\n", ref.Id, hash)
+			// A lower case hash still names a blob that must be kept
+			hash = strings.ToUpper(hash)
+			if !isValidHash(hash) {
+				return nil
+			}
+		}
+		key, _ := hashKey(hash)
+		live[key] = true
+		if !f.store.Exists(hash) {
+			report.Dangling++
+			log.Printf("Fsck: asset %v refers to missing blob %v\n", ref.Id, hash)
+			f.repairRow(ref, hash, report)
+		}
+		return nil
+	})
+	return live, err
+}
+
+// repairRow fetches the missing blob of an asset from upstream, or marks
+// the asset as broken if that fails.
+func (f *fsck) repairRow(ref AssetRef, hash string, report *FsckReport) {
+	if f.FetchFrom != "" {
+		err := f.fetch(ref.Id, hash)
+		if err == nil {
+			report.Fetched++
+			return
+		}
+		log.Printf("Fsck: failed to fetch blob %v of asset %v: %v\n", hash, ref.Id, err)
+	}
+	if ref.DBFlags&Broken != 0 {
+		report.Broken++
+		return
+	}
+	if f.MarkBroken {
+		if err := f.model.MarkBroken(ref.Id); err != nil {
+			log.Printf("Fsck: failed to mark asset %v as broken: %v\n", ref.Id, err)
+			report.Failed++
+			return
+		}
+		report.Marked++
+	}
+}
+
+// fetch stores the data of asset id from the upstream asset server if it
+// matches hash.
+func (f *fsck) fetch(id, hash string) error {
+	url := strings.TrimRight(f.FetchFrom, "/") + "/assets/" + id + "/data"
+	resp, err := f.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %v", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, fsckMaxFetch+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > fsckMaxFetch {
+		return fmt.Errorf("%v: larger than %d bytes", url, fsckMaxFetch)
+	}
+	if got := makeHash(data); got != hash {
+		return fmt.Errorf("upstream data hashes to %v", got)
+	}
+	_, err = f.store.Store(base64.StdEncoding.EncodeToString(data))
+	return err
+}
+
+func runFsck(config *Config, args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	var opts FsckOptions
+	fs.BoolVar(&opts.DeleteOrphans, "delete-orphans", false, "Delete blobs no asset refers to")
+	fs.DurationVar(&opts.OrphanMinAge, "orphan-min-age", time.Hour, "Age below which blobs are not considered orphans, they may belong to an asset being created")
+	fs.StringVar(&opts.FetchFrom, "fetch-from", "", "URL of an asset server to fetch missing blobs from")
+	fs.BoolVar(&opts.MarkBroken, "mark-broken", false, "Flag assets whose blob is missing and could not be fetched as broken")
+	fs.Parse(args)
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	store, packs, err := config.OpenStack()
+	if err != nil {
+		return err
+	}
+	if packs != nil {
+		defer packs.Close()
+	}
+
+	report, err := createFsck(CreateAssetModel(db), store, opts).Check()
+	log.Printf("Fsck: checked %d assets and %d blobs: %d missing blobs (%d fetched, %d marked broken, %d broken before), "+
+		"%d orphan blobs (%d deleted), %d malformed hashes, %d unknown files, %d repairs failed\n",
+		report.Rows, report.Blobs, report.Dangling, report.Fetched, report.Marked, report.Broken,
+		report.Orphans, report.Deleted, report.BadHashes, report.BadFiles, report.Failed)
+	if err == nil && report.Problems() > 0 {
+		err = errors.New("store and database are inconsistent")
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+type mockRefModel struct {
+	mockModel
+	refs   []AssetRef
+	marked []string
+}
+
+func (m *mockRefModel) Refs(after string, limit int) ([]AssetRef, error) {
+	result := []AssetRef{}
+	for _, ref := range m.refs {
+		if ref.Id > after && len(result) < limit {
+			result = append(result, ref)
+		}
+	}
+	return result, nil
+}
+
+func (m *mockRefModel) MarkBroken(id string) error {
+	m.marked = append(m.marked, id)
+	return nil
+}
+
+func TestFsck_DanglingAndOrphans(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+
+	used, _ := store.Store(base64Of("a used texture"))
+	old, _ := store.Store(base64Of("an old orphan"))
+	young, _ := store.Store(base64Of("a texture being created"))
+	p, _ := store.findOwn(old)
+	mtime := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(p, mtime, mtime)
+	missing := makeHash([]byte("a lost texture"))
+
+	model := &mockRefModel{refs: []AssetRef{
+		{Id: "a1", Hash: used},
+		{Id: "a2", Hash: missing},
+		{Id: "a3", Hash: "not a hash"},
+	}}
+	f := createFsck(model, store, FsckOptions{DeleteOrphans: true, OrphanMinAge: time.Hour, MarkBroken: true})
+	report, err := f.Check()
+	if err != nil {
+		t.Fatalf("Unexpected fsck error: %v", err)
+	}
+	if report.Rows != 3 || report.Blobs != 3 || report.Dangling != 1 || report.BadHashes != 1 ||
+		report.Orphans != 1 || report.Deleted != 1 || report.Marked != 1 {
+		t.Fail()
+		t.Logf("Unexpected report: %+v", report)
+	}
+	if !store.Exists(used) || store.Exists(old) || !store.Exists(young) {
+		t.Fail()
+		t.Log("Expected only the old orphan to be deleted")
+	}
+	if len(model.marked) != 1 || model.marked[0] != "a2" {
+		t.Fail()
+		t.Logf("Expected asset with missing blob to be marked broken. Got: %v", model.marked)
+	}
+
+	// A marked asset is no longer a problem
+	model.refs[1].DBFlags = Broken
+	model.refs = model.refs[:2]
+	report, _ = f.Check()
+	if report.Problems() != 0 || report.Broken != 1 {
+		t.Fail()
+		t.Logf("Expected no problems left. Got: %+v", report)
+	}
+}
+
+func TestFsck_FetchMissing(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+
+	data := []byte("a fetched texture")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/assets/a1/data" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	model := &mockRefModel{refs: []AssetRef{
+		{Id: "a1", Hash: makeHash(data)},
+		{Id: "a2", Hash: makeHash([]byte("unknown upstream"))},
+	}}
+	f := createFsck(model, store, FsckOptions{FetchFrom: server.URL + "/", MarkBroken: true})
+	report, err := f.Check()
+	if err != nil || report.Dangling != 2 || report.Fetched != 1 || report.Marked != 1 {
+		t.Fail()
+		t.Logf("Unexpected report: %+v (%v)", report, err)
+	}
+	if !store.Exists(makeHash(data)) {
+		t.Fail()
+		t.Log("Expected fetched blob to be stored")
+	}
+}
+
+func TestFsck_Chunks(t *testing.T) {
+	chunks, cleanup := testChunkStore(t)
+	defer cleanup()
+	inner := chunks.inner.(*assetStore)
+
+	used, _ := chunks.Store(base64.StdEncoding.EncodeToString(randomBytes(6, 64<<10)))
+	unused, _ := chunks.Store(base64.StdEncoding.EncodeToString(randomBytes(7, 64<<10)))
+	_, list, _ := readManifest(chunks.manifestPath(unused))
+	before := countBlobs(t, inner.dataDir)
+
+	model := &mockRefModel{refs: []AssetRef{{Id: "a1", Hash: used}}}
+	f := createFsck(model, chunks, FsckOptions{DeleteOrphans: true, OrphanMinAge: time.Hour})
+	f.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	report, err := f.Check()
+	if err != nil || report.Dangling != 0 || report.Orphans != 1+len(list) || report.Deleted != report.Orphans {
+		t.Fail()
+		t.Logf("Unexpected report: %+v (%v)", report, err)
+	}
+	if chunks.Exists(unused) || countBlobs(t, inner.dataDir) != before-len(list) {
+		t.Fail()
+		t.Log("Expected the unused blob and its chunks to be deleted")
+	}
+	if err := verifyBlob(chunks, used); err != nil {
+		t.Fail()
+		t.Logf("Expected the used blob to stay intact. Got: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+)
+
+// rename is swapped out by tests to simulate cross-device moves.
+var rename = os.Rename
+
+// commitFile moves a fully written and synced file from src to dst and makes
+// the move durable by syncing the destination directory. When src and dst
+// live on different filesystems the file is copied next to dst, synced and
+// renamed into place before src is removed.
+func commitFile(src, dst string) error {
+	err := rename(src, dst)
+	if isCrossDevice(err) {
+		err = copyFile(src, dst)
+		if err == nil {
+			err = os.Remove(src)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(path.Dir(dst))
+}
+
+func isCrossDevice(err error) bool {
+	if linkErr, ok := err.(*os.LinkError); ok {
+		return linkErr.Err == syscall.EXDEV
+	}
+	return false
+}
+
+// copyFile copies src to a temporary file in the directory of dst and renames
+// it into place, so dst is never observed partially written.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(path.Dir(dst), path.Base(dst)+".")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFileAtomic replaces name by a file holding data, so readers see
+// either the old or the new content.
+func writeFileAtomic(name string, data []byte, mode os.FileMode) error {
+	f, err := ioutil.TempFile(path.Dir(name), path.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = commitFile(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func testCommitFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commit")
+	if err != nil {
+		t.Skipf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "src")
+	dst := path.Join(dir, "dst")
+	if err := ioutil.WriteFile(src, []byte(testFileDataContent), 0644); err != nil {
+		t.Skipf("Unable to write source file: %v", err)
+	}
+	if err := commitFile(src, dst); err != nil {
+		t.Fail()
+		t.Logf("commitFile failed: %v", err)
+		return
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fail()
+		t.Logf("Expected source file to be gone. Got: %v", err)
+	}
+	data, err := ioutil.ReadFile(dst)
+	if err != nil || string(data) != testFileDataContent {
+		t.Fail()
+		t.Logf("Expected destination content: %v Got: %v (%v)", testFileDataContent, string(data), err)
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fail()
+		t.Logf("Expected only the destination file to be left. Got: %d entries", len(entries))
+	}
+}
+
+func TestFSUtil_commitFile(t *testing.T) {
+	testCommitFile(t)
+}
+
+func TestFSUtil_commitFileCrossDevice(t *testing.T) {
+	calls := 0
+	rename = func(src, dst string) error {
+		calls++
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EXDEV}
+	}
+	defer func() { rename = os.Rename }()
+
+	testCommitFile(t)
+	if calls != 1 {
+		t.Fail()
+		t.Logf("Expected one rename attempt. Got: %d", calls)
+	}
+}
+
+func TestFSUtil_commitFileMissingSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commit")
+	if err != nil {
+		t.Skipf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := commitFile(path.Join(dir, "missing"), path.Join(dir, "dst")); err == nil {
+		t.Fail()
+		t.Log("Expected an error when committing a missing file")
+	}
+}
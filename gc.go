@@ -0,0 +1,490 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// refsBatchSize is the number of assets read at a time
+const refsBatchSize = 1000
+
+var errGCStopped = errors.New("garbage collection stopped")
+
+// hashKey returns the binary form of a hash for sets of referenced blobs,
+// which take less memory than the hex strings.
+func hashKey(hash string) (key [32]byte, ok bool) {
+	raw, err := hex.DecodeString(hash)
+	if err != nil || len(raw) != len(key) {
+		return key, false
+	}
+	copy(key[:], raw)
+	return key, true
+}
+
+// eachRef calls fn for every asset in the order of their ids.
+func eachRef(model AssetModel, fn func(ref AssetRef) error) error {
+	after := ""
+	for {
+		refs, err := model.Refs(after, refsBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if err := fn(ref); err != nil {
+				return err
+			}
+		}
+		if len(refs) < refsBatchSize {
+			return nil
+		}
+		after = refs[len(refs)-1].Id
+	}
+}
+
+// referencedHashes returns the set of hashes the assets refer to.
+func referencedHashes(model AssetModel) (map[[32]byte]bool, error) {
+	live := map[[32]byte]bool{}
+	err := eachRef(model, func(ref AssetRef) error {
+		if key, ok := hashKey(strings.ToUpper(ref.Hash)); ok {
+			live[key] = true
+		}
+		return nil
+	})
+	return live, err
+}
+
+// orphan is a blob no asset refers to, with the way to remove it and, for
+// a chunked blob, its chunks. touched reports whether the blob was stored
+// again or reused since it was found.
+type orphan struct {
+	hash    string
+	kind    string
+	size    int64
+	chunks  []manifestChunk
+	remove  func() error
+	touched func() bool
+}
+
+// findOrphans lists the blobs of store that are not in live and were not
+// written within grace before now, along with the number of blobs and of
+// other files seen. Chunks are live if a chunked blob that is kept is made
+// of them.
+func findOrphans(store AssetStore, live map[[32]byte]bool, grace time.Duration, now time.Time) (orphans []orphan, blobs, badFiles int, err error) {
+	var chunks *chunkStore
+	var packs *packStore
+	for s := store; chunks == nil || packs == nil; {
+		if c, ok := s.(*chunkStore); ok {
+			chunks, s = c, c.inner
+		} else if p, ok := s.(*packStore); ok {
+			packs, s = p, p.large
+		} else {
+			break
+		}
+	}
+	recent := func(modTime time.Time) bool {
+		return now.Sub(modTime) < grace
+	}
+	recentFile := func(p string) func() bool {
+		return func() bool {
+			info, err := os.Stat(p)
+			return err == nil && recent(info.ModTime())
+		}
+	}
+
+	if chunks != nil {
+		// Collect the chunks of kept blobs before the blobs are listed
+		var dead []orphan
+		err = filepath.Walk(chunks.Dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || !strings.HasSuffix(p, manifestExt) {
+				return err
+			}
+			hash := blobHash(p)
+			key, ok := hashKey(hash)
+			if !ok {
+				badFiles++
+				return nil
+			}
+			blobs++
+			_, list, err := readManifest(p)
+			if err != nil {
+				log.Printf("%v\n", err)
+				badFiles++
+				return nil
+			}
+			if !live[key] && !recent(info.ModTime()) {
+				dead = append(dead, orphan{
+					hash:    hash,
+					kind:    "chunk manifest",
+					size:    info.Size(),
+					chunks:  list,
+					remove:  func() error { return os.Remove(p) },
+					touched: recentFile(p),
+				})
+				return nil
+			}
+			for _, chunk := range list {
+				if key, ok := hashKey(chunk.hash); ok {
+					live[key] = true
+				}
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+		orphans = append(orphans, dead...)
+	}
+
+	if packs != nil {
+		// Records carry no time, a segment written to within grace may
+		// hold recent ones
+		packs.mu.RLock()
+		recentSegments := map[uint32]bool{}
+		for id, seg := range packs.segments {
+			info, err := seg.f.Stat()
+			recentSegments[id] = err != nil || recent(info.ModTime())
+		}
+		for hash, entry := range packs.index {
+			blobs++
+			if key, _ := hashKey(hash); live[key] || recentSegments[entry.segment] {
+				continue
+			}
+			hash := hash
+			orphans = append(orphans, orphan{
+				hash:    hash,
+				kind:    "packed blob",
+				size:    int64(entry.length),
+				remove:  func() error { return packs.Delete(hash) },
+				touched: recentFile(packs.segmentPath(entry.segment, packSegmentExt)),
+			})
+		}
+		packs.mu.RUnlock()
+	}
+
+	for _, disk := range localDisks(store) {
+		var skipped int
+		skipped, err = walkBlobs(disk.dataDir, func(p, hash, ext string, info os.FileInfo) error {
+			blobs++
+			if key, _ := hashKey(hash); live[key] || recent(info.ModTime()) {
+				return nil
+			}
+			orphans = append(orphans, orphan{
+				hash:    hash,
+				kind:    "blob file",
+				size:    info.Size(),
+				remove:  func() error { return os.Remove(p) },
+				touched: recentFile(p),
+			})
+			return nil
+		})
+		badFiles += skipped
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+	}
+	return
+}
+
+// stillOrphans reads the assets again and drops the orphans an asset was
+// created for in the meantime, with the chunks of such chunked blobs.
+func stillOrphans(model AssetModel, orphans []orphan) ([]orphan, error) {
+	live, err := referencedHashes(model)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range orphans {
+		if key, _ := hashKey(o.hash); live[key] {
+			for _, chunk := range o.chunks {
+				key, _ := hashKey(chunk.hash)
+				live[key] = true
+			}
+		}
+	}
+	result := []orphan{}
+	for _, o := range orphans {
+		if key, _ := hashKey(o.hash); !live[key] {
+			result = append(result, o)
+		}
+	}
+	return result, nil
+}
+
+type GCOptions struct {
+	Interval time.Duration
+	// Blobs written within Grace are kept, they may belong to an asset
+	// that is being created
+	Grace time.Duration
+	// Rate limits the blobs deleted per second, 0 for no limit
+	Rate   int
+	DryRun bool
+}
+
+type GCReport struct {
+	Referenced int
+	Blobs      int
+	Orphans    int
+	Deleted    int
+	Failed     int
+	Bytes      int64
+}
+
+// garbageCollector deletes the blobs no asset refers to any more, after
+// rewritable assets were overwritten or assets were deleted.
+type garbageCollector struct {
+	GCOptions
+	model AssetModel
+	store AssetStore
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func createGarbageCollector(model AssetModel, store AssetStore, opts GCOptions) *garbageCollector {
+	return &garbageCollector{
+		GCOptions: opts,
+		model:     model,
+		store:     store,
+		now:       time.Now,
+		sleep:     time.Sleep,
+	}
+}
+
+// Collect marks the blobs the assets refer to and sweeps the others. With
+// DryRun the orphans are only counted. Bytes are those of the deleted blob
+// files, packed blobs give their space back when their segment is
+// compacted.
+func (g *garbageCollector) Collect(stop <-chan struct{}) (report GCReport, err error) {
+	live, err := referencedHashes(g.model)
+	if err != nil {
+		return
+	}
+	report.Referenced = len(live)
+	orphans, blobs, _, err := findOrphans(g.store, live, g.Grace, g.now())
+	report.Blobs = blobs
+	if err != nil {
+		return
+	}
+	if g.DryRun {
+		report.Orphans = len(orphans)
+		for _, o := range orphans {
+			log.Printf("GC: would delete %v %v (%d bytes)\n", o.kind, o.hash, o.size)
+			report.Bytes += o.size
+		}
+		return
+	}
+
+	if orphans, err = stillOrphans(g.model, orphans); err != nil {
+		return
+	}
+	report.Orphans = len(orphans)
+	start := g.now()
+	// Chunks of chunked blobs that turned out to be in use
+	kept := map[[32]byte]bool{}
+	for _, o := range orphans {
+		select {
+		case <-stop:
+			return report, errGCStopped
+		default:
+		}
+		// An asset may have been created for the blob or the blob stored
+		// again since the assets were read
+		referenced, err := g.model.HashReferenced(o.hash)
+		if err != nil {
+			log.Printf("GC: failed to check %v %v: %v\n", o.kind, o.hash, err)
+			report.Failed++
+			continue
+		}
+		if key, _ := hashKey(o.hash); referenced || kept[key] || o.touched() {
+			for _, chunk := range o.chunks {
+				key, _ := hashKey(chunk.hash)
+				kept[key] = true
+			}
+			report.Orphans--
+			continue
+		}
+		if err := o.remove(); err != nil && !os.IsNotExist(err) {
+			log.Printf("GC: failed to delete %v %v: %v\n", o.kind, o.hash, err)
+			report.Failed++
+			continue
+		}
+		report.Deleted++
+		report.Bytes += o.size
+		statAdd("gc.deleted", 1)
+		statAdd("gc.bytes", o.size)
+		if g.Rate > 0 {
+			due := time.Duration(float64(report.Deleted+report.Failed) / float64(g.Rate) * float64(time.Second))
+			if elapsed := g.now().Sub(start); elapsed < due {
+				g.sleep(due - elapsed)
+			}
+		}
+	}
+	return
+}
+
+func (g *garbageCollector) Run(interval time.Duration, stop <-chan struct{}) {
+	every(interval, stop, g.collectAndLog)
+}
+
+func (g *garbageCollector) collectAndLog() {
+	report, err := g.Collect(nil)
+	if err != nil {
+		log.Printf("GC: %v\n", err)
+	}
+	verb := "deleted"
+	if g.DryRun {
+		verb = "would delete"
+	}
+	log.Printf("GC: %d of %d blobs are referenced by assets, %v %d orphans (%d bytes), %d failed\n",
+		report.Blobs-report.Orphans, report.Blobs, verb, report.Orphans, report.Bytes, report.Failed)
+}
+
+func runGC(config *Config, args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	opts := config.GC
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Only report the blobs that would be deleted")
+	fs.IntVar(&opts.Rate, "rate", config.GC.Rate, "Blobs to delete per second, 0 for no limit")
+	fs.Parse(args)
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	store, packs, err := config.OpenStack()
+	if err != nil {
+		return err
+	}
+	if packs != nil {
+		defer packs.Close()
+	}
+	if localDisks(store) == nil {
+		return errors.New("gc needs the fs store backend")
+	}
+	createGarbageCollector(CreateAssetModel(db), store, opts).collectAndLog()
+	return nil
+}
+
+// reclaimBlob deletes the blob hash from store if no asset refers to it and
+// returns the bytes freed. The chunks of a chunked blob are left to garbage
+// collection, other blobs may share them.
+func reclaimBlob(model AssetModel, store AssetStore, hash string) (int64, error) {
+	referenced, err := model.HashReferenced(hash)
+	if err != nil || referenced {
+		return 0, err
+	}
+	return removeBlob(store, hash)
+}
+
+// touchBlob reports whether store has the blob hash and refreshes its
+// modification time, so garbage collection keeps a blob that is stored
+// again or reused by a new asset for another grace period.
+func touchBlob(store AssetStore, hash string) bool {
+	now := time.Now()
+	switch s := store.(type) {
+	case *verifyStore:
+		return touchBlob(s.AssetStore, hash)
+	case *chunkStore:
+		if os.Chtimes(s.manifestPath(hash), now, now) == nil {
+			return true
+		}
+		return touchBlob(s.inner, hash)
+	case *packStore:
+		s.mu.RLock()
+		entry, found := s.index[hash]
+		s.mu.RUnlock()
+		if !found {
+			return touchBlob(s.large, hash)
+		}
+		// Records carry no time, garbage collection goes by the segment
+		os.Chtimes(s.segmentPath(entry.segment, packSegmentExt), now, now)
+		return true
+	}
+
+	disks := localDisks(store)
+	if disks == nil {
+		return store.Exists(hash)
+	}
+	for _, disk := range disks {
+		p, found := disk.exists(hash)
+		if !found {
+			continue
+		}
+		if err := os.Chtimes(p, now, now); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeBlob deletes every copy store keeps of the blob hash.
+func removeBlob(store AssetStore, hash string) (size int64, err error) {
+	switch s := store.(type) {
+	case *verifyStore:
+		return removeBlob(s.AssetStore, hash)
+	case *chunkStore:
+		name := s.manifestPath(hash)
+		info, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			return removeBlob(s.inner, hash)
+		}
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), os.Remove(name)
+	case *packStore:
+		s.mu.RLock()
+		entry, found := s.index[hash]
+		s.mu.RUnlock()
+		if !found {
+			return removeBlob(s.large, hash)
+		}
+		return int64(entry.length), s.Delete(hash)
+	}
+
+	disks := localDisks(store)
+	if disks == nil {
+		return 0, errors.New("the store backend cannot delete blobs")
+	}
+	for _, disk := range disks {
+		p, found := disk.findOwn(hash)
+		if !found {
+			continue
+		}
+		info, err := os.Stat(p)
+		if err == nil {
+			err = os.Remove(p)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return size, err
+		}
+		if err == nil {
+			size += info.Size()
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGC_Collect(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+
+	used, _ := store.Store(base64Of("a used texture"))
+	old, _ := store.Store(base64Of("an overwritten texture"))
+	young, _ := store.Store(base64Of("a texture being created"))
+	p, _ := store.findOwn(old)
+	info, _ := os.Stat(p)
+	mtime := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(p, mtime, mtime)
+
+	model := &mockRefModel{refs: []AssetRef{{Id: "a1", Hash: used}}}
+	gc := createGarbageCollector(model, store, GCOptions{Grace: time.Hour, DryRun: true})
+	report, err := gc.Collect(nil)
+	if err != nil || report.Blobs != 3 || report.Orphans != 1 || report.Deleted != 0 || report.Bytes != info.Size() {
+		t.Fail()
+		t.Logf("Unexpected dry run report: %+v (%v)", report, err)
+	}
+	if !store.Exists(old) {
+		t.Fail()
+		t.Log("Expected dry run not to delete anything")
+	}
+
+	gc.DryRun = false
+	report, err = gc.Collect(nil)
+	if err != nil || report.Orphans != 1 || report.Deleted != 1 || report.Bytes != info.Size() {
+		t.Fail()
+		t.Logf("Unexpected report: %+v (%v)", report, err)
+	}
+	if !store.Exists(used) || store.Exists(old) || !store.Exists(young) {
+		t.Fail()
+		t.Log("Expected only the old orphan to be deleted")
+	}
+}
+
+func TestGC_Packed(t *testing.T) {
+	p, _, cleanup := testPackStore(t, 1<<20)
+	defer cleanup()
+
+	used, _ := p.Store(base64Of("a used landmark"))
+	unused, _ := p.Store(base64Of("a deleted landmark"))
+	model := &mockRefModel{refs: []AssetRef{{Id: "a1", Hash: used}}}
+	gc := createGarbageCollector(model, p, GCOptions{Grace: time.Hour})
+
+	report, _ := gc.Collect(nil)
+	if report.Blobs != 2 || report.Orphans != 0 {
+		t.Fail()
+		t.Logf("Expected blobs of a recently written segment to be kept. Got: %+v", report)
+	}
+
+	gc.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	report, err := gc.Collect(nil)
+	if err != nil || report.Deleted != 1 {
+		t.Fail()
+		t.Logf("Unexpected report: %+v (%v)", report, err)
+	}
+	if !p.Exists(used) || p.Exists(unused) {
+		t.Fail()
+		t.Log("Expected only the unused packed blob to be deleted")
+	}
+}
+
+func TestGC_Rate(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+	for i := 0; i < 5; i++ {
+		store.Store(base64Of(fmt.Sprintf("orphan %d", i)))
+	}
+
+	gc := createGarbageCollector(&mockRefModel{}, store, GCOptions{Rate: 2})
+	now := time.Now()
+	var slept time.Duration
+	gc.now = func() time.Time { return now }
+	gc.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	report, err := gc.Collect(nil)
+	if err != nil || report.Deleted != 5 {
+		t.Fail()
+		t.Logf("Unexpected report: %+v (%v)", report, err)
+	}
+	if slept != 2500*time.Millisecond {
+		t.Fail()
+		t.Logf("Expected 5 deletions at 2 per second to take 2.5s. Got: %v", slept)
+	}
+}
+
+// racingModel runs race before the first blob is rechecked, as if it
+// happened between marking and sweeping.
+type racingModel struct {
+	mockRefModel
+	race func()
+}
+
+func (m *racingModel) HashReferenced(hash string) (bool, error) {
+	if m.race != nil {
+		m.race()
+		m.race = nil
+	}
+	for _, ref := range m.refs {
+		if ref.Hash == hash {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func backdateFiles(t *testing.T, dir string) {
+	mtime := time.Now().Add(-2 * time.Hour)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			err = os.Chtimes(p, mtime, mtime)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Unable to backdate files: %v", err)
+	}
+}
+
+func TestGC_Race(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+
+	stored, _ := store.Store(base64Of("a texture uploaded again"))
+	referenced, _ := store.Store(base64Of("a texture an asset is created for"))
+	orphan, _ := store.Store(base64Of("an orphan"))
+	backdateFiles(t, store.dataDir)
+
+	model := &racingModel{}
+	model.race = func() {
+		store.Store(base64Of("a texture uploaded again"))
+		model.refs = append(model.refs, AssetRef{Id: "a1", Hash: referenced})
+	}
+	gc := createGarbageCollector(model, store, GCOptions{Grace: time.Hour})
+	report, err := gc.Collect(nil)
+	if err != nil || report.Orphans != 1 || report.Deleted != 1 {
+		t.Fail()
+		t.Logf("Unexpected report: %+v (%v)", report, err)
+	}
+	if !store.Exists(stored) || !store.Exists(referenced) || store.Exists(orphan) {
+		t.Fail()
+		t.Log("Expected blobs stored again or referenced meanwhile to be kept")
+	}
+}
+
+func TestGC_ReusedChunks(t *testing.T) {
+	chunks, cleanup := testChunkStore(t)
+	defer cleanup()
+	inner := chunks.inner.(*assetStore)
+
+	data := randomBytes(8, 64<<10)
+	old, _ := chunks.Store(base64.StdEncoding.EncodeToString(data))
+	backdateFiles(t, path.Dir(inner.dataDir))
+
+	// A new version sharing most chunks is stored while the old one is
+	// collected
+	data = append(data[:len(data)-10:len(data)-10], []byte("new ending")...)
+	var updated string
+	model := &racingModel{}
+	model.race = func() {
+		updated, _ = chunks.Store(base64.StdEncoding.EncodeToString(data))
+	}
+	gc := createGarbageCollector(model, chunks, GCOptions{Grace: time.Hour})
+	if _, err := gc.Collect(nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if chunks.Exists(old) {
+		t.Fail()
+		t.Log("Expected the old version to be deleted")
+	}
+	if err := verifyBlob(chunks, updated); err != nil {
+		t.Fail()
+		t.Logf("Expected the new version to keep its chunks. Got: %v", err)
+	}
+}
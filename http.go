@@ -21,7 +21,9 @@ package main
 import (
 	"compress/gzip"
 	"compress/zlib"
+	"encoding/json"
 	"encoding/xml"
+	"expvar"
 	"io"
 	"log"
 	"net"
@@ -34,13 +36,19 @@ import (
 )
 
 type HTTPService struct {
-	service Service
-	router  *mux.Router
+	service     Service
+	uploads     *uploadManager
+	router      *mux.Router
+	adminRouter *mux.Router
 }
 
-func CreateHTTPService(db Database, dataStore, spoolStore string) *HTTPService {
+// CreateHTTPService creates the HTTP API of service, without the upload
+// session endpoints if uploads is nil. The admin endpoints and metrics are
+// served by AdminRouter, apart from the API the simulators use.
+func CreateHTTPService(service Service, uploads *uploadManager) *HTTPService {
 	return &HTTPService{
-		service: CreateService(db, dataStore, spoolStore),
+		service: service,
+		uploads: uploads,
 	}
 }
 
@@ -66,6 +74,15 @@ func (h HTTPService) xmlResponse(responseData interface{}, resp http.ResponseWri
 	}
 }
 
+func (h HTTPService) jsonResponse(responseData interface{}, resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(resp).Encode(responseData)
+	if err != nil {
+		http.NotFound(resp, req)
+		log.Printf("Failed to encode response: %v\n", err)
+	}
+}
+
 // Export this bit is the only thing worth using really
 func Compressor(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -99,14 +116,46 @@ func (h HTTPService) Router() *mux.Router {
 	router.HandleFunc("/assets/{asset_id}", h.get).Methods("GET")
 	router.HandleFunc("/assets/{asset_id}", h.del).Methods("DELETE")
 	router.HandleFunc("/get_assets_exist", h.exists).Methods("POST")
+	if h.uploads != nil {
+		router.HandleFunc("/uploads", h.createUpload).Methods("POST")
+		router.HandleFunc("/uploads/{upload_id}", h.getUpload).Methods("GET")
+		router.HandleFunc("/uploads/{upload_id}", h.putUpload).Methods("PUT")
+		router.HandleFunc("/uploads/{upload_id}", h.deleteUpload).Methods("DELETE")
+		router.HandleFunc("/uploads/{upload_id}/finalize", h.finalizeUpload).Methods("POST")
+	}
+	router.HandleFunc("/blobs/exist", h.blobsExist).Methods("POST")
+	router.HandleFunc("/blobs/{hash}", h.getBlob).Methods("GET")
+	router.HandleFunc("/blobs/{hash}", h.headBlob).Methods("HEAD")
 	h.router = router
 	return router
 }
 
+// AdminRouter routes the endpoints that list and search all assets and
+// expose metrics. They have no authentication and are meant for a listener
+// only operators can reach.
+func (h HTTPService) AdminRouter() *mux.Router {
+	if h.adminRouter != nil {
+		return h.adminRouter
+	}
+	router := mux.NewRouter()
+
+	router.HandleFunc("/admin/assets", h.listAssets).Methods("GET")
+	router.HandleFunc("/admin/search", h.searchAssets).Methods("GET")
+	router.HandleFunc("/admin/assets/{asset_id}/siblings", h.getSiblings).Methods("GET")
+	router.HandleFunc("/admin/blobs/{hash}", h.getBlobInfo).Methods("GET")
+	router.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+	h.adminRouter = router
+	return router
+}
+
 func (h HTTPService) Run(listener net.Listener) {
 	http.Serve(listener, handlers.LoggingHandler(os.Stdout, h.Router()))
 }
 
+func (h HTTPService) RunAdmin(listener net.Listener) {
+	http.Serve(listener, handlers.LoggingHandler(os.Stdout, h.AdminRouter()))
+}
+
 func (h HTTPService) index(resp http.ResponseWriter, req *http.Request) {
 	resp.Header().Set("Content-Type", "text/html")
 	resp.Write([]byte("<html><head><title>OpenSimulator Assets Server</title></head><body><h1>OpenSimulator Assets Server</h1></body></html>"))
@@ -161,6 +210,68 @@ func (h HTTPService) getData(resp http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// maxBlobsExist is the number of hashes a /blobs/exist request may check
+const maxBlobsExist = 10000
+
+func (h HTTPService) blobsExist(resp http.ResponseWriter, req *http.Request) {
+	var hashes = ArrayOfStrings{}
+	defer req.Body.Close()
+
+	err := xml.NewDecoder(req.Body).Decode(&hashes)
+	if err != nil {
+		http.Error(resp, "invalid request", http.StatusBadRequest)
+		log.Printf("Failed to decode request: %v\n", err)
+		return
+	}
+	if len(hashes.Strings) > maxBlobsExist {
+		http.Error(resp, "too many hashes", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var bools = ArrayOfBoolean{}
+	bools.Booleans = h.service.BlobsExist(hashes.Strings)
+
+	h.xmlResponse(bools, resp, req)
+}
+
+// blobHeaders sets the headers of a blob response.
+func blobHeaders(resp http.ResponseWriter, hash string) {
+	resp.Header().Set("Content-Type", "application/octet-stream")
+	// Blobs never change, their hash is their version
+	resp.Header().Set("ETag", `"`+hash+`"`)
+	resp.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+}
+
+func (h HTTPService) headBlob(resp http.ResponseWriter, req *http.Request) {
+	hash, ok := normalizeHash(mux.Vars(req)["hash"])
+	if !ok {
+		http.Error(resp, ErrInvalidHash.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.service.BlobsExist([]string{hash})[0] {
+		http.NotFound(resp, req)
+		return
+	}
+	blobHeaders(resp, hash)
+}
+
+func (h HTTPService) getBlob(resp http.ResponseWriter, req *http.Request) {
+	hash := mux.Vars(req)["hash"]
+	reader, err := h.service.GetBlob(hash)
+	if err == ErrInvalidHash {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.NotFound(resp, req)
+		return
+	}
+	defer reader.Close()
+	blobHeaders(resp, strings.ToUpper(hash))
+	if _, err = io.Copy(resp, reader); err != nil {
+		log.Printf("Copying blob %v to output stream failed: %v\n", hash, err)
+	}
+}
+
 func (h HTTPService) getMetadata(resp http.ResponseWriter, req *http.Request) {
 	id := mux.Vars(req)["asset_id"]
 	meta, err := h.service.GetAssetMetaData(id)
@@ -181,12 +292,28 @@ func (h HTTPService) create(resp http.ResponseWriter, req *http.Request) {
 		log.Printf("AssetCreate: Failed to decode data: %v\n", err)
 		return
 	}
-	err = h.service.CreateAsset(&fullData)
-	if err != nil {
+	h.createAsset(&fullData, resp, req)
+}
+
+// createAsset creates the asset and writes the response, returning the
+// error of the service.
+func (h HTTPService) createAsset(fullData *FullAssetData, resp http.ResponseWriter, req *http.Request) error {
+	err := h.service.CreateAsset(fullData)
+	if err == ErrInsufficientStorage {
+		http.Error(resp, err.Error(), http.StatusInsufficientStorage)
+		log.Printf("Rejected asset: %v Error: %v\n", fullData.Id, err)
+	} else if err == ErrUnknownBlob || err == ErrInvalidHash {
+		http.Error(resp, err.Error(), http.StatusUnprocessableEntity)
+		log.Printf("Rejected asset: %v Error: %v\n", fullData.Id, err)
+	} else if err == ErrTemporaryRejected {
+		http.Error(resp, err.Error(), http.StatusForbidden)
+		log.Printf("Rejected temporary asset: %v\n", fullData.Id)
+	} else if err != nil {
 		http.NotFound(resp, req)
 		log.Printf("Failed to create asset: %v Error: %v\n", fullData.Id, err)
 	} else {
 		log.Printf("Successfully created asset: %v Hash: %v\n", fullData.Id, fullData.Hash)
 		h.xmlResponse(CreateResponseSuccess{Id: fullData.Id}, resp, req)
 	}
+	return err
 }
@@ -25,9 +25,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 )
 
+const (
+	testFullStorageId = "5b1a2d6e-5b0e-4f4c-9d4c-1f00d4e5a001"
+)
+
 type mockService struct {
 }
 
@@ -60,6 +65,12 @@ func (m *mockService) CreateAsset(data *FullAssetData) error {
 		data.Hash = testFileDataContentHash
 		return nil
 	}
+	if data.Id == testFullStorageId {
+		return ErrInsufficientStorage
+	}
+	if data.BlobHash != "" {
+		return ErrUnknownBlob
+	}
 	return os.ErrInvalid
 }
 
@@ -75,6 +86,62 @@ func (m *mockService) AssetsExist(ids []string) []bool {
 	return result
 }
 
+func (m *mockService) ListAssets(filter AssetFilter, after string, limit int) ([]AssetBase, error) {
+	assets := []AssetBase{}
+	for _, id := range []string{"a1", "a2", "a3"} {
+		if id > after && len(assets) < limit && (!filter.HasType || filter.Type == 4) {
+			asset := testServiceAssetInstance()
+			asset.Id, asset.FullId = id, id
+			assets = append(assets, asset)
+		}
+	}
+	return assets, nil
+}
+
+func (m *mockService) SearchAssets(q SearchQuery) ([]SearchResult, error) {
+	if q.Text == "" {
+		return nil, errEmptyQuery
+	}
+	return []SearchResult{{Id: testContentId, Name: q.Text, Type: 7, Score: 1}}, nil
+}
+
+func (m *mockService) GetBlobInfo(hash string) (BlobInfo, error) {
+	if hash == testFileDataContentHash {
+		return BlobInfo{Hash: hash, Exists: true, Size: int64(len(testFileDataContent)), Format: "snappy"}, nil
+	}
+	return BlobInfo{Hash: hash}, nil
+}
+
+func (m *mockService) AssetsByHash(hash string, after string, limit int) ([]string, error) {
+	ids := []string{}
+	if hash == testFileDataContentHash {
+		for _, id := range []string{testContentId, "a1", "f1"} {
+			if id > after && len(ids) < limit {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (m *mockService) GetBlob(hash string) (io.ReadCloser, error) {
+	if _, ok := normalizeHash(hash); !ok {
+		return nil, ErrInvalidHash
+	}
+	if strings.ToUpper(hash) == testFileDataContentHash {
+		return &mockDataSource{bytes.NewReader([]byte(testFileDataContent))}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (m *mockService) BlobsExist(hashes []string) []bool {
+	result := make([]bool, len(hashes))
+	for i, hash := range hashes {
+		result[i] = strings.ToUpper(hash) == testFileDataContentHash
+	}
+	return result
+}
+
 var httpTestServiceInstance *HTTPService = &HTTPService{service: &mockService{}}
 
 func TestHTTP_GetFullData(t *testing.T) {
@@ -268,3 +335,19 @@ func TestHTTP_Delete(t *testing.T) {
 		t.Logf("Expected non failure on request: Got Code: %v", recorder.Code)
 	}
 }
+
+func TestHTTP_CreateInsufficientStorage(t *testing.T) {
+	fullData, _ := httpTestServiceInstance.service.GetFullAssetData(testContentId)
+	fullData.Id = testFullStorageId
+	data, err := xml.Marshal(&fullData)
+	if err != nil {
+		t.Skip("TestHTTP_CreateInsufficientStorage test broken")
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/assets", bytes.NewReader(append([]byte(xml.Header), data...)))
+	httpTestServiceInstance.Router().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusInsufficientStorage {
+		t.Fail()
+		t.Logf("Expected code: %v Got: %v", http.StatusInsufficientStorage, recorder.Code)
+	}
+}
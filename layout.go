@@ -0,0 +1,229 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	layoutFileName    = "layout.json"
+	layoutFileVersion = 1
+)
+
+// layoutRecheckInterval is how often a running store looks for a layout file
+// changed by the reshard command.
+var layoutRecheckInterval = 10 * time.Second
+
+// Layout describes how blobs are fanned out into directories: Depth levels
+// of directories each named by the next Width characters of the hash.
+type Layout struct {
+	Depth int `json:"depth"`
+	Width int `json:"width"`
+}
+
+// defaultLayout is the hash[0:3]/hash[3:6]/hash layout snapper always used.
+var defaultLayout = Layout{Depth: 2, Width: 3}
+
+func (l Layout) String() string {
+	return fmt.Sprintf("depth %d width %d", l.Depth, l.Width)
+}
+
+func (l Layout) Validate() error {
+	if l.Depth < 0 || l.Width < 1 || l.Depth*l.Width >= 64 {
+		return fmt.Errorf("invalid layout: %v", l)
+	}
+	return nil
+}
+
+// Path returns the slash separated location of hash relative to the store.
+func (l Layout) Path(hash string) string {
+	p := ""
+	for i := 0; i < l.Depth; i++ {
+		p += hash[i*l.Width:(i+1)*l.Width] + "/"
+	}
+	return p + hash
+}
+
+type layoutFile struct {
+	Version int `json:"version"`
+	Layout
+	Previous *Layout `json:"previous,omitempty"`
+}
+
+func readLayoutFile(dataDir string) (layoutFile, error) {
+	var lf layoutFile
+	data, err := ioutil.ReadFile(path.Join(dataDir, layoutFileName))
+	if err != nil {
+		return lf, err
+	}
+	if err := json.Unmarshal(data, &lf); err != nil {
+		return lf, err
+	}
+	if lf.Version != layoutFileVersion {
+		return lf, fmt.Errorf("unsupported layout file version %d", lf.Version)
+	}
+	if err := lf.Layout.Validate(); err != nil {
+		return lf, err
+	}
+	if lf.Previous != nil {
+		if err := lf.Previous.Validate(); err != nil {
+			return lf, err
+		}
+	}
+	return lf, nil
+}
+
+func writeLayoutFile(dataDir string, lf layoutFile, fileMode os.FileMode) error {
+	lf.Version = layoutFileVersion
+	data, err := json.MarshalIndent(lf, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dataDir, layoutFileName+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Chmod(fileMode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = commitFile(f.Name(), path.Join(dataDir, layoutFileName))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// LoadLayout returns the layout recorded in dataDir. A store without layout
+// file is either new, in which case it gets the configured layout, or was
+// created before layouts were configurable and uses the default layout.
+func LoadLayout(dataDir string, configured Layout, dirMode, fileMode os.FileMode) (Layout, *Layout, error) {
+	lf, err := readLayoutFile(dataDir)
+	if err == nil {
+		return lf.Layout, lf.Previous, nil
+	}
+	if !os.IsNotExist(err) {
+		return Layout{}, nil, err
+	}
+
+	entries, err := ioutil.ReadDir(dataDir)
+	if err != nil && !os.IsNotExist(err) {
+		return Layout{}, nil, err
+	}
+	lf.Layout = configured
+	if len(entries) > 0 {
+		lf.Layout = defaultLayout
+	}
+	if err := os.MkdirAll(dataDir, dirMode); err != nil {
+		return Layout{}, nil, err
+	}
+	return lf.Layout, nil, writeLayoutFile(dataDir, lf, fileMode)
+}
+
+// layoutState holds the layouts a store looks blobs up in and picks up
+// changes to the layout file made while the store is running.
+type layoutState struct {
+	mu       sync.Mutex
+	dataDir  string
+	current  Layout
+	previous *Layout
+	modTime  time.Time
+	checked  time.Time
+}
+
+func (s *layoutState) get() (Layout, *Layout) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dataDir == "" || time.Since(s.checked) < layoutRecheckInterval {
+		return s.current, s.previous
+	}
+	s.checked = time.Now()
+	info, err := os.Stat(path.Join(s.dataDir, layoutFileName))
+	if err != nil || info.ModTime().Equal(s.modTime) {
+		return s.current, s.previous
+	}
+	lf, err := readLayoutFile(s.dataDir)
+	if err != nil {
+		return s.current, s.previous
+	}
+	s.current, s.previous, s.modTime = lf.Layout, lf.Previous, info.ModTime()
+	return s.current, s.previous
+}
+
+// layouts returns every layout a blob may currently be found in, the
+// layout new blobs are written to first.
+func (s *layoutState) layouts() []Layout {
+	current, previous := s.get()
+	if previous == nil || *previous == current {
+		return []Layout{current}
+	}
+	return []Layout{current, *previous}
+}
+
+// walkBlobs calls fn for every blob file below dataDir with the hash and
+// extension taken from its name. Other files, apart from the layout file,
+// are counted as skipped.
+func walkBlobs(dataDir string, fn func(p, hash, ext string, info os.FileInfo) error) (skipped int, err error) {
+	return walkBlobsAfter(dataDir, "", fn)
+}
+
+// walkBlobsAfter is walkBlobs for the files that come after the path after
+// in lexical order, the order files are walked in.
+func walkBlobsAfter(dataDir, after string, fn func(p, hash, ext string, info os.FileInfo) error) (skipped int, err error) {
+	layoutPath := path.Join(dataDir, layoutFileName)
+	err = filepath.Walk(dataDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if after != "" && p <= after {
+			if info.IsDir() && p != dataDir && !strings.HasPrefix(after, p+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || p == layoutPath {
+			return nil
+		}
+		hash := blobHash(p)
+		ext := path.Base(p)[len(hash):]
+		if !isValidHash(hash) || (ext != "" && ext != ".gz" && ext != ".snappy") {
+			skipped++
+			return nil
+		}
+		return fn(p, hash, ext, info)
+	})
+	return
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLayout_Path(t *testing.T) {
+	cases := map[Layout]string{
+		{Depth: 2, Width: 3}: "D6E/C68/" + testFileDataContentHash,
+		{Depth: 3, Width: 2}: "D6/EC/68/" + testFileDataContentHash,
+		{Depth: 0, Width: 1}: testFileDataContentHash,
+	}
+	for layout, expected := range cases {
+		if result := layout.Path(testFileDataContentHash); result != expected {
+			t.Fail()
+			t.Logf("Layout %v Expected: %v Got: %v", layout, expected, result)
+		}
+	}
+}
+
+func TestLayout_Validate(t *testing.T) {
+	for _, l := range []Layout{{Depth: -1, Width: 2}, {Depth: 2, Width: 0}, {Depth: 8, Width: 8}} {
+		if l.Validate() == nil {
+			t.Fail()
+			t.Logf("Expected layout %v to be invalid", l)
+		}
+	}
+	if defaultLayout.Validate() != nil {
+		t.Fail()
+		t.Log("Expected default layout to be valid")
+	}
+}
+
+func TestLayout_LoadLayoutNewStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Skipf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	configured := Layout{Depth: 3, Width: 2}
+	layout, previous, err := LoadLayout(path.Join(dir, "data"), configured, 0755, 0644)
+	if err != nil || layout != configured || previous != nil {
+		t.Fail()
+		t.Logf("Expected new store to use %v Got: %v %v (%v)", configured, layout, previous, err)
+	}
+	lf, err := readLayoutFile(path.Join(dir, "data"))
+	if err != nil || lf.Layout != configured {
+		t.Fail()
+		t.Logf("Expected layout file with %v Got: %v (%v)", configured, lf.Layout, err)
+	}
+}
+
+func TestLayout_LoadLayoutLegacyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Skipf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(path.Join(dir, "D6E", "C68"), 0755)
+
+	layout, _, err := LoadLayout(dir, Layout{Depth: 3, Width: 2}, 0755, 0644)
+	if err != nil || layout != defaultLayout {
+		t.Fail()
+		t.Logf("Expected existing store without layout file to use %v Got: %v (%v)", defaultLayout, layout, err)
+	}
+}
+
+func TestLayout_StoreLooksUpPreviousLayout(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+
+	old := Layout{Depth: 1, Width: 4}
+	hash, err := store.Store(testFileDataContentB64)
+	if err != nil {
+		t.Fatalf("Unable to store blob: %v", err)
+	}
+	os.MkdirAll(path.Join(store.dataDir, "D6EC"), 0755)
+	os.Rename(store.makePath(hash)+".snappy", path.Join(store.dataDir, old.Path(hash))+".snappy")
+	if store.Exists(hash) {
+		t.Fail()
+		t.Log("Blob moved to another layout must not be found without previous layout")
+	}
+
+	store.layout.previous = &old
+	data, err := store.GetAsBase64(hash)
+	if err != nil || data != testFileDataContentB64 {
+		t.Fail()
+		t.Logf("Expected blob to be found in previous layout. Got: %v (%v)", data, err)
+	}
+}
+
+func TestLayout_StatePicksUpChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Skipf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	state := &layoutState{dataDir: dir, current: defaultLayout, checked: time.Now()}
+	next := Layout{Depth: 3, Width: 2}
+	writeLayoutFile(dir, layoutFile{Layout: next, Previous: &defaultLayout}, 0644)
+	if layouts := state.layouts(); len(layouts) != 1 || layouts[0] != defaultLayout {
+		t.Fail()
+		t.Logf("Expected layout file not to be read before recheck interval. Got: %v", layouts)
+	}
+	state.checked = time.Time{}
+	if layouts := state.layouts(); len(layouts) != 2 || layouts[0] != next || layouts[1] != defaultLayout {
+		t.Fail()
+		t.Logf("Expected new and previous layout. Got: %v", layouts)
+	}
+}
@@ -20,10 +20,12 @@ package main
 
 import (
 	"flag"
-	"fmt"
+	"log"
 	"net"
 	"os"
+	"path"
 	"runtime"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
@@ -31,21 +33,166 @@ import (
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	db, err := sqlx.Open("mysql", os.Getenv("ASSETSDBCON"))
+	config := RegisterFlags(flag.CommandLine)
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		cmd := findCommand(flag.Arg(0))
+		if cmd == nil {
+			usage()
+			os.Exit(2)
+		}
+		if err := cmd.Run(config, flag.Args()[1:]); err != nil {
+			log.Fatalf("ERROR: %v failed: %v\n", cmd.Name, err)
+		}
+		return
+	}
+
+	db, err := openDatabase()
 	if err != nil {
-		fmt.Errorf("ERROR: Unable to establish database connection: %v\n", err.Error())
+		log.Fatalf("ERROR: Unable to establish database connection: %v\n", err.Error())
+	}
+	if err := checkSchema(db, config.AutoMigrate); err != nil {
+		log.Fatalf("ERROR: %v\n", err)
 	}
 
-	var dataStore = flag.String("datastore", "asset/data", "Path to asset data store")
-	var spoolStore = flag.String("spoolstore", "asset/tmp", "Path to asset temporary data store")
-	var address = flag.String("address", "0.0.0.0:8003", "Address to listen to. Default: 0.0.0.0:8003")
-	flag.Parse()
+	store, packs, err := config.OpenStack()
+	if err != nil {
+		log.Fatalf("ERROR: Unable to open asset store: %v\n", err)
+	}
+	if packs != nil && config.PackCompactInterval > 0 {
+		go packs.Run(config.PackCompactInterval, nil)
+	}
 
-	listener, err := net.Listen("tcp", *address)
+	monitored := map[string]string{
+		"spoolstore": config.SpoolStore,
+	}
+	if fsStore, ok := store.(placer); ok {
+		sweeper := createSpoolSweeper(fsStore, config.SpoolMaxAge, config.SpoolPromote)
+		sweeper.sweepAndLog()
+		if config.SpoolSweepInterval > 0 {
+			go sweeper.Run(config.SpoolSweepInterval, nil)
+		}
+		disks := fsStore.dataDisks()
+		for i, disk := range disks {
+			monitored[dataStoreName(i, len(disks))] = disk.dataDir
+		}
+
+		if tree := disks[0].fsassets; tree != nil {
+			drain := func() { drainAndLog(fsStore, tree) }
+			drain()
+			if config.SpoolSweepInterval > 0 {
+				go every(config.SpoolSweepInterval, nil, drain)
+			}
+		}
+	}
+
+	if disks := localDisks(store); disks != nil && config.Scrub.Interval > 0 {
+		scrub := createScrubber(disks, packs, config.Scrub, config.QuarantineDir)
+		go scrub.Run(config.Scrub.Interval, nil)
+	}
+	if localDisks(store) != nil && config.GC.Interval > 0 {
+		gc := createGarbageCollector(CreateAssetModel(db), store, config.GC)
+		go gc.Run(config.GC.Interval, nil)
+	}
+	if (config.Expiry.After > 0 || len(config.Expiry.ByType) > 0) && config.Expiry.Interval > 0 {
+		opts, err := config.ExpiryOptions()
+		if err != nil {
+			log.Fatalf("ERROR: %v\n", err)
+		}
+		expiry := createExpirer(CreateAssetModel(db), store, opts)
+		go expiry.Run(config.Expiry.Interval, nil)
+	}
+
+	hot := unwrapStore(store)
+	if tiered, ok := unwrapStore(store).(*tieredStore); ok {
+		hot = tiered.hot
+		monitored["coldstore"] = tiered.cold.dataDir
+		if config.TierInterval > 0 {
+			mover := createTierMover(tiered, CreateAssetModel(db), config.TierAfter, config.AccessSlack())
+			go mover.Run(config.TierInterval, nil)
+		}
+	}
+
+	space := createSpaceMonitor(monitored, config.Watermarks)
+	if multi, ok := hot.(*multiStore); ok {
+		for i := range multi.disks {
+			space.pooled[dataStoreName(i, len(multi.disks))] = true
+		}
+		multi.full = func(i int) bool {
+			return space.Level(dataStoreName(i, len(multi.disks))) == spaceCritical
+		}
+	}
+	var guard StorageGuard
+	if config.SpaceCheckInterval > 0 {
+		space.Check()
+		go space.Run(config.SpaceCheckInterval, nil)
+		guard = space
+	}
+
+	if config.VerifyReads {
+		store = CreateVerifyStore(store, config.VerifyBuffer, config.QuarantineDir)
+	}
+
+	var access AccessRecorder
+	if config.AccessFlushInterval > 0 {
+		tracker := createAccessTracker(CreateAssetModel(db), config.AccessGranularity)
+		go tracker.Run(config.AccessFlushInterval, nil)
+		access = tracker
+	}
+
+	var temporary TemporaryAssets
+	switch config.Temporary.Mode {
+	case TemporaryCache:
+		opts := config.Temporary
+		if opts.Keys, err = config.LoadKeys(); err != nil {
+			log.Fatalf("ERROR: Unable to load encryption keys: %v\n", err)
+		}
+		temp, err := createTemporaryStore(opts)
+		if err != nil {
+			log.Fatalf("ERROR: Unable to create temporary asset store: %v\n", err)
+		}
+		go temp.Run(time.Minute, nil)
+		temporary = temp
+	case TemporaryReject:
+		temporary = rejectTemporary{}
+	}
+
+	var search SearchIndex
+	if config.Search {
+		// Text contents would be kept unencrypted
+		search = createSearchIndex(db, config.EncryptionKeys == "")
+	}
+
+	var uploads *uploadManager
+	if config.Uploads.TTL > 0 && config.EncryptionKeys != "" {
+		// Session data would be spooled unencrypted
+		log.Printf("Upload sessions are disabled with -encryption-keys\n")
+	} else if config.Uploads.TTL > 0 {
+		uploads, err = createUploadManager(path.Join(config.SpoolStore, uploadDirName), config.Uploads, guard)
+		if err != nil {
+			log.Fatalf("ERROR: Unable to open upload sessions: %v\n", err)
+		}
+		go uploads.Run(time.Minute, nil)
+	}
+
+	listener, err := net.Listen("tcp", config.Address)
 	if err != nil {
-		fmt.Errorf("Failed to listen to specified address: %v ERROR: %v\n", address, err)
+		log.Fatalf("Failed to listen to specified address: %v ERROR: %v\n", config.Address, err)
 	}
 
-	httpService := CreateHTTPService(db, *dataStore, *spoolStore)
+	httpService := CreateHTTPService(CreateService(db, store, guard, access, temporary, search), uploads)
+	if config.AdminAddress != "" {
+		adminListener, err := net.Listen("tcp", config.AdminAddress)
+		if err != nil {
+			log.Fatalf("Failed to listen to admin address: %v ERROR: %v\n", config.AdminAddress, err)
+		}
+		go httpService.RunAdmin(adminListener)
+	}
 	httpService.Run(listener)
 }
+
+func openDatabase() (*sqlx.DB, error) {
+	return sqlx.Open("mysql", os.Getenv("ASSETSDBCON"))
+}
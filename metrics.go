@@ -0,0 +1,35 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"expvar"
+)
+
+// stats holds all counters and gauges exported on /debug/vars.
+var stats = expvar.NewMap("snapper")
+
+func statAdd(name string, delta int64) {
+	stats.Add(name, delta)
+}
+
+func statSet(name string, value int64) {
+	stats.Add(name, 0)
+	stats.Get(name).(*expvar.Int).Set(value)
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+)
+
+// migration changes the schema of the database. Migrations are applied in
+// order and recorded in the migrations table, MySQL cannot roll back schema
+// changes so a failed migration has to be cleaned up by hand.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+var migrations = []migration{
+	{1, "Store creator, temporary and local flags of assets", []string{
+		"ALTER TABLE `fsassets` " +
+			"ADD COLUMN `creator_id` VARCHAR(128) NOT NULL DEFAULT '', " +
+			"ADD COLUMN `temporary` TINYINT(1) NOT NULL DEFAULT 0, " +
+			"ADD COLUMN `local` TINYINT(1) NOT NULL DEFAULT 0, " +
+			"ADD INDEX `snapper_creator_id` (`creator_id`)",
+	}},
+	{2, "Index the columns admin listings filter on", []string{
+		"ALTER TABLE `fsassets` " +
+			"ADD INDEX `snapper_type` (`type`), " +
+			"ADD INDEX `snapper_name` (`name`), " +
+			"ADD INDEX `snapper_hash` (`hash`), " +
+			"ADD INDEX `snapper_create_time` (`create_time`), " +
+			"ADD INDEX `snapper_access_time` (`access_time`)",
+	}},
+	{3, "Add the full-text search index", []string{
+		"CREATE TABLE `snapper_search` (" +
+			"`id` VARCHAR(64) NOT NULL PRIMARY KEY, " +
+			"`name` VARCHAR(255) NOT NULL DEFAULT '', " +
+			"`description` VARCHAR(255) NOT NULL DEFAULT '', " +
+			"`content` MEDIUMTEXT NOT NULL, " +
+			"FULLTEXT KEY `snapper_search_text` (`name`, `description`, `content`)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	}},
+}
+
+const createMigrationsTable = "CREATE TABLE IF NOT EXISTS `snapper_migrations` (" +
+	"`version` INT NOT NULL PRIMARY KEY, " +
+	"`description` VARCHAR(255) NOT NULL, " +
+	"`applied_time` INT NOT NULL)"
+
+// pendingMigrations returns the migrations not applied to db yet.
+func pendingMigrations(db Database) ([]migration, error) {
+	if _, err := db.Exec(createMigrationsTable); err != nil {
+		return nil, err
+	}
+	var versions []int
+	if err := db.Select(&versions, "SELECT `version` FROM `snapper_migrations`"); err != nil {
+		return nil, err
+	}
+	applied := map[int]bool{}
+	for _, v := range versions {
+		applied[v] = true
+	}
+	pending := []migration{}
+	for _, m := range migrations {
+		if !applied[m.version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations to db and returns how many it
+// applied.
+func Migrate(db Database) (int, error) {
+	pending, err := pendingMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	for n, m := range pending {
+		log.Printf("Migrate: applying %d: %v\n", m.version, m.description)
+		for _, statement := range m.statements {
+			if _, err := db.Exec(statement); err != nil {
+				return n, fmt.Errorf("migration %d: %v", m.version, err)
+			}
+		}
+		_, err := db.Exec("INSERT INTO `snapper_migrations` (`version`, `description`, `applied_time`) VALUES (?, ?, UNIX_TIMESTAMP(NOW()))",
+			m.version, m.description)
+		if err != nil {
+			return n, fmt.Errorf("migration %d: %v", m.version, err)
+		}
+	}
+	return len(pending), nil
+}
+
+// checkSchema makes sure the database has every migration applied, applying
+// them if auto is set.
+func checkSchema(db Database, auto bool) error {
+	if auto {
+		_, err := Migrate(db)
+		return err
+	}
+	pending, err := pendingMigrations(db)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d database migrations are pending, run the migrate command or start with -auto-migrate", len(pending))
+	}
+	return nil
+}
+
+func runMigrate(config *Config, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Parse(args)
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	applied, err := Migrate(db)
+	log.Printf("Migrate: applied %d migrations\n", applied)
+	return err
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+type mockMigrationDatabase struct {
+	applied []int
+	execs   []string
+}
+
+func (m *mockMigrationDatabase) Get(dest interface{}, query string, args ...interface{}) error {
+	return sql.ErrNoRows
+}
+
+func (m *mockMigrationDatabase) Select(dest interface{}, query string, args ...interface{}) error {
+	*dest.(*[]int) = append([]int{}, m.applied...)
+	return nil
+}
+
+func (m *mockMigrationDatabase) Exec(query string, args ...interface{}) (sql.Result, error) {
+	m.execs = append(m.execs, query)
+	if strings.HasPrefix(query, "INSERT INTO `snapper_migrations`") {
+		m.applied = append(m.applied, args[0].(int))
+	}
+	return nil, nil
+}
+
+func TestMigrate_Pending(t *testing.T) {
+	db := &mockMigrationDatabase{}
+	if err := checkSchema(db, false); err == nil {
+		t.Fail()
+		t.Log("Expected pending migrations to be reported")
+	}
+	if len(db.applied) != 0 {
+		t.Fail()
+		t.Logf("Expected no migration to be applied without auto. Got: %v", db.applied)
+	}
+
+	if err := checkSchema(db, true); err != nil || len(db.applied) != len(migrations) {
+		t.Fail()
+		t.Logf("Expected every migration to be applied. Got: %v (%v)", db.applied, err)
+	}
+	if err := checkSchema(db, false); err != nil {
+		t.Fail()
+		t.Logf("Expected an up to date schema to pass. Got: %v", err)
+	}
+
+	execs := len(db.execs)
+	if applied, err := Migrate(db); err != nil || applied != 0 || len(db.execs) != execs+1 {
+		t.Fail()
+		t.Logf("Expected applied migrations to be skipped. Got: %d (%v)", applied, err)
+	}
+}
@@ -20,6 +20,7 @@ package main
 
 import (
 	"database/sql"
+	"strings"
 )
 
 type AssetModel interface {
@@ -27,10 +28,88 @@ type AssetModel interface {
 	GetHash(id string) (hash string, err error)
 	GetHashAndType(id string) (hash string, assetType int8, err error)
 	Put(asset AssetBase) error
+	ColdHashes(before int64, after string, limit int) ([]string, error)
+	Refs(after string, limit int) ([]AssetRef, error)
+	MarkBroken(id string) error
+	Collectable(before int64, after string, limit int) ([]AssetRef, error)
+	DeleteCollectable(id string, before int64) (bool, error)
+	HashReferenced(hash string) (bool, error)
+	Touch(ids []string, at, before int64) error
+	List(filter AssetFilter, after string, limit int) ([]AssetBase, error)
+	IdsByHash(hash string, after string, limit int) ([]string, error)
+}
+
+// AssetFilter selects the assets List returns. Zero fields match every
+// asset, time ranges are unix times and include their bounds.
+type AssetFilter struct {
+	Type    int8
+	HasType bool
+	// Flags matches assets having all of these flags
+	Flags          int64
+	Creator        string
+	NamePrefix     string
+	Hash           string
+	CreatedAfter   int64
+	CreatedBefore  int64
+	AccessedAfter  int64
+	AccessedBefore int64
+}
+
+// where returns the conditions of f and their arguments.
+func (f AssetFilter) where() (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	add := func(condition string, arg interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+	if f.HasType {
+		add("`type` = ?", f.Type)
+	}
+	if f.Flags != 0 {
+		conditions = append(conditions, "`asset_flags` & ? = ?")
+		args = append(args, f.Flags, f.Flags)
+	}
+	if f.Creator != "" {
+		add("`creator_id` = ?", f.Creator)
+	}
+	if f.NamePrefix != "" {
+		add("`name` LIKE ?", likeEscaper.Replace(f.NamePrefix)+"%")
+	}
+	if f.Hash != "" {
+		add("`hash` = ?", strings.ToUpper(f.Hash))
+	}
+	if f.CreatedAfter != 0 {
+		add("`create_time` >= ?", f.CreatedAfter)
+	}
+	if f.CreatedBefore != 0 {
+		add("`create_time` <= ?", f.CreatedBefore)
+	}
+	if f.AccessedAfter != 0 {
+		add("`access_time` >= ?", f.AccessedAfter)
+	}
+	if f.AccessedBefore != 0 {
+		add("`access_time` <= ?", f.AccessedBefore)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// AssetRef is the part of an asset row maintenance tasks look at. Refs
+// only fills in the id, hash and flags.
+type AssetRef struct {
+	Id         string `db:"id"`
+	Hash       string `db:"hash"`
+	DBFlags    int64  `db:"asset_flags"`
+	Type       int8   `db:"type"`
+	Name       string `db:"name"`
+	AccessTime int64  `db:"access_time"`
 }
 
 type Database interface {
 	Get(dest interface{}, query string, args ...interface{}) error
+	Select(dest interface{}, query string, args ...interface{}) error
 	Exec(query string, args ...interface{}) (sql.Result, error)
 }
 
@@ -67,9 +146,107 @@ func (a *assetModel) GetHashAndType(id string) (hash string, assetType int8, err
 
 func (a *assetModel) Put(asset AssetBase) error {
 	asset.DBFlags = AssetFlagsFromString(asset.Flags)
-	_, err := a.db.Exec("INSERT INTO `fsassets` (id, type, hash, name, description, asset_flags, create_time, access_time)"+
-		"VALUES(?, ?, ?, ?, ?, ?, UNIX_TIMESTAMP(NOW()), UNIX_TIMESTAMP(NOW())) ON DUPLICATE KEY UPDATE type = ?, hash = ?, name = ?, description = ?, access_time = UNIX_TIMESTAMP(NOW()), asset_flags = ?",
-		asset.Id, asset.Type, asset.Hash, asset.Name, asset.Description, asset.DBFlags,
-		asset.Type, asset.Hash, asset.Name, asset.Description, asset.DBFlags)
+	_, err := a.db.Exec("INSERT INTO `fsassets` (id, type, hash, name, description, asset_flags, creator_id, temporary, local, create_time, access_time)"+
+		"VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, UNIX_TIMESTAMP(NOW()), UNIX_TIMESTAMP(NOW())) ON DUPLICATE KEY UPDATE type = ?, hash = ?, name = ?, description = ?, access_time = UNIX_TIMESTAMP(NOW()), asset_flags = ?, creator_id = ?, temporary = ?, local = ?",
+		asset.Id, asset.Type, asset.Hash, asset.Name, asset.Description, asset.DBFlags, asset.CreatorID, asset.Temporary, asset.Local,
+		asset.Type, asset.Hash, asset.Name, asset.Description, asset.DBFlags, asset.CreatorID, asset.Temporary, asset.Local)
 	return err
 }
+
+// ColdHashes returns up to limit hashes, ordered and starting after the
+// given one, of which no asset was accessed since the unix time before.
+// The hashes of assets not accessed since then are rechecked one by one for
+// another asset sharing them, rather than grouping the whole table.
+func (a *assetModel) ColdHashes(before int64, after string, limit int) (hashes []string, err error) {
+	err = a.db.Select(&hashes, "SELECT DISTINCT a.`hash` FROM `fsassets` a WHERE a.`hash` > ? AND a.`access_time` < ? "+
+		"AND NOT EXISTS (SELECT 1 FROM `fsassets` b WHERE b.`hash` = a.`hash` AND b.`access_time` >= ?) ORDER BY a.`hash` LIMIT ?",
+		after, before, before, limit)
+	return
+}
+
+// Refs returns up to limit assets, ordered by and starting after the given
+// id, with the hash of their blob.
+func (a *assetModel) Refs(after string, limit int) (refs []AssetRef, err error) {
+	err = a.db.Select(&refs, "SELECT `id`, `hash`, `asset_flags` FROM `fsassets` WHERE `id` > ? ORDER BY `id` LIMIT ?",
+		after, limit)
+	return
+}
+
+// MarkBroken flags an asset whose blob is lost. Storing the asset again
+// replaces its flags and so clears the mark.
+func (a *assetModel) MarkBroken(id string) error {
+	_, err := a.db.Exec("UPDATE `fsassets` SET `asset_flags` = `asset_flags` | ? WHERE `id` = ?", Broken, id)
+	return err
+}
+
+// Collectable returns up to limit collectable assets, ordered by and
+// starting after the given id, that were not accessed since the unix time
+// before.
+func (a *assetModel) Collectable(before int64, after string, limit int) (refs []AssetRef, err error) {
+	err = a.db.Select(&refs, "SELECT `id`, `hash`, `asset_flags`, `type`, `name`, `access_time` FROM `fsassets` "+
+		"WHERE `id` > ? AND `asset_flags` & ? != 0 AND `access_time` < ? ORDER BY `id` LIMIT ?",
+		after, Collectable, before, limit)
+	return
+}
+
+// DeleteCollectable deletes a collectable asset and its search index entry
+// if it still was not accessed since the unix time before and reports
+// whether it did.
+func (a *assetModel) DeleteCollectable(id string, before int64) (bool, error) {
+	result, err := a.db.Exec("DELETE a, s FROM `fsassets` a LEFT JOIN `snapper_search` s ON s.`id` = a.`id` "+
+		"WHERE a.`id` = ? AND a.`asset_flags` & ? != 0 AND a.`access_time` < ?",
+		id, Collectable, before)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// HashReferenced reports whether any asset refers to the blob hash.
+func (a *assetModel) HashReferenced(hash string) (bool, error) {
+	var count int
+	err := a.db.Get(&count, "SELECT COUNT(*) FROM `fsassets` WHERE `hash` = ?", hash)
+	return count > 0, err
+}
+
+// Touch sets the access time of the assets ids to the unix time at, unless
+// it was set after the unix time before.
+func (a *assetModel) Touch(ids []string, at, before int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := []interface{}{at}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	args = append(args, before)
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	_, err := a.db.Exec("UPDATE `fsassets` SET `access_time` = ? WHERE `id` IN ("+placeholders+") AND `access_time` < ?", args...)
+	return err
+}
+
+// List returns up to limit assets matching filter, ordered by and starting
+// after the given id.
+func (a *assetModel) List(filter AssetFilter, after string, limit int) (assets []AssetBase, err error) {
+	where, args := filter.where()
+	if where != "" {
+		where = " AND " + where
+	}
+	args = append([]interface{}{after}, args...)
+	args = append(args, limit)
+	err = a.db.Select(&assets, "SELECT * FROM `fsassets` WHERE `id` > ?"+where+" ORDER BY `id` LIMIT ?", args...)
+	for i := range assets {
+		assets[i].Flags = AssetFlagsToString(assets[i].DBFlags)
+		assets[i].FullId = assets[i].Id
+	}
+	return
+}
+
+// IdsByHash returns up to limit ids, ordered and starting after the given
+// one, of the assets referring to the blob hash.
+func (a *assetModel) IdsByHash(hash string, after string, limit int) (ids []string, err error) {
+	err = a.db.Select(&ids, "SELECT `id` FROM `fsassets` WHERE `hash` = ? AND `id` > ? ORDER BY `id` LIMIT ?",
+		hash, after, limit)
+	return
+}
@@ -20,6 +20,7 @@ package main
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"strings"
 	"testing"
 )
@@ -66,17 +67,32 @@ func (m *mockDatabase) Get(dest interface{}, query string, args ...interface{})
 	return nil
 }
 
+func (m *mockDatabase) Select(dest interface{}, query string, args ...interface{}) error {
+	placeholders := strings.Count(query, "?")
+	if len(args) != placeholders {
+		m.t.Fail()
+		m.t.Logf("Query requires %d parameters. Got: %d arguments", placeholders, len(args))
+	}
+	if hashes, ok := dest.(*[]string); ok && m.data.Hash > args[0].(string) {
+		*hashes = []string{m.data.Hash}
+	}
+	if refs, ok := dest.(*[]AssetRef); ok && m.data.Id > args[0].(string) {
+		*refs = []AssetRef{{Id: m.data.Id, Hash: m.data.Hash, DBFlags: m.data.DBFlags}}
+	}
+	return nil
+}
+
 func (m *mockDatabase) Exec(query string, args ...interface{}) (sql.Result, error) {
 	placeholders := strings.Count(query, "?")
 	if len(args) != placeholders {
 		m.t.Fail()
 		m.t.Logf("Upsert requires %d parameters. Got: %d arguments", placeholders, len(args))
-	} else if placeholders != 11 {
+	} else if placeholders != 17 {
 		m.t.Fail()
-		m.t.Log("This test was designed for 11 parameters and needs an update!")
+		m.t.Log("This test was designed for 17 parameters and needs an update!")
 	} else {
 		expectedFlags := AssetFlagsFromString(m.data.Flags)
-		if expectedFlags != args[5].(int64) || expectedFlags != args[10] {
+		if expectedFlags != args[5].(int64) || expectedFlags != args[13] {
 			m.t.Fail()
 			m.t.Logf("Expected flags to be converted")
 		}
@@ -113,25 +129,53 @@ func (m *mockDatabase) Exec(query string, args ...interface{}) (sql.Result, erro
 		m.t.Log("Expected sixth value to be a int64 with the asset flags")
 	}
 
-	if t, ok := args[6].(int8); !ok || t != m.data.Type {
+	m.data.CreatorID, ok = args[6].(string)
+	if !ok {
+		m.t.Fail()
+		m.t.Log("Expected seventh value to be a string with the creator id")
+	}
+	m.data.Temporary, ok = args[7].(bool)
+	if !ok {
+		m.t.Fail()
+		m.t.Log("Expected eighth value to be a bool with the temporary flag")
+	}
+	m.data.Local, ok = args[8].(bool)
+	if !ok {
+		m.t.Fail()
+		m.t.Log("Expected ninth value to be a bool with the local flag")
+	}
+
+	if t, ok := args[9].(int8); !ok || t != m.data.Type {
+		m.t.Fail()
+		m.t.Log("Asset type or value mismatch on type parameter on update")
+	}
+	if t, ok := args[10].(string); !ok || t != m.data.Hash {
+		m.t.Fail()
+		m.t.Log("Asset type or value mismatch on hash parameter on update")
+	}
+	if t, ok := args[11].(string); !ok || t != m.data.Name {
+		m.t.Fail()
+		m.t.Log("Asset type or value mismatch on name parameter on update")
+	}
+	if t, ok := args[12].(string); !ok || t != m.data.Description {
 		m.t.Fail()
-		m.t.Log("Asset type or value mismatch on seventh parameter on update")
+		m.t.Log("Asset type or value mismatch on description parameter on update")
 	}
-	if t, ok := args[7].(string); !ok || t != m.data.Hash {
+	if t, ok := args[13].(int64); !ok || t != m.data.DBFlags {
 		m.t.Fail()
-		m.t.Log("Asset type or value mismatch on eigth parameter on update")
+		m.t.Log("Asset type or value mismatch on flags parameter on update")
 	}
-	if t, ok := args[8].(string); !ok || t != m.data.Name {
+	if t, ok := args[14].(string); !ok || t != m.data.CreatorID {
 		m.t.Fail()
-		m.t.Log("Asset type or value mismatch on ninth parameter on update")
+		m.t.Log("Asset type or value mismatch on creator parameter on update")
 	}
-	if t, ok := args[9].(string); !ok || t != m.data.Description {
+	if t, ok := args[15].(bool); !ok || t != m.data.Temporary {
 		m.t.Fail()
-		m.t.Log("Asset type or value mismatch on tenth parameter on update")
+		m.t.Log("Asset type or value mismatch on temporary parameter on update")
 	}
-	if t, ok := args[10].(int64); !ok || t != m.data.DBFlags {
+	if t, ok := args[16].(bool); !ok || t != m.data.Local {
 		m.t.Fail()
-		m.t.Log("Asset type or value mismatch on eleventh parameter on update")
+		m.t.Log("Asset type or value mismatch on local parameter on update")
 	}
 
 	return nil, nil
@@ -201,3 +245,53 @@ func TestAssetModel_Put(t *testing.T) {
 		t.Logf("Expected DBFlags to be: %d Got: %d", m.data.DBFlags, data.DBFlags)
 	}
 }
+
+func TestAssetModel_ColdHashes(t *testing.T) {
+	m := &mockDatabase{t: t, data: testModelAssetInstance(true)}
+	hashes, err := CreateAssetModel(m).ColdHashes(1000, "", 10)
+	if err != nil || len(hashes) != 1 || hashes[0] != m.data.Hash {
+		t.Fail()
+		t.Logf("Expected hash %v. Got: %v (%v)", m.data.Hash, hashes, err)
+	}
+	hashes, _ = CreateAssetModel(m).ColdHashes(1000, m.data.Hash, 10)
+	if len(hashes) != 0 {
+		t.Fail()
+		t.Logf("Expected no hashes after the last one. Got: %v", hashes)
+	}
+}
+
+func TestAssetModel_Refs(t *testing.T) {
+	m := &mockDatabase{t: t, data: testModelAssetInstance(true)}
+	refs, err := CreateAssetModel(m).Refs("", 10)
+	if err != nil || len(refs) != 1 || refs[0].Id != m.data.Id || refs[0].Hash != m.data.Hash {
+		t.Fail()
+		t.Logf("Expected a reference to %v. Got: %v (%v)", m.data.Hash, refs, err)
+	}
+	refs, _ = CreateAssetModel(m).Refs(m.data.Id, 10)
+	if len(refs) != 0 {
+		t.Fail()
+		t.Logf("Expected no references after the last id. Got: %v", refs)
+	}
+}
+
+type mockDeleteDatabase struct {
+	mockMigrationDatabase
+}
+
+func (m *mockDeleteDatabase) Exec(query string, args ...interface{}) (sql.Result, error) {
+	m.execs = append(m.execs, query)
+	return driver.RowsAffected(2), nil
+}
+
+func TestAssetModel_DeleteCollectable(t *testing.T) {
+	db := &mockDeleteDatabase{}
+	deleted, err := CreateAssetModel(db).DeleteCollectable(testContentId, 1000)
+	if err != nil || !deleted {
+		t.Fail()
+		t.Logf("Expected the asset to be deleted. Got: %v (%v)", deleted, err)
+	}
+	if len(db.execs) != 1 || !strings.Contains(db.execs[0], "`snapper_search`") {
+		t.Fail()
+		t.Logf("Expected the search index entry to be deleted with the asset. Got: %v", db.execs)
+	}
+}
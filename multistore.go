@@ -0,0 +1,346 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DataDir is one directory of the data store with the share of new blobs
+// placed on it. A weight of zero drains the directory: blobs are still
+// found there but new ones go elsewhere and rebalance moves the rest away.
+type DataDir struct {
+	Path   string
+	Weight float64
+}
+
+// ParseDataDirs parses a comma separated list of directories, each with an
+// optional weight like "/disk1/assets:2,/disk2/assets".
+func ParseDataDirs(s string) ([]DataDir, error) {
+	dirs := []DataDir{}
+	seen := map[string]bool{}
+	active := false
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		dir := DataDir{Path: part, Weight: 1}
+		if idx := strings.LastIndex(part, ":"); idx > 0 {
+			if w, err := strconv.ParseFloat(part[idx+1:], 64); err == nil {
+				dir.Path, dir.Weight = part[:idx], w
+			}
+		}
+		if dir.Path == "" {
+			return nil, fmt.Errorf("empty data store directory in %q", s)
+		}
+		if dir.Weight < 0 || math.IsInf(dir.Weight, 0) || math.IsNaN(dir.Weight) {
+			return nil, fmt.Errorf("invalid weight for data store directory %v", dir.Path)
+		}
+		dir.Path = path.Clean(dir.Path)
+		if seen[dir.Path] {
+			return nil, fmt.Errorf("data store directory %v listed twice", dir.Path)
+		}
+		seen[dir.Path] = true
+		active = active || dir.Weight > 0
+		dirs = append(dirs, dir)
+	}
+	if !active {
+		return nil, errors.New("no data store directory with a weight above zero")
+	}
+	return dirs, nil
+}
+
+// dataStoreName is the name a data store directory is monitored and
+// reported under.
+func dataStoreName(i, n int) string {
+	if n == 1 {
+		return "datastore"
+	}
+	return "datastore" + strconv.Itoa(i)
+}
+
+// placer is implemented by the file system stores, which keep their blobs on
+// one or more local disks.
+type placer interface {
+	AssetStore
+	// placeBlob returns the disk a new blob for hash is written to.
+	placeBlob(hash string) *assetStore
+	dataDisks() []*assetStore
+	storeBytes(buffer []byte) (string, error)
+}
+
+// localDisks returns every directory of a file system store, including the
+// cold tier, nil for other backends.
+func localDisks(store AssetStore) []*assetStore {
+	switch s := store.(type) {
+	case *packStore:
+		return localDisks(s.large)
+	case *chunkStore:
+		return localDisks(s.inner)
+	case *verifyStore:
+		return localDisks(s.AssetStore)
+	case *tieredStore:
+		return append(append([]*assetStore{}, s.hot.dataDisks()...), s.cold)
+	case placer:
+		return s.dataDisks()
+	}
+	return nil
+}
+
+func (a *assetStore) placeBlob(hash string) *assetStore {
+	return a
+}
+
+func (a *assetStore) dataDisks() []*assetStore {
+	return []*assetStore{a}
+}
+
+// multiStore spreads blobs over several data directories. Every blob has a
+// preferred order of disks given by weighted rendezvous hashing of the disk
+// path and the hash, so adding or removing a disk only moves the blobs that
+// now rank it first.
+type multiStore struct {
+	disks   []*assetStore
+	weights []float64
+	// full reports whether disk i is too full to take new blobs.
+	full func(i int) bool
+}
+
+func CreateMultiStore(disks []*assetStore, weights []float64) *multiStore {
+	return &multiStore{
+		disks:   disks,
+		weights: weights,
+		full:    func(int) bool { return false },
+	}
+}
+
+// rank returns the disk indexes in order of preference for hash.
+func (m *multiStore) rank(hash string) []int {
+	scores := make([]float64, len(m.disks))
+	order := make([]int, len(m.disks))
+	for i, disk := range m.disks {
+		sum := sha256.Sum256([]byte(disk.dataDir + "/" + hash))
+		// Uniform in (0, 1), turned into a score that is proportional
+		// to the weight in the long run
+		u := (float64(binary.BigEndian.Uint64(sum[:8])>>11) + 0.5) / (1 << 53)
+		scores[i] = -m.weights[i] / math.Log(u)
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return scores[order[a]] > scores[order[b]]
+	})
+	return order
+}
+
+// candidates returns the disks that can take a new blob for hash, most
+// preferred first.
+func (m *multiStore) candidates(hash string) []*assetStore {
+	result := []*assetStore{}
+	for _, i := range m.rank(hash) {
+		if m.weights[i] > 0 && !m.full(i) {
+			result = append(result, m.disks[i])
+		}
+	}
+	return result
+}
+
+func (m *multiStore) placeBlob(hash string) *assetStore {
+	if candidates := m.candidates(hash); len(candidates) > 0 {
+		return candidates[0]
+	}
+	for _, i := range m.rank(hash) {
+		if m.weights[i] > 0 {
+			return m.disks[i]
+		}
+	}
+	return m.disks[0]
+}
+
+func (m *multiStore) dataDisks() []*assetStore {
+	return m.disks
+}
+
+// exists looks for hash on every disk, the preferred ones first. Assets of
+// an FSAssets tree are served through the first disk.
+func (m *multiStore) exists(hash string) (string, bool) {
+	for _, i := range m.rank(hash) {
+		if spath, found := m.disks[i].findOwn(hash); found {
+			return spath, true
+		}
+	}
+	if first := m.disks[0]; first.fsassets != nil {
+		if p, found := first.fsassets.find(hash); found {
+			return first.adoptFSAssets(hash, p), true
+		}
+	}
+	return "", false
+}
+
+func (m *multiStore) Exists(hash string) bool {
+	_, exists := m.exists(hash)
+	return exists
+}
+
+func (m *multiStore) Load(hash string) (io.ReadCloser, error) {
+	// A running rebalance may move the blob between finding and opening it
+	for attempt := 0; ; attempt++ {
+		spath, exists := m.exists(hash)
+		if !exists {
+			return nil, &os.PathError{Op: "open", Path: hash, Err: os.ErrNotExist}
+		}
+		f, e := os.Open(spath)
+		if os.IsNotExist(e) && attempt == 0 {
+			continue
+		}
+		if e != nil {
+			return nil, e
+		}
+		return newAssetReader(f, blobFormat(f.Name()), m.disks[0].keys)
+	}
+}
+
+func (m *multiStore) Store(data string) (string, error) {
+	buffer, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+	return m.storeBytes(buffer)
+}
+
+func (m *multiStore) storeBytes(buffer []byte) (hash string, err error) {
+	hash = makeHash(buffer)
+	if touchBlob(m, hash) {
+		return hash, nil
+	}
+	// Fall back to the next disk when one fills up before the space
+	// monitor noticed
+	for _, disk := range m.candidates(hash) {
+		_, err = disk.storeBytes(buffer)
+		if !errors.Is(err, syscall.ENOSPC) && !errors.Is(err, syscall.EDQUOT) {
+			return hash, err
+		}
+		log.Printf("Data store %v is full: %v\n", disk.dataDir, err)
+	}
+	return hash, ErrInsufficientStorage
+}
+
+func (m *multiStore) GetAsBase64(hash string) (string, error) {
+	return loadAsBase64(m, hash)
+}
+
+type RebalanceReport struct {
+	Moved      int
+	Duplicates int
+	Skipped    int
+	Failed     int
+	Bytes      int64
+}
+
+// Rebalance moves every blob that is not on the disk it would be placed on
+// today to that disk. Blobs stay readable throughout: they are copied to
+// their new disk before being removed from the old one.
+func (m *multiStore) Rebalance(dryRun bool) (report RebalanceReport, err error) {
+	for _, disk := range m.disks {
+		var skipped int
+		skipped, err = walkBlobs(disk.dataDir, func(p, hash, ext string, info os.FileInfo) error {
+			target := m.placeBlob(hash)
+			if target == disk {
+				return nil
+			}
+			if _, found := target.findOwn(hash); found {
+				report.Duplicates++
+				if dryRun {
+					return nil
+				}
+				return os.Remove(p)
+			}
+			report.Moved++
+			report.Bytes += info.Size()
+			if dryRun {
+				return nil
+			}
+			if err := moveBlob(p, target, hash); err != nil {
+				log.Printf("Rebalance: failed to move %v to %v: %v\n", p, target.dataDir, err)
+				report.Moved--
+				report.Bytes -= info.Size()
+				report.Failed++
+			}
+			if report.Moved > 0 && report.Moved%10000 == 0 {
+				log.Printf("Rebalance: moved %d blobs\n", report.Moved)
+			}
+			return nil
+		})
+		report.Skipped += skipped
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func runRebalance(config *Config, args []string) error {
+	fs := flag.NewFlagSet("rebalance", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only report what would be moved")
+	fs.Parse(args)
+
+	store, err := config.OpenStore()
+	if err != nil {
+		return err
+	}
+	if tiered, ok := store.(*tieredStore); ok {
+		store = tiered.hot
+	}
+	multi, ok := store.(*multiStore)
+	if !ok {
+		return errors.New("rebalance needs more than one data store directory")
+	}
+	monitored := map[string]string{}
+	for i, disk := range multi.disks {
+		monitored[dataStoreName(i, len(multi.disks))] = disk.dataDir
+	}
+	space := createSpaceMonitor(monitored, config.Watermarks)
+	space.Check()
+	multi.full = func(i int) bool {
+		return space.Level(dataStoreName(i, len(multi.disks))) == spaceCritical
+	}
+
+	report, err := multi.Rebalance(*dryRun)
+	verb := "moved"
+	if *dryRun {
+		verb = "would move"
+	}
+	log.Printf("Rebalance: %v %d blobs (%d bytes), removed %d duplicates, %d failed, skipped %d unknown files\n",
+		verb, report.Moved, report.Bytes, report.Duplicates, report.Failed, report.Skipped)
+	return err
+}
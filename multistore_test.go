@@ -0,0 +1,204 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func base64Of(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func testMultiStore(t *testing.T, weights ...float64) (*multiStore, func()) {
+	dir, err := ioutil.TempDir("", "multistore")
+	if err != nil {
+		t.Skipf("Unable to create temp dir: %v", err)
+	}
+	disks := []*assetStore{}
+	for i := range weights {
+		disks = append(disks, CreateAssetStore(StoreOptions{
+			DataDir:  path.Join(dir, fmt.Sprintf("disk%d", i)),
+			SpoolDir: path.Join(dir, "tmp"),
+			DirMode:  0755,
+			FileMode: 0644,
+		}).(*assetStore))
+	}
+	return CreateMultiStore(disks, weights), func() { os.RemoveAll(dir) }
+}
+
+func TestMultiStore_ParseDataDirs(t *testing.T) {
+	dirs, err := ParseDataDirs("/disk1/assets:2, /disk2/assets,/disk3/assets:0")
+	expected := []DataDir{{"/disk1/assets", 2}, {"/disk2/assets", 1}, {"/disk3/assets", 0}}
+	if err != nil || fmt.Sprint(dirs) != fmt.Sprint(expected) {
+		t.Fail()
+		t.Logf("Expected: %v Got: %v (%v)", expected, dirs, err)
+	}
+	if dirs, err := ParseDataDirs("C:/assets"); err != nil || dirs[0].Path != "C:/assets" {
+		t.Fail()
+		t.Logf("Expected a colon without weight to be part of the path. Got: %v (%v)", dirs, err)
+	}
+	for _, in := range []string{"a:0", "a,a", "a:-1", "a,,b"} {
+		if _, err := ParseDataDirs(in); err == nil {
+			t.Fail()
+			t.Logf("Expected %q to be rejected", in)
+		}
+	}
+}
+
+func TestMultiStore_Placement(t *testing.T) {
+	store, cleanup := testMultiStore(t, 3, 1, 0)
+	defer cleanup()
+
+	counts := map[*assetStore]int{}
+	for i := 0; i < 4000; i++ {
+		hash := makeHash([]byte(fmt.Sprint(i)))
+		disk := store.placeBlob(hash)
+		if disk != store.placeBlob(hash) {
+			t.Fatalf("Placement of %v is not deterministic", hash)
+		}
+		counts[disk]++
+	}
+	if counts[store.disks[2]] != 0 {
+		t.Fail()
+		t.Logf("Expected no blobs on a disk with weight 0. Got: %d", counts[store.disks[2]])
+	}
+	if share := float64(counts[store.disks[0]]) / 4000; share < 0.7 || share > 0.8 {
+		t.Fail()
+		t.Logf("Expected about 75%% of the blobs on the heavier disk. Got: %v", share)
+	}
+
+	store.full = func(i int) bool { return i == 0 }
+	for i := 0; i < 100; i++ {
+		if store.placeBlob(makeHash([]byte(fmt.Sprint(i)))) != store.disks[1] {
+			t.Fatal("Expected a full disk to be skipped")
+		}
+	}
+}
+
+func TestMultiStore_StoreAndLoad(t *testing.T) {
+	store, cleanup := testMultiStore(t, 1, 1)
+	defer cleanup()
+
+	hash, err := store.Store(testFileDataContentB64)
+	if err != nil || hash != testFileDataContentHash {
+		t.Fatalf("Unexpected store result: %v (%v)", hash, err)
+	}
+	disk := store.placeBlob(hash)
+	if _, found := disk.findOwn(hash); !found {
+		t.Fail()
+		t.Log("Expected blob on the disk it is placed on")
+	}
+
+	// A blob on another disk than its placement is still found and not
+	// stored a second time
+	placed := store.placeBlob(emptyTestFileDataContentHash)
+	other := store.disks[0]
+	if other == placed {
+		other = store.disks[1]
+	}
+	other.storeBytes([]byte{})
+	if _, err := store.Store(emptyTestFileDataContentB64); err != nil {
+		t.Fail()
+		t.Logf("Unexpected store error: %v", err)
+	}
+	if _, found := placed.findOwn(emptyTestFileDataContentHash); found {
+		t.Fail()
+		t.Log("Expected existing blob not to be written again")
+	}
+	for _, h := range []string{testFileDataContentHash, emptyTestFileDataContentHash} {
+		if !store.Exists(h) {
+			t.Fail()
+			t.Logf("Expected %v to exist", h)
+		}
+	}
+	data, err := store.GetAsBase64(testFileDataContentHash)
+	if err != nil || data != testFileDataContentB64 {
+		t.Fail()
+		t.Logf("Unexpected data: %v (%v)", data, err)
+	}
+	if _, err := store.Load(strings.Repeat("A", 64)); !os.IsNotExist(err) {
+		t.Fail()
+		t.Logf("Expected missing blob to be reported as not existing. Got: %v", err)
+	}
+
+	store.full = func(int) bool { return true }
+	if _, err := store.Store(base64Of("new content")); err != ErrInsufficientStorage {
+		t.Fail()
+		t.Logf("Expected all disks full to be rejected. Got: %v", err)
+	}
+}
+
+func TestMultiStore_Rebalance(t *testing.T) {
+	store, cleanup := testMultiStore(t, 1, 1, 0)
+	defer cleanup()
+
+	// Everything starts out on the draining disk
+	hashes := []string{}
+	for i := 0; i < 20; i++ {
+		hash, err := store.disks[2].storeBytes([]byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatalf("Unable to store blob: %v", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	// and one of them is already on its new disk as well
+	store.placeBlob(hashes[0]).storeBytes([]byte("0"))
+
+	report, err := store.Rebalance(true)
+	if err != nil || report.Moved != 19 || report.Duplicates != 1 {
+		t.Fail()
+		t.Logf("Unexpected dry run report: %+v (%v)", report, err)
+	}
+	if _, found := store.disks[2].findOwn(hashes[5]); !found {
+		t.Fatal("Expected dry run to leave blobs in place")
+	}
+
+	report, err = store.Rebalance(false)
+	if err != nil || report.Moved != 19 || report.Duplicates != 1 || report.Failed != 0 {
+		t.Fail()
+		t.Logf("Unexpected report: %+v (%v)", report, err)
+	}
+	for i, hash := range hashes {
+		if _, found := store.disks[2].findOwn(hash); found {
+			t.Fail()
+			t.Logf("Expected %v to be moved off the draining disk", hash)
+		}
+		if _, found := store.placeBlob(hash).findOwn(hash); !found {
+			t.Fail()
+			t.Logf("Expected %v on its placement disk", hash)
+		}
+		data, err := store.GetAsBase64(hash)
+		if err != nil || data != base64Of(fmt.Sprint(i)) {
+			t.Fail()
+			t.Logf("Unexpected data for %v: %v (%v)", hash, data, err)
+		}
+	}
+
+	if report, err := store.Rebalance(false); err != nil || report.Moved != 0 {
+		t.Fail()
+		t.Logf("Expected a balanced store to stay as it is. Got: %+v (%v)", report, err)
+	}
+}
@@ -0,0 +1,628 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Small blobs are appended to segment files instead of getting a file of
+// their own. Every record of a segment is
+//
+//	magic "SPK1" | kind | sha256 (32) | payload length (4) | crc32 (4) | payload
+//
+// where kind is a put, whose payload is the blob exactly as it would be
+// stored in a .snappy file, or a delete without payload. The crc covers
+// everything after the magic. Segments are only ever appended to, so after
+// a crash at most the tail of the last segment is torn and cut off again
+// when the store is opened. Sealed segments get an index file listing their
+// records, so only the active segment has to be scanned on startup.
+const (
+	packRecordMagic = "SPK1"
+	packIndexMagic  = "SPX1"
+	packHeaderSize  = len(packRecordMagic) + 1 + sha256.Size + 4 + 4
+	packSegmentExt  = ".pack"
+	packIndexExt    = ".idx"
+	// packLockName is locked by the process that has the pack store open
+	packLockName = "snapper.lock"
+
+	packPut    = 'P'
+	packDelete = 'D'
+)
+
+var (
+	errPackRecord = errors.New("invalid pack record")
+	errLocked     = errors.New("locked by another process")
+)
+
+type PackOptions struct {
+	Dir string
+	// Blobs up to MaxBlobSize bytes are packed, larger ones stored as files
+	MaxBlobSize int
+	SegmentSize int64
+	// Segments of which at least CompactRatio is unused are compacted
+	CompactRatio float64
+	DirMode      os.FileMode
+	FileMode     os.FileMode
+	Keys         *keyRing
+}
+
+// packRecord is a record of a segment as listed in the index.
+type packRecord struct {
+	kind   byte
+	hash   string
+	offset int64 // of the payload
+	length uint32
+}
+
+type packEntry struct {
+	segment uint32
+	offset  int64
+	length  uint32
+}
+
+type packSegment struct {
+	f    *os.File
+	size int64
+	// live counts the bytes of records the index still refers to
+	live int64
+}
+
+// packStore keeps small blobs in segment files and hands everything else to
+// the large store.
+type packStore struct {
+	PackOptions
+	large placer
+	lock  *os.File
+
+	mu       sync.RWMutex
+	index    map[string]packEntry
+	segments map[uint32]*packSegment
+	active   uint32
+	// records of the active segment, written to its index when sealed
+	records []packRecord
+}
+
+// OpenPackStore opens the segments in opts.Dir. The active segment is
+// repaired and appended to, so a pack directory is only opened by one
+// process at a time.
+func OpenPackStore(opts PackOptions, large placer) (*packStore, error) {
+	if err := os.MkdirAll(opts.Dir, opts.DirMode); err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(path.Join(opts.Dir, packLockName), opts.FileMode)
+	if err == errLocked {
+		return nil, fmt.Errorf("pack directory %v is in use by another process", opts.Dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(opts.Dir)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	ids := []uint32{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, packSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, packSegmentExt), 10, 32)
+		if err == nil {
+			ids = append(ids, uint32(id))
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	p := &packStore{
+		PackOptions: opts,
+		large:       large,
+		lock:        lock,
+		index:       map[string]packEntry{},
+		segments:    map[uint32]*packSegment{},
+	}
+	for n, id := range ids {
+		if err := p.openSegment(id, n == len(ids)-1); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	if len(ids) == 0 {
+		if err := p.createSegment(1); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	statSet("pack.blobs", int64(len(p.index)))
+	return p, nil
+}
+
+func (p *packStore) segmentPath(id uint32, ext string) string {
+	return path.Join(p.Dir, fmt.Sprintf("%08d%s", id, ext))
+}
+
+// openSegment loads the records of segment id into the index. The active
+// segment is scanned and cut off after its last complete record.
+func (p *packStore) openSegment(id uint32, active bool) error {
+	f, err := os.OpenFile(p.segmentPath(id, packSegmentExt), os.O_RDWR, p.FileMode)
+	if err != nil {
+		return err
+	}
+	seg := &packSegment{f: f}
+	p.segments[id] = seg
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	seg.size = info.Size()
+
+	var records []packRecord
+	if !active {
+		records, err = readPackIndex(p.segmentPath(id, packIndexExt), seg.size)
+	}
+	if active || err != nil {
+		var valid int64
+		records, valid, err = scanPackSegment(f)
+		if err != nil {
+			return err
+		}
+		if valid != seg.size {
+			log.Printf("Pack segment %v: cutting off %d bytes of incomplete records\n", f.Name(), seg.size-valid)
+			if err := f.Truncate(valid); err != nil {
+				return err
+			}
+			seg.size = valid
+		}
+		if !active {
+			if err := writePackIndex(p.segmentPath(id, packIndexExt), seg.size, records, p.FileMode); err != nil {
+				log.Printf("Pack segment %v: unable to write index: %v\n", f.Name(), err)
+			}
+		}
+	}
+	for _, r := range records {
+		p.apply(id, r)
+	}
+	if active {
+		p.active, p.records = id, records
+	}
+	return nil
+}
+
+func (p *packStore) createSegment(id uint32) error {
+	f, err := os.OpenFile(p.segmentPath(id, packSegmentExt), os.O_RDWR|os.O_CREATE|os.O_EXCL, p.FileMode)
+	if err != nil {
+		return err
+	}
+	p.segments[id] = &packSegment{f: f}
+	p.active, p.records = id, nil
+	return syncDir(p.Dir)
+}
+
+// apply updates the index with a record of segment id.
+func (p *packStore) apply(id uint32, r packRecord) {
+	if old, ok := p.index[r.hash]; ok {
+		if seg := p.segments[old.segment]; seg != nil {
+			seg.live -= int64(packHeaderSize) + int64(old.length)
+		}
+		delete(p.index, r.hash)
+	}
+	if r.kind == packPut {
+		p.index[r.hash] = packEntry{segment: id, offset: r.offset, length: r.length}
+		p.segments[id].live += int64(packHeaderSize) + int64(r.length)
+	}
+}
+
+// appendRecord writes a record to the active segment, sealing it first when
+// it is full. The caller holds the write lock.
+func (p *packStore) appendRecord(kind byte, hash string, payload []byte, sync bool) error {
+	raw, err := hex.DecodeString(hash)
+	if err != nil || len(raw) != sha256.Size {
+		return errPackRecord
+	}
+	seg := p.segments[p.active]
+	if seg.size > 0 && seg.size+int64(packHeaderSize+len(payload)) > p.SegmentSize {
+		if err := p.seal(); err != nil {
+			return err
+		}
+		seg = p.segments[p.active]
+	}
+
+	rec := make([]byte, packHeaderSize, packHeaderSize+len(payload))
+	copy(rec, packRecordMagic)
+	rec[4] = kind
+	copy(rec[5:], raw)
+	binary.BigEndian.PutUint32(rec[5+sha256.Size:], uint32(len(payload)))
+	rec = append(rec, payload...)
+	crc := crc32.ChecksumIEEE(rec[4 : packHeaderSize-4])
+	crc = crc32.Update(crc, crc32.IEEETable, payload)
+	binary.BigEndian.PutUint32(rec[packHeaderSize-4:], crc)
+
+	_, err = seg.f.WriteAt(rec, seg.size)
+	if err == nil && sync {
+		err = seg.f.Sync()
+	}
+	if err != nil {
+		seg.f.Truncate(seg.size)
+		return err
+	}
+	r := packRecord{kind: kind, hash: hash, offset: seg.size + int64(packHeaderSize), length: uint32(len(payload))}
+	seg.size += int64(len(rec))
+	p.records = append(p.records, r)
+	p.apply(p.active, r)
+	return nil
+}
+
+// seal writes the index of the active segment and starts a new one.
+func (p *packStore) seal() error {
+	seg := p.segments[p.active]
+	if err := seg.f.Sync(); err != nil {
+		return err
+	}
+	if err := writePackIndex(p.segmentPath(p.active, packIndexExt), seg.size, p.records, p.FileMode); err != nil {
+		return err
+	}
+	return p.createSegment(p.active + 1)
+}
+
+func (p *packStore) placeBlob(hash string) *assetStore {
+	return p.large.placeBlob(hash)
+}
+
+func (p *packStore) dataDisks() []*assetStore {
+	return p.large.dataDisks()
+}
+
+func (p *packStore) Exists(hash string) bool {
+	p.mu.RLock()
+	_, found := p.index[hash]
+	p.mu.RUnlock()
+	return found || p.large.Exists(hash)
+}
+
+func (p *packStore) Load(hash string) (io.ReadCloser, error) {
+	p.mu.RLock()
+	entry, found := p.index[hash]
+	if !found {
+		p.mu.RUnlock()
+		return p.large.Load(hash)
+	}
+	payload := make([]byte, entry.length)
+	_, err := p.segments[entry.segment].f.ReadAt(payload, entry.offset)
+	p.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return newAssetReader(ioutil.NopCloser(bytes.NewReader(payload)), formatSnappy, p.Keys)
+}
+
+func (p *packStore) Store(data string) (string, error) {
+	buffer, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+	return p.storeBytes(buffer)
+}
+
+func (p *packStore) storeBytes(buffer []byte) (string, error) {
+	if len(buffer) > p.MaxBlobSize {
+		return p.large.storeBytes(buffer)
+	}
+	hash := makeHash(buffer)
+	if touchBlob(p, hash) {
+		return hash, nil
+	}
+	var payload bytes.Buffer
+	if err := encodeBlob(&payload, buffer, true, p.Keys); err != nil {
+		return hash, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, found := p.index[hash]; found {
+		return hash, nil
+	}
+	if err := p.appendRecord(packPut, hash, payload.Bytes(), true); err != nil {
+		return hash, err
+	}
+	statSet("pack.blobs", int64(len(p.index)))
+	return hash, nil
+}
+
+func (p *packStore) GetAsBase64(hash string) (string, error) {
+	return loadAsBase64(p, hash)
+}
+
+// Delete removes a packed blob. Its space is given back by compaction.
+func (p *packStore) Delete(hash string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, found := p.index[hash]; !found {
+		return &os.PathError{Op: "delete", Path: hash, Err: os.ErrNotExist}
+	}
+	if err := p.appendRecord(packDelete, hash, nil, true); err != nil {
+		return err
+	}
+	statSet("pack.blobs", int64(len(p.index)))
+	return nil
+}
+
+type CompactReport struct {
+	Segments   int
+	Moved      int
+	BytesFreed int64
+}
+
+// Compact copies the blobs still in use out of sealed segments that are
+// mostly unused and removes those segments. Blobs stay readable throughout,
+// the index is switched to the copy before a segment is removed.
+func (p *packStore) Compact() (report CompactReport, err error) {
+	p.mu.RLock()
+	candidates := []uint32{}
+	oldest := p.active
+	for id, seg := range p.segments {
+		if id < oldest {
+			oldest = id
+		}
+		if id != p.active && seg.size > 0 && float64(seg.size-seg.live)/float64(seg.size) >= p.CompactRatio {
+			candidates = append(candidates, id)
+		}
+	}
+	p.mu.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+
+	for _, id := range candidates {
+		var moved int
+		var freed int64
+		moved, freed, err = p.compactSegment(id, id == oldest)
+		if err != nil {
+			return
+		}
+		report.Segments++
+		report.Moved += moved
+		report.BytesFreed += freed
+	}
+	return
+}
+
+func (p *packStore) compactSegment(id uint32, oldest bool) (moved int, freed int64, err error) {
+	p.mu.RLock()
+	seg := p.segments[id]
+	p.mu.RUnlock()
+	// Sealed segments are never written to again, so reading it does not
+	// need the lock
+	records, _, err := scanPackSegment(seg.f)
+	if err != nil {
+		return
+	}
+	for _, r := range records {
+		payload := make([]byte, r.length)
+		if _, err = seg.f.ReadAt(payload, r.offset); err != nil {
+			return
+		}
+		p.mu.Lock()
+		entry, found := p.index[r.hash]
+		switch {
+		case r.kind == packPut && found && entry.segment == id && entry.offset == r.offset:
+			err = p.appendRecord(packPut, r.hash, payload, false)
+			moved++
+		case r.kind == packDelete && !found && !oldest:
+			// The deleted blob may still be in an older segment
+			err = p.appendRecord(packDelete, r.hash, nil, false)
+		}
+		p.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err = p.segments[p.active].f.Sync(); err != nil {
+		return
+	}
+	freed = seg.size
+	seg.f.Close()
+	delete(p.segments, id)
+	os.Remove(p.segmentPath(id, packIndexExt))
+	if err = os.Remove(p.segmentPath(id, packSegmentExt)); err != nil {
+		return
+	}
+	err = syncDir(p.Dir)
+	return
+}
+
+// Run compacts the segments every interval until stop is closed.
+func (p *packStore) Run(interval time.Duration, stop <-chan struct{}) {
+	every(interval, stop, p.compactAndLog)
+}
+
+func (p *packStore) compactAndLog() {
+	report, err := p.Compact()
+	if err != nil {
+		log.Printf("Pack compaction failed: %v\n", err)
+	}
+	if report.Segments > 0 {
+		log.Printf("Pack compaction: compacted %d segments, moved %d blobs, freed %d bytes\n",
+			report.Segments, report.Moved, report.BytesFreed)
+	}
+}
+
+func (p *packStore) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, seg := range p.segments {
+		seg.f.Close()
+	}
+	return p.lock.Close()
+}
+
+// scanPackSegment reads every record of a segment. It returns the records
+// up to the first incomplete or corrupt one and the size they take.
+func scanPackSegment(f *os.File) (records []packRecord, valid int64, err error) {
+	r := bufio.NewReaderSize(io.NewSectionReader(f, 0, 1<<62), 1<<16)
+	header := make([]byte, packHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return records, valid, nil
+		}
+		length := binary.BigEndian.Uint32(header[5+sha256.Size:])
+		if string(header[:4]) != packRecordMagic || (header[4] != packPut && header[4] != packDelete) {
+			return records, valid, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return records, valid, nil
+		}
+		crc := crc32.ChecksumIEEE(header[4 : packHeaderSize-4])
+		crc = crc32.Update(crc, crc32.IEEETable, payload)
+		if crc != binary.BigEndian.Uint32(header[packHeaderSize-4:]) {
+			return records, valid, nil
+		}
+		records = append(records, packRecord{
+			kind:   header[4],
+			hash:   strings.ToUpper(hex.EncodeToString(header[5 : 5+sha256.Size])),
+			offset: valid + int64(packHeaderSize),
+			length: length,
+		})
+		valid += int64(packHeaderSize) + int64(length)
+	}
+}
+
+// writePackIndex stores the records of a sealed segment of the given size.
+func writePackIndex(name string, size int64, records []packRecord, fileMode os.FileMode) error {
+	buf := bytes.NewBufferString(packIndexMagic)
+	binary.Write(buf, binary.BigEndian, size)
+	for _, r := range records {
+		raw, _ := hex.DecodeString(r.hash)
+		buf.WriteByte(r.kind)
+		buf.Write(raw)
+		binary.Write(buf, binary.BigEndian, r.offset)
+		binary.Write(buf, binary.BigEndian, r.length)
+	}
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	f, err := ioutil.TempFile(path.Dir(name), path.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Chmod(fileMode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = commitFile(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// readPackIndex loads the index of a segment, which must still have the
+// size recorded in the index.
+func readPackIndex(name string, size int64) ([]packRecord, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	const entrySize = 1 + sha256.Size + 8 + 4
+	body := len(data) - 4
+	if body < len(packIndexMagic)+8 || (body-len(packIndexMagic)-8)%entrySize != 0 ||
+		string(data[:len(packIndexMagic)]) != packIndexMagic ||
+		crc32.ChecksumIEEE(data[:body]) != binary.BigEndian.Uint32(data[body:]) {
+		return nil, fmt.Errorf("%v: corrupt pack index", name)
+	}
+	if int64(binary.BigEndian.Uint64(data[len(packIndexMagic):])) != size {
+		return nil, fmt.Errorf("%v: pack index does not match its segment", name)
+	}
+	records := []packRecord{}
+	for off := len(packIndexMagic) + 8; off < body; off += entrySize {
+		records = append(records, packRecord{
+			kind:   data[off],
+			hash:   strings.ToUpper(hex.EncodeToString(data[off+1 : off+1+sha256.Size])),
+			offset: int64(binary.BigEndian.Uint64(data[off+1+sha256.Size:])),
+			length: binary.BigEndian.Uint32(data[off+1+sha256.Size+8:]),
+		})
+	}
+	return records, nil
+}
+
+// unwrapStore returns the store below the pack and chunk stores, which
+// only handle blobs of some sizes themselves.
+func unwrapStore(store AssetStore) AssetStore {
+	for {
+		switch s := store.(type) {
+		case *packStore:
+			store = s.large
+		case *chunkStore:
+			store = s.inner
+		case *verifyStore:
+			store = s.AssetStore
+		default:
+			return store
+		}
+	}
+}
+
+func runCompact(config *Config, args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	fs.Parse(args)
+	if config.Pack.Dir == "" {
+		return errors.New("compact needs -pack-dir")
+	}
+	store, err := config.OpenStore()
+	if err != nil {
+		return err
+	}
+	packs, err := config.OpenPacks(store)
+	if err != nil {
+		return err
+	}
+	defer packs.Close()
+	report, err := packs.Compact()
+	log.Printf("Compact: compacted %d segments, moved %d blobs, freed %d bytes\n",
+		report.Segments, report.Moved, report.BytesFreed)
+	return err
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func testPackOptions(dir string, segmentSize int64) PackOptions {
+	return PackOptions{
+		Dir:          path.Join(dir, "packs"),
+		MaxBlobSize:  64,
+		SegmentSize:  segmentSize,
+		CompactRatio: 0.5,
+		DirMode:      0755,
+		FileMode:     0644,
+	}
+}
+
+func testPackStore(t *testing.T, segmentSize int64) (*packStore, func() *packStore, func()) {
+	large, cleanup := testSpoolStore(t)
+	dir := path.Dir(large.dataDir)
+	open := func() *packStore {
+		p, err := OpenPackStore(testPackOptions(dir, segmentSize), large)
+		if err != nil {
+			t.Fatalf("Unable to open pack store: %v", err)
+		}
+		return p
+	}
+	p := open()
+	reopen := func() *packStore {
+		p.Close()
+		p = open()
+		return p
+	}
+	return p, reopen, func() { p.Close(); cleanup() }
+}
+
+func TestPack_SmallAndLarge(t *testing.T) {
+	p, reopen, cleanup := testPackStore(t, 1<<20)
+	defer cleanup()
+
+	small := base64Of("a landmark")
+	large := base64Of(strings.Repeat("mesh ", 100))
+	smallHash, err := p.Store(small)
+	if err != nil {
+		t.Fatalf("Unexpected store error: %v", err)
+	}
+	largeHash, _ := p.Store(large)
+	if _, found := p.large.(*assetStore).findOwn(smallHash); found {
+		t.Fail()
+		t.Log("Expected small blob not to get a file")
+	}
+	if _, found := p.large.(*assetStore).findOwn(largeHash); !found {
+		t.Fail()
+		t.Log("Expected large blob to be stored as a file")
+	}
+
+	p = reopen()
+	for hash, expected := range map[string]string{smallHash: small, largeHash: large} {
+		data, err := p.GetAsBase64(hash)
+		if err != nil || data != expected {
+			t.Fail()
+			t.Logf("Expected %v to be readable after reopening. Got: %v (%v)", hash, data, err)
+		}
+	}
+	if p.Exists(emptyTestFileDataContentHash) {
+		t.Fail()
+		t.Log("Expected unknown blob not to exist")
+	}
+}
+
+func TestPack_SealAndRecover(t *testing.T) {
+	p, reopen, cleanup := testPackStore(t, 256)
+	defer cleanup()
+
+	hashes := map[string]string{}
+	for i := 0; i < 10; i++ {
+		data := base64Of(fmt.Sprintf("notecard %d", i))
+		hash, err := p.Store(data)
+		if err != nil {
+			t.Fatalf("Unexpected store error: %v", err)
+		}
+		hashes[hash] = data
+	}
+	if len(p.segments) < 3 {
+		t.Fatalf("Expected several segments. Got: %d", len(p.segments))
+	}
+	// Simulate a crash in the middle of an append and a lost index
+	active := p.segmentPath(p.active, packSegmentExt)
+	f, _ := os.OpenFile(active, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte(packRecordMagic + "P partial"))
+	f.Close()
+	ioutil.WriteFile(p.segmentPath(1, packIndexExt), []byte("garbage"), 0644)
+
+	p = reopen()
+	for hash, expected := range hashes {
+		data, err := p.GetAsBase64(hash)
+		if err != nil || data != expected {
+			t.Fail()
+			t.Logf("Expected %v to survive the crash. Got: %v (%v)", hash, data, err)
+		}
+	}
+	if info, _ := os.Stat(active); info.Size() != p.segments[p.active].size {
+		t.Fail()
+		t.Log("Expected torn record to be cut off")
+	}
+	hash, err := p.Store(base64Of("after crash"))
+	p = reopen()
+	if err != nil || !p.Exists(hash) {
+		t.Fail()
+		t.Logf("Expected appends to work after recovery: %v", err)
+	}
+}
+
+func TestPack_DeleteAndCompact(t *testing.T) {
+	p, reopen, cleanup := testPackStore(t, 512)
+	defer cleanup()
+
+	hashes := []string{}
+	for i := 0; i < 12; i++ {
+		hash, _ := p.Store(base64Of(fmt.Sprintf("script %d", i)))
+		hashes = append(hashes, hash)
+	}
+	for _, hash := range hashes[:10] {
+		if err := p.Delete(hash); err != nil {
+			t.Fatalf("Unexpected delete error: %v", err)
+		}
+	}
+	if err := p.Delete(hashes[0]); !os.IsNotExist(err) {
+		t.Fail()
+		t.Logf("Expected deleting a missing blob to fail. Got: %v", err)
+	}
+	before := len(p.segments)
+
+	report, err := p.Compact()
+	if err != nil || report.Segments == 0 || report.BytesFreed == 0 {
+		t.Fail()
+		t.Logf("Unexpected compaction report: %+v (%v)", report, err)
+	}
+	if len(p.segments) >= before {
+		t.Fail()
+		t.Logf("Expected fewer segments after compaction: %d -> %d", before, len(p.segments))
+	}
+
+	p = reopen()
+	for i, hash := range hashes {
+		if p.Exists(hash) != (i >= 10) {
+			t.Fail()
+			t.Logf("Unexpected existence of blob %d after compaction", i)
+		}
+	}
+	data, err := p.GetAsBase64(hashes[11])
+	if err != nil || data != base64Of("script 11") {
+		t.Fail()
+		t.Logf("Expected kept blob to be readable. Got: %v (%v)", data, err)
+	}
+}
+
+func TestPack_Encrypted(t *testing.T) {
+	large, cleanup := testSpoolStore(t)
+	defer cleanup()
+	opts := testPackOptions(path.Dir(large.dataDir), 1<<20)
+	opts.Keys = testKeyRing(t, "k1 "+testKey1+"\n", "")
+	p, err := OpenPackStore(opts, large)
+	if err != nil {
+		t.Fatalf("Unable to open pack store: %v", err)
+	}
+	defer p.Close()
+
+	hash, _ := p.Store(base64Of("secret notecard"))
+	segment, _ := ioutil.ReadFile(p.segmentPath(p.active, packSegmentExt))
+	if strings.Contains(string(segment), "secret") || !strings.Contains(string(segment), encryptionMagic) {
+		t.Fail()
+		t.Log("Expected packed blob to be encrypted")
+	}
+	if data, err := p.GetAsBase64(hash); err != nil || data != base64Of("secret notecard") {
+		t.Fail()
+		t.Logf("Expected encrypted packed blob to be readable. Got: %v (%v)", data, err)
+	}
+}
+
+func TestPack_Rewrap(t *testing.T) {
+	large, cleanup := testSpoolStore(t)
+	defer cleanup()
+	opts := testPackOptions(path.Dir(large.dataDir), 512)
+	opts.Keys = testKeyRing(t, "k1 "+testKey1+"\n", "")
+	p, err := OpenPackStore(opts, large)
+	if err != nil {
+		t.Fatalf("Unable to open pack store: %v", err)
+	}
+	defer p.Close()
+
+	hashes := []string{}
+	for i := 0; i < 12; i++ {
+		hash, _ := p.Store(base64Of(fmt.Sprintf("notecard %d", i)))
+		hashes = append(hashes, hash)
+	}
+
+	rotated := testKeyRing(t, "k1 "+testKey1+"\nk2 "+testKey2+"\n", "")
+	p.Keys = rotated
+	report, err := p.Rewrap(rotated, false)
+	if err != nil || report.Rewrapped != 12 || report.Current != 0 || report.Failed != 0 {
+		t.Fail()
+		t.Logf("Unexpected rewrap report: %+v (%v)", report, err)
+	}
+	report, _ = p.Rewrap(rotated, false)
+	if report.Rewrapped != 0 || report.Current != 12 {
+		t.Fail()
+		t.Logf("Expected all packed blobs to be current after rewrap. Got: %+v", report)
+	}
+
+	// No segment holds a blob for the retired key anymore
+	p.Keys = testKeyRing(t, "k2 "+testKey2+"\n", "")
+	for id, seg := range p.segments {
+		records, _, err := scanPackSegment(seg.f)
+		if err != nil {
+			t.Fatalf("Unable to scan segment %d: %v", id, err)
+		}
+		for _, r := range records {
+			payload := make([]byte, r.length)
+			seg.f.ReadAt(payload, r.offset)
+			if r.kind == packPut {
+				if src, err := rewrapSource(bufio.NewReader(bytes.NewReader(payload)), p.Keys); src != nil || err != nil {
+					t.Fail()
+					t.Logf("Expected segment %d to only hold blobs for the current key. Got: %v", id, err)
+				}
+			}
+		}
+	}
+	for i, hash := range hashes {
+		data, err := p.GetAsBase64(hash)
+		if err != nil || data != base64Of(fmt.Sprintf("notecard %d", i)) {
+			t.Fail()
+			t.Logf("Expected rewrapped blob %d to be readable. Got: %v (%v)", i, data, err)
+		}
+	}
+}
+
+func TestPack_Lock(t *testing.T) {
+	p, _, cleanup := testPackStore(t, 1<<20)
+	defer cleanup()
+
+	if _, err := OpenPackStore(p.PackOptions, p.large); err == nil {
+		t.Fail()
+		t.Log("Expected a pack directory in use to be refused")
+	}
+	p.Close()
+	second, err := OpenPackStore(p.PackOptions, p.large)
+	if err != nil {
+		t.Fail()
+		t.Logf("Expected the pack directory to open once it is closed. Got: %v", err)
+	} else {
+		second.Close()
+	}
+}
@@ -19,14 +19,80 @@
 package main
 
 import (
+	"bufio"
 	"compress/gzip"
+	"io"
 	"os"
+	"path"
+	"strings"
 
 	"github.com/golang/snappy"
 )
 
+const (
+	formatRaw    = ""
+	formatGzip   = "gz"
+	formatSnappy = "snappy"
+)
+
+// blobFormat returns the compression format of a blob file from its name.
+// Spool files carry a random suffix after the format extension, so the
+// format is the second dot separated part of the file name.
+func blobFormat(name string) string {
+	parts := strings.SplitN(path.Base(name), ".", 3)
+	if len(parts) < 2 {
+		return formatRaw
+	}
+	switch parts[1] {
+	case formatGzip, formatSnappy:
+		return parts[1]
+	}
+	return formatRaw
+}
+
+// blobHash returns the content hash encoded in the name of a blob file.
+func blobHash(name string) string {
+	return strings.SplitN(path.Base(name), ".", 2)[0]
+}
+
+// newAssetReader wraps f with the decompressor for format, decrypting
+// compressed blobs with keys first if they are encrypted. f is closed if
+// the reader cannot be created.
+func newAssetReader(f io.ReadCloser, format string, keys *keyRing) (io.ReadCloser, error) {
+	if format != formatGzip && format != formatSnappy {
+		return f, nil
+	}
+	buffered := bufio.NewReader(f)
+	var src io.Reader = buffered
+	if isEncrypted(buffered) {
+		d, e := newDecryptReader(buffered, keys)
+		if e != nil {
+			f.Close()
+			return nil, e
+		}
+		src = d
+	}
+	if format == formatSnappy {
+		return &assetReader{
+			f:      f,
+			gzip:   nil,
+			snappy: snappy.NewReader(src),
+		}, nil
+	}
+	gzipreader, e := gzip.NewReader(src)
+	if e != nil {
+		f.Close()
+		return nil, e
+	}
+	return &assetReader{
+		f:      f,
+		gzip:   gzipreader,
+		snappy: nil,
+	}, nil
+}
+
 type assetReader struct {
-	f      *os.File
+	f      io.ReadCloser
 	gzip   *gzip.Reader
 	snappy *snappy.Reader
 }
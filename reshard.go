@@ -0,0 +1,148 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ReshardReport struct {
+	Moved      int
+	Duplicates int
+	Skipped    int
+}
+
+// Reshard moves every blob in dataDir into layout to. The target layout is
+// recorded in the layout file before any blob is moved, together with the
+// layout being migrated from, so running servers look in both and an
+// interrupted run can simply be started again.
+func Reshard(dataDir string, to Layout, dirMode, fileMode os.FileMode, wait time.Duration) (report ReshardReport, err error) {
+	if err = to.Validate(); err != nil {
+		return
+	}
+	dataDir = path.Clean(dataDir)
+	current, previous, err := LoadLayout(dataDir, defaultLayout, dirMode, fileMode)
+	if err != nil {
+		return
+	}
+	if previous != nil && current != to {
+		err = fmt.Errorf("reshard to %v in progress, finish it first", current)
+		return
+	}
+	if previous == nil && current == to {
+		return
+	}
+	if current != to {
+		err = writeLayoutFile(dataDir, layoutFile{Layout: to, Previous: &current}, fileMode)
+		if err != nil {
+			return
+		}
+		log.Printf("Reshard: waiting %v for running servers to pick up the new layout\n", wait)
+		time.Sleep(wait)
+	}
+
+	report.Skipped, err = walkBlobs(dataDir, func(p, hash, ext string, info os.FileInfo) error {
+		dst := path.Join(dataDir, to.Path(hash)) + ext
+		if dst == p {
+			return nil
+		}
+		if _, err := os.Stat(dst); err == nil {
+			// Same hash, same content. Keep the copy in the new layout.
+			report.Duplicates++
+			return os.Remove(p)
+		}
+		if err := os.MkdirAll(path.Dir(dst), dirMode); err != nil {
+			return err
+		}
+		if err := commitFile(p, dst); err != nil {
+			return err
+		}
+		report.Moved++
+		if report.Moved%10000 == 0 {
+			log.Printf("Reshard: moved %d blobs\n", report.Moved)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// Remove the now empty directories of the old layout, deepest first
+	dirs := []string{}
+	filepath.Walk(dataDir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && p != dataDir {
+			dirs = append(dirs, p)
+		}
+		return nil
+	})
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dataDir, dir)
+		if err == nil && !to.isDir(filepath.ToSlash(rel)) {
+			os.Remove(dir)
+		}
+	}
+
+	err = writeLayoutFile(dataDir, layoutFile{Layout: to}, fileMode)
+	return
+}
+
+// isDir reports whether the relative directory rel can be part of layout l.
+func (l Layout) isDir(rel string) bool {
+	parts := strings.Split(rel, "/")
+	if len(parts) > l.Depth {
+		return false
+	}
+	for _, p := range parts {
+		if len(p) != l.Width {
+			return false
+		}
+	}
+	return true
+}
+
+func runReshard(config *Config, args []string) error {
+	fs := flag.NewFlagSet("reshard", flag.ExitOnError)
+	depth := fs.Int("depth", config.Layout.Depth, "Number of directory levels")
+	width := fs.Int("width", config.Layout.Width, "Number of hash characters per directory level")
+	wait := fs.Duration("wait", 2*layoutRecheckInterval, "Time to give running servers to pick up the new layout")
+	fs.Parse(args)
+
+	dirs, err := ParseDataDirs(config.DataStore)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		report, err := Reshard(dir.Path, Layout{Depth: *depth, Width: *width}, config.DirMode, config.FileMode, *wait)
+		log.Printf("Reshard %v: moved %d blobs, removed %d duplicates, skipped %d unknown files\n",
+			dir.Path, report.Moved, report.Duplicates, report.Skipped)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
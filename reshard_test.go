@@ -0,0 +1,111 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReshard_MovesBlobs(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+
+	store.Store(testFileDataContentB64)
+	store.Store(emptyTestFileDataContentB64)
+	ioutil.WriteFile(path.Join(store.dataDir, "README"), []byte("keep"), 0644)
+
+	to := Layout{Depth: 3, Width: 2}
+	report, err := Reshard(store.dataDir, to, 0755, 0644, 0)
+	if err != nil {
+		t.Fatalf("Unexpected reshard error: %v", err)
+	}
+	if report.Moved != 2 || report.Skipped != 1 {
+		t.Fail()
+		t.Logf("Unexpected report: %+v", report)
+	}
+	for _, hash := range []string{testFileDataContentHash, emptyTestFileDataContentHash} {
+		if _, err := os.Stat(path.Join(store.dataDir, to.Path(hash)) + ".snappy"); err != nil {
+			t.Fail()
+			t.Logf("Expected %v in new layout: %v", hash, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(store.dataDir, "D6E")); !os.IsNotExist(err) {
+		t.Fail()
+		t.Log("Expected empty directories of the old layout to be removed")
+	}
+	lf, err := readLayoutFile(store.dataDir)
+	if err != nil || lf.Layout != to || lf.Previous != nil {
+		t.Fail()
+		t.Logf("Expected finished layout file for %v Got: %+v (%v)", to, lf, err)
+	}
+
+	reopened := CreateAssetStore(StoreOptions{DataDir: store.dataDir, SpoolDir: store.spoolDir, Layout: to}).(*assetStore)
+	data, err := reopened.GetAsBase64(testFileDataContentHash)
+	if err != nil || data != testFileDataContentB64 {
+		t.Fail()
+		t.Logf("Expected blob to be readable after reshard. Got: %v (%v)", data, err)
+	}
+}
+
+func TestReshard_Resume(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+
+	store.Store(testFileDataContentB64)
+	store.Store(emptyTestFileDataContentB64)
+
+	// Simulate a run that was interrupted after moving one of two blobs
+	to := Layout{Depth: 1, Width: 2}
+	os.MkdirAll(store.dataDir, 0755)
+	writeLayoutFile(store.dataDir, layoutFile{Layout: to, Previous: &defaultLayout}, 0644)
+	moved := path.Join(store.dataDir, to.Path(testFileDataContentHash)) + ".snappy"
+	os.MkdirAll(path.Dir(moved), 0755)
+	os.Rename(store.makePath(testFileDataContentHash)+".snappy", moved)
+
+	if _, err := Reshard(store.dataDir, Layout{Depth: 3, Width: 2}, 0755, 0644, 0); err == nil {
+		t.Fail()
+		t.Log("Expected reshard to a different layout to be refused while one is in progress")
+	}
+	report, err := Reshard(store.dataDir, to, 0755, 0644, 0)
+	if err != nil || report.Moved != 1 {
+		t.Fail()
+		t.Logf("Expected resumed reshard to move the remaining blob. Got: %+v (%v)", report, err)
+	}
+}
+
+func TestReshard_Duplicates(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+
+	store.Store(testFileDataContentB64)
+	to := Layout{Depth: 1, Width: 2}
+	dst := path.Join(store.dataDir, to.Path(testFileDataContentHash)) + ".snappy"
+	os.MkdirAll(path.Dir(dst), 0755)
+	data, _ := ioutil.ReadFile(store.makePath(testFileDataContentHash) + ".snappy")
+	ioutil.WriteFile(dst, data, 0644)
+
+	report, err := Reshard(store.dataDir, to, 0755, 0644, 0)
+	if err != nil || report.Duplicates != 1 || report.Moved != 0 {
+		t.Fail()
+		t.Logf("Expected one duplicate. Got: %+v (%v)", report, err)
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+type RewrapReport struct {
+	Rewrapped int
+	Current   int
+	Skipped   int
+	Failed    int
+}
+
+// Rewrap re-encrypts every compressed blob on disks that is not encrypted
+// with the current key of keys yet, including blobs stored before
+// encryption was enabled. Only the encryption layer is replaced, the
+// compressed data itself is copied as it is. Uncompressed blobs, such as
+// adopted FSAssets files, are compressed with snappy and encrypted.
+func Rewrap(disks []*assetStore, keys *keyRing, dryRun bool) (report RewrapReport, err error) {
+	for _, disk := range disks {
+		var skipped int
+		skipped, err = walkBlobs(disk.dataDir, func(p, hash, ext string, info os.FileInfo) error {
+			var rewrapped bool
+			var err error
+			if ext == "" {
+				rewrapped, err = rewrapRawBlob(disk, p, hash, keys, dryRun)
+			} else {
+				rewrapped, err = rewrapBlob(disk, p, keys, dryRun)
+			}
+			switch {
+			case err != nil:
+				log.Printf("Rewrap: failed to rewrap %v: %v\n", p, err)
+				report.Failed++
+			case rewrapped:
+				report.Rewrapped++
+			default:
+				report.Current++
+			}
+			return nil
+		})
+		report.Skipped += skipped
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// rewrapBlob replaces the blob file p by a copy encrypted with the current
+// key. It reports false if the blob already is.
+func rewrapBlob(disk *assetStore, p string, keys *keyRing, dryRun bool) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	src, err := rewrapSource(bufio.NewReader(f), keys)
+	if err != nil || src == nil {
+		return false, err
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	tempPath := strings.Replace(p, disk.dataDir, disk.spoolDir, 1)
+	if err := os.MkdirAll(path.Dir(tempPath), disk.dirMode); err != nil {
+		return false, err
+	}
+	tmp, err := ioutil.TempFile(path.Dir(tempPath), path.Base(tempPath)+".")
+	if err != nil {
+		return false, err
+	}
+	err = tmp.Chmod(disk.fileMode)
+	var enc *encryptWriter
+	if err == nil {
+		enc, err = newEncryptWriter(tmp, keys)
+	}
+	if err == nil {
+		_, err = io.Copy(enc, src)
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = commitFile(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+// rewrapSource returns a reader for the compressed blob read by r without
+// its encryption, nil if the blob already is encrypted with the current key.
+func rewrapSource(r *bufio.Reader, keys *keyRing) (io.Reader, error) {
+	if !isEncrypted(r) {
+		return r, nil
+	}
+	d, err := newDecryptReader(r, keys)
+	if err != nil {
+		return nil, err
+	}
+	if d.keyID == keys.current {
+		return nil, nil
+	}
+	return d, nil
+}
+
+// Rewrap re-encrypts the packed blobs that are not encrypted with the
+// current key of keys yet. The copies are appended to the active segment
+// and the segments that held the old ones are compacted afterwards, so no
+// blob stays readable with a retired key.
+func (p *packStore) Rewrap(keys *keyRing, dryRun bool) (report RewrapReport, err error) {
+	p.mu.RLock()
+	hashes := make([]string, 0, len(p.index))
+	for hash := range p.index {
+		hashes = append(hashes, hash)
+	}
+	p.mu.RUnlock()
+	sort.Strings(hashes)
+
+	touched := map[uint32]bool{}
+	for _, hash := range hashes {
+		p.mu.Lock()
+		entry, found := p.index[hash]
+		var rewrapped bool
+		if found {
+			rewrapped, err = p.rewrapEntry(hash, entry, keys, dryRun)
+		}
+		p.mu.Unlock()
+		switch {
+		case !found:
+			// Deleted meanwhile
+		case err != nil:
+			log.Printf("Rewrap: failed to rewrap packed blob %v: %v\n", hash, err)
+			report.Failed++
+			err = nil
+		case rewrapped:
+			report.Rewrapped++
+			touched[entry.segment] = true
+		default:
+			report.Current++
+		}
+	}
+	if dryRun {
+		return
+	}
+
+	p.mu.RLock()
+	oldest := p.active
+	for id := range p.segments {
+		if id < oldest {
+			oldest = id
+		}
+	}
+	p.mu.RUnlock()
+	ids := []uint32{}
+	for id := range touched {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if _, _, err = p.compactSegment(id, id == oldest); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// rewrapEntry appends a copy of the packed blob hash encrypted with the
+// current key. The active segment is sealed first if it holds the blob, so
+// it can be compacted afterwards. The caller holds the write lock.
+func (p *packStore) rewrapEntry(hash string, entry packEntry, keys *keyRing, dryRun bool) (bool, error) {
+	payload := make([]byte, entry.length)
+	if _, err := p.segments[entry.segment].f.ReadAt(payload, entry.offset); err != nil {
+		return false, err
+	}
+	src, err := rewrapSource(bufio.NewReader(bytes.NewReader(payload)), keys)
+	if err != nil || src == nil || dryRun {
+		return src != nil, err
+	}
+	if entry.segment == p.active {
+		if err := p.seal(); err != nil {
+			return false, err
+		}
+	}
+	var buf bytes.Buffer
+	enc, err := newEncryptWriter(&buf, keys)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(enc, src); err != nil {
+		return false, err
+	}
+	if err := enc.Close(); err != nil {
+		return false, err
+	}
+	if err := p.appendRecord(packPut, hash, buf.Bytes(), false); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rewrapRawBlob replaces the uncompressed blob file p by an encrypted snappy
+// blob. Uncompressed blobs are never encrypted, so it always rewraps.
+func rewrapRawBlob(disk *assetStore, p, hash string, keys *keyRing, dryRun bool) (bool, error) {
+	if dryRun {
+		return true, nil
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return false, err
+	}
+	if makeHash(data) != hash {
+		// Do not seal corrupt data, scrub and fsck report it
+		return false, fmt.Errorf("content does not match hash %v", hash)
+	}
+	// The raw file is found before the snappy one until it is removed, both
+	// hold the same content
+	if err := disk.writeBlob(p+".snappy", data); err != nil {
+		return false, err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+func runRewrap(config *Config, args []string) error {
+	fs := flag.NewFlagSet("rewrap", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only report what would be rewrapped")
+	fs.Parse(args)
+
+	keys, err := config.LoadKeys()
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		return errors.New("rewrap needs -encryption-keys")
+	}
+	store, err := config.OpenStore()
+	if err != nil {
+		return err
+	}
+	disks := localDisks(store)
+	if disks == nil {
+		return errors.New("rewrap needs the fs store backend")
+	}
+
+	report, err := Rewrap(disks, keys, *dryRun)
+	if err == nil && config.Pack.Dir != "" {
+		var packs *packStore
+		if packs, err = config.OpenPacks(store); err != nil {
+			return err
+		}
+		defer packs.Close()
+		var packed RewrapReport
+		packed, err = packs.Rewrap(keys, *dryRun)
+		report.Rewrapped += packed.Rewrapped
+		report.Current += packed.Current
+		report.Failed += packed.Failed
+	}
+	verb := "rewrapped"
+	if *dryRun {
+		verb = "would rewrap"
+	}
+	log.Printf("Rewrap: %v %d blobs, %d already current, %d failed, skipped %d files\n",
+		verb, report.Rewrapped, report.Current, report.Failed, report.Skipped)
+	return err
+}
@@ -0,0 +1,314 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Client is a minimal S3 client speaking the subset of the API the object
+// store backend needs, signed with AWS Signature Version 4.
+type s3Client struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	http      *http.Client
+	now       func() time.Time
+}
+
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+func createS3Client(endpoint, bucket, region, accessKey, secretKey string, pathStyle bool) (*s3Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", endpoint)
+	}
+	return &s3Client{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		pathStyle: pathStyle,
+		http:      http.DefaultClient,
+		now:       time.Now,
+	}, nil
+}
+
+func (c *s3Client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path = "/" + c.bucket + "/" + key
+	} else {
+		u.Host = c.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = ""
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+func (c *s3Client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		reader = bytes.NewReader(body)
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req, err := http.NewRequest(method, c.objectURL(key, query).String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	c.sign(req, payloadHash)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	e := &s3Error{Status: resp.StatusCode}
+	if method != "HEAD" {
+		xml.NewDecoder(resp.Body).Decode(e)
+	}
+	return nil, e
+}
+
+func (c *s3Client) PutObject(key string, data []byte, header http.Header) error {
+	resp, err := c.do("PUT", key, nil, header, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *s3Client) HeadObject(key string) (http.Header, error) {
+	resp, err := c.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp.Header, nil
+}
+
+// GetObject returns the streaming body of the object, the caller must close it.
+func (c *s3Client) GetObject(key string) (io.ReadCloser, http.Header, error) {
+	resp, err := c.do("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Body, resp.Header, nil
+}
+
+func (c *s3Client) CreateMultipartUpload(key string, header http.Header) (string, error) {
+	resp, err := c.do("POST", key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result s3InitiateMultipartUploadResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.UploadId, nil
+}
+
+func (c *s3Client) UploadPart(key, uploadId string, partNumber int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadId}}
+	resp, err := c.do("PUT", key, query, nil, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+func (c *s3Client) CompleteMultipartUpload(key, uploadId string, parts []s3CompletedPart) error {
+	body, err := xml.Marshal(s3CompleteMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do("POST", key, url.Values{"uploadId": {uploadId}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// S3 reports some failures with a 200 status and an error document
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &s3Error{Status: resp.StatusCode}
+		xml.Unmarshal(data, e)
+		return e
+	}
+	return nil
+}
+
+func (c *s3Client) AbortMultipartUpload(key, uploadId string) error {
+	resp, err := c.do("DELETE", key, url.Values{"uploadId": {uploadId}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// sign adds the AWS Signature Version 4 authorization to req.
+func (c *s3Client) sign(req *http.Request, payloadHash string) {
+	amzDate := c.now().UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent encodes everything except unreserved characters, and
+// slashes unless escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+
+	"github.com/golang/snappy"
+)
+
+// Objects smaller than this are uploaded with a single PUT. S3 requires
+// all parts but the last one of a multipart upload to be at least 5MB.
+const (
+	defaultS3PartSize = 16 << 20
+	minS3PartSize     = 5 << 20
+)
+
+// formatMetaHeader records the compression format of an object, the same
+// information the file extension carries in the filesystem store.
+const formatMetaHeader = "X-Amz-Meta-Snapper-Format"
+
+type S3Options struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+	PartSize  int
+}
+
+type s3Store struct {
+	client   *s3Client
+	prefix   string
+	partSize int
+}
+
+func CreateS3Store(opts S3Options) (AssetStore, error) {
+	client, err := createS3Client(opts.Endpoint, opts.Bucket, opts.Region, opts.AccessKey, opts.SecretKey, opts.PathStyle)
+	if err != nil {
+		return nil, err
+	}
+	partSize := opts.PartSize
+	if partSize <= 0 {
+		partSize = defaultS3PartSize
+	} else if partSize < minS3PartSize {
+		partSize = minS3PartSize
+	}
+	return &s3Store{
+		client:   client,
+		prefix:   opts.Prefix,
+		partSize: partSize,
+	}, nil
+}
+
+func (s *s3Store) key(hash string) string {
+	return s.prefix + defaultLayout.Path(hash)
+}
+
+func (s *s3Store) Load(hash string) (io.ReadCloser, error) {
+	body, header, err := s.client.GetObject(s.key(hash))
+	if err != nil {
+		return nil, err
+	}
+	return newAssetReader(body, header.Get(formatMetaHeader), nil)
+}
+
+func (s *s3Store) Exists(hash string) bool {
+	_, err := s.client.HeadObject(s.key(hash))
+	return err == nil
+}
+
+func (s *s3Store) Store(data string) (string, error) {
+	buffer, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+	hash := makeHash(buffer)
+	if s.Exists(hash) {
+		return hash, nil
+	}
+
+	var compressed bytes.Buffer
+	w := snappy.NewWriter(&compressed)
+	if _, err := w.Write(buffer); err != nil {
+		return hash, err
+	}
+	if err := w.Close(); err != nil {
+		return hash, err
+	}
+
+	header := http.Header{
+		"Content-Type":   {"application/octet-stream"},
+		formatMetaHeader: {formatSnappy},
+	}
+	if compressed.Len() <= s.partSize {
+		return hash, s.client.PutObject(s.key(hash), compressed.Bytes(), header)
+	}
+	return hash, s.multipartUpload(s.key(hash), compressed.Bytes(), header)
+}
+
+func (s *s3Store) multipartUpload(key string, data []byte, header http.Header) error {
+	uploadId, err := s.client.CreateMultipartUpload(key, header)
+	if err != nil {
+		return err
+	}
+	parts := []s3CompletedPart{}
+	for offset := 0; offset < len(data); offset += s.partSize {
+		end := offset + s.partSize
+		if end > len(data) {
+			end = len(data)
+		}
+		etag, err := s.client.UploadPart(key, uploadId, len(parts)+1, data[offset:end])
+		if err != nil {
+			s.client.AbortMultipartUpload(key, uploadId)
+			return err
+		}
+		parts = append(parts, s3CompletedPart{PartNumber: len(parts) + 1, ETag: etag})
+	}
+	err = s.client.CompleteMultipartUpload(key, uploadId, parts)
+	if err != nil {
+		s.client.AbortMultipartUpload(key, uploadId)
+	}
+	return err
+}
+
+func (s *s3Store) GetAsBase64(hash string) (string, error) {
+	return loadAsBase64(s, hash)
+}
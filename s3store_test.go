@@ -0,0 +1,265 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeS3Object struct {
+	data   []byte
+	header http.Header
+}
+
+// fakeS3 is an in-process stand-in for a path style S3 endpoint.
+type fakeS3 struct {
+	mu         sync.Mutex
+	bucket     string
+	objects    map[string]fakeS3Object
+	uploads    map[string]map[int][]byte
+	uploadMeta map[string]http.Header
+	multipart  int
+}
+
+func createFakeS3(bucket string) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		bucket:     bucket,
+		objects:    map[string]fakeS3Object{},
+		uploads:    map[string]map[int][]byte{},
+		uploadMeta: map[string]http.Header{},
+	}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeS3) metaHeader(h http.Header) http.Header {
+	meta := http.Header{}
+	for k, v := range h {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			meta[k] = v
+		}
+	}
+	return meta
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "<Error><Code>XAmzContentSHA256Mismatch</Code></Error>")
+		return
+	}
+	prefix := "/" + f.bucket + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == "POST" && query.Get("uploadId") != "":
+		id := query.Get("uploadId")
+		var complete s3CompleteMultipartUpload
+		xml.Unmarshal(body, &complete)
+		var data []byte
+		for _, p := range complete.Parts {
+			data = append(data, f.uploads[id][p.PartNumber]...)
+		}
+		f.objects[key] = fakeS3Object{data: data, header: f.uploadMeta[id]}
+		delete(f.uploads, id)
+		f.multipart++
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == "POST" && query.Has("uploads"):
+		id := strconv.Itoa(rand.Int())
+		f.uploads[id] = map[int][]byte{}
+		f.uploadMeta[id] = f.metaHeader(r.Header)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == "PUT" && query.Get("uploadId") != "":
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")][n] = body
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", n))
+	case r.Method == "PUT":
+		f.objects[key] = fakeS3Object{data: body, header: f.metaHeader(r.Header)}
+	case r.Method == "DELETE" && query.Get("uploadId") != "":
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" || r.Method == "HEAD":
+		obj, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for k, v := range obj.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		if r.Method == "GET" {
+			w.Write(obj.data)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func testS3Store(t *testing.T, partSize int) (*s3Store, *fakeS3, func()) {
+	fake, server := createFakeS3("assets")
+	store, err := CreateS3Store(S3Options{
+		Endpoint:  server.URL,
+		Bucket:    "assets",
+		Region:    "us-east-1",
+		Prefix:    "blobs/",
+		AccessKey: "test",
+		SecretKey: "secret",
+		PathStyle: true,
+		PartSize:  partSize,
+	})
+	if err != nil {
+		server.Close()
+		t.Fatalf("Unable to create S3 store: %v", err)
+	}
+	return store.(*s3Store), fake, server.Close
+}
+
+func TestS3Store_StoreAndLoad(t *testing.T) {
+	store, fake, cleanup := testS3Store(t, 0)
+	defer cleanup()
+
+	if store.Exists(testFileDataContentHash) {
+		t.Fail()
+		t.Log("Expected empty bucket")
+	}
+	hash, err := store.Store(testFileDataContentB64)
+	if err != nil || hash != testFileDataContentHash {
+		t.Fail()
+		t.Logf("Expected hash: %v Got: %v (%v)", testFileDataContentHash, hash, err)
+	}
+	expectedKey := "blobs/D6E/C68/" + testFileDataContentHash
+	if keys := fake.keys(); len(keys) != 1 || keys[0] != expectedKey {
+		t.Fail()
+		t.Logf("Expected key %v Got: %v", expectedKey, keys)
+	}
+	if format := fake.objects[expectedKey].header.Get(formatMetaHeader); format != formatSnappy {
+		t.Fail()
+		t.Logf("Expected format metadata %v Got: %v", formatSnappy, format)
+	}
+	if !store.Exists(testFileDataContentHash) {
+		t.Fail()
+		t.Log("Expected stored blob to exist")
+	}
+	data, err := store.GetAsBase64(testFileDataContentHash)
+	if err != nil || data != testFileDataContentB64 {
+		t.Fail()
+		t.Logf("Expected data: %v Got: %v (%v)", testFileDataContentB64, data, err)
+	}
+}
+
+func TestS3Store_LoadGzipObject(t *testing.T) {
+	store, fake, cleanup := testS3Store(t, 0)
+	defer cleanup()
+
+	fake.objects["blobs/D6E/C68/"+testFileDataContentHash] = fakeS3Object{
+		data:   gzipEncode(testFileDataContent),
+		header: http.Header{formatMetaHeader: {formatGzip}},
+	}
+	data, err := store.GetAsBase64(testFileDataContentHash)
+	if err != nil || data != testFileDataContentB64 {
+		t.Fail()
+		t.Logf("Expected data: %v Got: %v (%v)", testFileDataContentB64, data, err)
+	}
+}
+
+func TestS3Store_LoadMissing(t *testing.T) {
+	store, _, cleanup := testS3Store(t, 0)
+	defer cleanup()
+
+	if _, err := store.Load(testFileDataContentHash); err == nil {
+		t.Fail()
+		t.Log("Expected error loading a missing blob")
+	}
+}
+
+func TestS3Store_Multipart(t *testing.T) {
+	store, fake, cleanup := testS3Store(t, minS3PartSize)
+	defer cleanup()
+
+	// Random data does not compress, so this needs three parts
+	content := make([]byte, 2*minS3PartSize+1000)
+	rand.Read(content)
+	hash, err := store.Store(base64.StdEncoding.EncodeToString(content))
+	if err != nil {
+		t.Fail()
+		t.Logf("Unexpected error: %v", err)
+	}
+	if fake.multipart != 1 {
+		t.Fail()
+		t.Logf("Expected one multipart upload. Got: %d", fake.multipart)
+	}
+	reader, err := store.Load(hash)
+	if err != nil {
+		t.Fatalf("Unable to load multipart blob: %v", err)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fail()
+		t.Logf("Multipart blob corrupted: %v", err)
+	}
+}
+
+func gzipEncode(content string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(content))
+	w.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,436 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const scrubStateVersion = 1
+
+var errScrubStopped = errors.New("scrub stopped")
+
+type ScrubOptions struct {
+	// StateFile remembers the progress of the current pass
+	StateFile string
+	// ReportFile receives the report of every finished pass
+	ReportFile string
+	// Rate limits the bytes read per second, 0 for no limit
+	Rate     int64
+	Interval time.Duration
+}
+
+type ScrubProblem struct {
+	Path        string `json:"path"`
+	Error       string `json:"error"`
+	Quarantined string `json:"quarantined,omitempty"`
+}
+
+type ScrubReport struct {
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Checked  int            `json:"checked"`
+	Bytes    int64          `json:"bytes"`
+	Corrupt  int            `json:"corrupt"`
+	Failed   int            `json:"failed"`
+	Skipped  int            `json:"skipped"`
+	Problems []ScrubProblem `json:"problems"`
+}
+
+// scrubState is the report of the current pass together with the last file
+// checked, so a pass can be resumed after a restart. Packed blobs are
+// checked after the disks, with Disk set to the pack directory and the
+// last record checked given by Segment and Offset.
+type scrubState struct {
+	Version int `json:"version"`
+	ScrubReport
+	Disk    string `json:"disk"`
+	After   string `json:"after"`
+	Segment uint32 `json:"segment,omitempty"`
+	Offset  int64  `json:"offset,omitempty"`
+}
+
+// scrubber reads every blob file of the data store and every packed blob
+// and checks that its content still matches its hash. Blobs that do not
+// are moved to the quarantine directory.
+type scrubber struct {
+	ScrubOptions
+	disks []*assetStore
+	// packs is nil without pack files
+	packs         *packStore
+	quarantineDir string
+	now           func() time.Time
+	sleep         func(time.Duration)
+}
+
+func createScrubber(disks []*assetStore, packs *packStore, opts ScrubOptions, quarantineDir string) *scrubber {
+	return &scrubber{
+		ScrubOptions:  opts,
+		disks:         disks,
+		packs:         packs,
+		quarantineDir: quarantineDir,
+		now:           time.Now,
+		sleep:         time.Sleep,
+	}
+}
+
+func (s *scrubber) loadState() (*scrubState, error) {
+	data, err := ioutil.ReadFile(s.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	state := &scrubState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Version != scrubStateVersion {
+		return nil, errors.New("unsupported scrub state version")
+	}
+	return state, nil
+}
+
+func (s *scrubber) saveState(state *scrubState) error {
+	state.Version = scrubStateVersion
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.StateFile, append(data, '\n'), 0644)
+}
+
+// Pass scrubs every disk and then the packed blobs, continuing an
+// unfinished pass where it stopped. It returns errScrubStopped if stop is
+// closed before the pass is done.
+func (s *scrubber) Pass(stop <-chan struct{}) (ScrubReport, error) {
+	for _, name := range []string{s.StateFile, s.ReportFile} {
+		if err := os.MkdirAll(path.Dir(name), 0755); err != nil {
+			return ScrubReport{}, err
+		}
+	}
+	state, err := s.loadState()
+	if err != nil || !state.Finished.IsZero() {
+		state = &scrubState{ScrubReport: ScrubReport{Started: s.now(), Problems: []ScrubProblem{}}}
+	}
+	onPacks := s.packs != nil && state.Disk == s.packs.Dir
+	first := 0
+	for i, disk := range s.disks {
+		if disk.dataDir == state.Disk {
+			first = i
+		}
+	}
+	if state.Disk != "" && !onPacks && s.disks[first].dataDir != state.Disk {
+		// The disk the pass stopped on is gone, start it over
+		state.After = ""
+	}
+
+	start, read := s.now(), int64(0)
+	lastSave := start
+	stopped := func() bool {
+		select {
+		case <-stop:
+			return true
+		default:
+			return false
+		}
+	}
+	// progress accounts for size bytes read, waits for the rate limit and
+	// saves the state now and then
+	progress := func(size int64) {
+		state.Bytes += size
+		read += size
+		if s.Rate > 0 {
+			due := time.Duration(float64(read) / float64(s.Rate) * float64(time.Second))
+			if elapsed := s.now().Sub(start); elapsed < due {
+				s.sleep(due - elapsed)
+			}
+		}
+		if now := s.now(); now.Sub(lastSave) > 10*time.Second {
+			lastSave = now
+			if err := s.saveState(state); err != nil {
+				log.Printf("Scrub: failed to save progress: %v\n", err)
+			}
+		}
+	}
+	failed := func(err error) (ScrubReport, error) {
+		if serr := s.saveState(state); serr != nil {
+			log.Printf("Scrub: failed to save progress: %v\n", serr)
+		}
+		return state.ScrubReport, err
+	}
+
+	disks := s.disks[first:]
+	if onPacks {
+		disks = nil
+	}
+	for _, disk := range disks {
+		if state.Disk != disk.dataDir {
+			state.Disk, state.After = disk.dataDir, ""
+		}
+		skipped, err := walkBlobsAfter(disk.dataDir, state.After, func(p, hash, ext string, info os.FileInfo) error {
+			if stopped() {
+				return errScrubStopped
+			}
+			s.check(disk, p, hash, &state.ScrubReport)
+			state.After = p
+			progress(info.Size())
+			return nil
+		})
+		state.Skipped += skipped
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return failed(err)
+		}
+	}
+
+	if s.packs != nil {
+		if state.Disk != s.packs.Dir {
+			state.Disk, state.After, state.Segment, state.Offset = s.packs.Dir, "", 0, 0
+		}
+		for _, e := range s.packedAfter(state.Segment, state.Offset) {
+			if stopped() {
+				return failed(errScrubStopped)
+			}
+			s.checkPacked(e.hash, &state.ScrubReport)
+			state.Segment, state.Offset = e.segment, e.offset
+			progress(int64(e.length))
+		}
+	}
+
+	state.Finished = s.now()
+	if err := s.saveState(state); err != nil {
+		return state.ScrubReport, err
+	}
+	data, err := json.MarshalIndent(state.ScrubReport, "", "  ")
+	if err != nil {
+		return state.ScrubReport, err
+	}
+	return state.ScrubReport, writeFileAtomic(s.ReportFile, append(data, '\n'), 0644)
+}
+
+// check verifies the blob file p and quarantines it if it is corrupt.
+func (s *scrubber) check(disk *assetStore, p, hash string, report *ScrubReport) {
+	err := verifyFile(disk, p, hash)
+	if os.IsNotExist(err) {
+		// Deleted or moved to another tier since the directory was read
+		return
+	}
+	report.Checked++
+	statAdd("scrub.checked", 1)
+	if err == nil {
+		return
+	}
+	problem := ScrubProblem{Path: p, Error: err.Error()}
+	if err == ErrBlobCorrupt {
+		report.Corrupt++
+		statAdd("scrub.corrupt", 1)
+		dst, qerr := quarantineFile(p, s.quarantineDir)
+		if qerr != nil {
+			log.Printf("Scrub: failed to quarantine %v: %v\n", p, qerr)
+		} else {
+			problem.Quarantined = dst
+		}
+		log.Printf("Scrub: %v is corrupt\n", p)
+	} else {
+		report.Failed++
+		log.Printf("Scrub: failed to check %v: %v\n", p, err)
+	}
+	report.Problems = append(report.Problems, problem)
+}
+
+// packedBlob is an entry of the pack index with its hash.
+type packedBlob struct {
+	packEntry
+	hash string
+}
+
+// packedAfter returns the packed blobs that come after the record at offset
+// of segment, in the order they are stored in.
+func (s *scrubber) packedAfter(segment uint32, offset int64) []packedBlob {
+	s.packs.mu.RLock()
+	blobs := []packedBlob{}
+	for hash, entry := range s.packs.index {
+		if entry.segment > segment || (entry.segment == segment && entry.offset > offset) {
+			blobs = append(blobs, packedBlob{packEntry: entry, hash: hash})
+		}
+	}
+	s.packs.mu.RUnlock()
+	sort.Slice(blobs, func(i, j int) bool {
+		if blobs[i].segment != blobs[j].segment {
+			return blobs[i].segment < blobs[j].segment
+		}
+		return blobs[i].offset < blobs[j].offset
+	})
+	return blobs
+}
+
+// checkPacked verifies the packed blob hash and quarantines it if it is
+// corrupt.
+func (s *scrubber) checkPacked(hash string, report *ScrubReport) {
+	p := s.packs
+	p.mu.RLock()
+	entry, found := p.index[hash]
+	var payload []byte
+	var err error
+	if found {
+		// The blob may have been moved by compaction since it was listed
+		payload = make([]byte, entry.length)
+		_, err = p.segments[entry.segment].f.ReadAt(payload, entry.offset)
+	}
+	p.mu.RUnlock()
+	if !found {
+		return
+	}
+	name := fmt.Sprintf("%v@%d", p.segmentPath(entry.segment, packSegmentExt), entry.offset)
+	if err == nil {
+		err = verifyContent(ioutil.NopCloser(bytes.NewReader(payload)), formatSnappy, hash, p.Keys)
+	}
+	report.Checked++
+	statAdd("scrub.checked", 1)
+	if err == nil {
+		return
+	}
+	problem := ScrubProblem{Path: name, Error: err.Error()}
+	if err == ErrBlobCorrupt {
+		report.Corrupt++
+		statAdd("scrub.corrupt", 1)
+		if _, qerr := quarantineBlob(p, hash, s.quarantineDir); qerr != nil {
+			log.Printf("Scrub: failed to quarantine %v: %v\n", name, qerr)
+		} else {
+			problem.Quarantined = path.Join(s.quarantineDir, hash+"."+formatSnappy)
+		}
+		log.Printf("Scrub: packed blob %v at %v is corrupt\n", hash, name)
+	} else {
+		report.Failed++
+		log.Printf("Scrub: failed to check packed blob %v at %v: %v\n", hash, name, err)
+	}
+	report.Problems = append(report.Problems, problem)
+}
+
+// verifyFile reads the blob file p of disk and returns ErrBlobCorrupt if it
+// cannot be decoded or its content does not hash to hash. Other errors mean
+// the file could not be checked.
+func verifyFile(disk *assetStore, p, hash string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	return verifyContent(f, blobFormat(p), hash, disk.keys)
+}
+
+// verifyContent is verifyFile for the blob read from f in format. f is
+// closed.
+func verifyContent(f io.ReadCloser, format, hash string, keys *keyRing) error {
+	reader, err := newAssetReader(f, format, keys)
+	if err != nil {
+		if isCorruption(err) || err == io.EOF {
+			return ErrBlobCorrupt
+		}
+		return err
+	}
+	defer reader.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		if isCorruption(err) {
+			return ErrBlobCorrupt
+		}
+		return err
+	}
+	if strings.ToUpper(hex.EncodeToString(hasher.Sum(nil))) != hash {
+		return ErrBlobCorrupt
+	}
+	return nil
+}
+
+// Run scrubs the store every interval, counted from the end of the last
+// pass. An unfinished pass is resumed right away.
+func (s *scrubber) Run(interval time.Duration, stop <-chan struct{}) {
+	for {
+		wait := time.Duration(0)
+		if state, err := s.loadState(); err == nil && !state.Finished.IsZero() {
+			wait = state.Finished.Add(interval).Sub(s.now())
+		}
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return
+		}
+		switch err := s.scrubAndLog(stop); {
+		case err == errScrubStopped:
+			return
+		case err != nil:
+			// Do not retry a failing pass right away
+			s.sleep(time.Minute)
+		}
+	}
+}
+
+func (s *scrubber) scrubAndLog(stop <-chan struct{}) error {
+	report, err := s.Pass(stop)
+	if err != nil {
+		log.Printf("Scrub: %v\n", err)
+		return err
+	}
+	log.Printf("Scrub: checked %d blobs (%d bytes), %d corrupt, %d failed, skipped %d files in %v\n",
+		report.Checked, report.Bytes, report.Corrupt, report.Failed, report.Skipped,
+		report.Finished.Sub(report.Started))
+	return nil
+}
+
+func runScrub(config *Config, args []string) error {
+	fs := flag.NewFlagSet("scrub", flag.ExitOnError)
+	restart := fs.Bool("restart", false, "Start a new pass instead of resuming an unfinished one")
+	rate := fs.Int64("rate", config.Scrub.Rate, "Bytes to read per second, 0 for no limit")
+	fs.Parse(args)
+
+	store, packs, err := config.OpenStack()
+	if err != nil {
+		return err
+	}
+	if packs != nil {
+		defer packs.Close()
+	}
+	disks := localDisks(store)
+	if disks == nil {
+		return errors.New("scrub needs the fs store backend")
+	}
+	opts := config.Scrub
+	opts.Rate = *rate
+	if *restart {
+		if err := os.Remove(opts.StateFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return createScrubber(disks, packs, opts, config.QuarantineDir).scrubAndLog(nil)
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func testScrubber(store *assetStore) *scrubber {
+	dir := path.Dir(store.dataDir)
+	return createScrubber([]*assetStore{store}, nil, ScrubOptions{
+		StateFile:  path.Join(dir, "scrub", "state.json"),
+		ReportFile: path.Join(dir, "scrub", "report.json"),
+	}, path.Join(dir, "quarantine"))
+}
+
+func TestScrub_QuarantinesCorrupt(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+	s := testScrubber(store)
+
+	intact, _ := store.Store(base64Of("an intact sound"))
+	flipped, _ := store.Store(base64Of("a flipped sound"))
+	truncated, _ := store.Store(base64Of("a truncated sound, long enough to be cut in half"))
+	corruptBlob(t, store, flipped, []byte("a flipped sounc"))
+	p, _ := store.findOwn(truncated)
+	info, _ := os.Stat(p)
+	os.Truncate(p, info.Size()/2)
+
+	report, err := s.Pass(nil)
+	if err != nil {
+		t.Fatalf("Unexpected scrub error: %v", err)
+	}
+	if report.Checked != 3 || report.Corrupt != 2 || report.Failed != 0 || len(report.Problems) != 2 {
+		t.Fail()
+		t.Logf("Expected 3 blobs checked and 2 corrupt. Got: %+v", report)
+	}
+	if !store.Exists(intact) || store.Exists(flipped) || store.Exists(truncated) {
+		t.Fail()
+		t.Log("Expected only the corrupt blobs to be taken out of the store")
+	}
+	if files, _ := ioutil.ReadDir(s.quarantineDir); len(files) != 2 {
+		t.Fail()
+		t.Logf("Expected 2 files in quarantine. Got: %d", len(files))
+	}
+	if _, err := os.Stat(s.ReportFile); err != nil {
+		t.Fail()
+		t.Logf("Expected a report to be written. Got: %v", err)
+	}
+}
+
+func TestScrub_Resume(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+	s := testScrubber(store)
+	for i := 0; i < 5; i++ {
+		store.Store(base64Of(fmt.Sprintf("blob %d", i)))
+	}
+
+	// Every check is followed by a sleep of the rate limit, stop after two
+	stop := make(chan struct{})
+	sleeps := 0
+	s.Rate = 1
+	s.now = func() time.Time { return time.Unix(0, 0) }
+	s.sleep = func(time.Duration) {
+		sleeps++
+		if sleeps == 2 {
+			close(stop)
+		}
+	}
+	report, err := s.Pass(stop)
+	if err != errScrubStopped || report.Checked != 2 {
+		t.Fail()
+		t.Logf("Expected pass to stop after 2 blobs. Got: %d, %v", report.Checked, err)
+	}
+
+	s = testScrubber(store)
+	report, err = s.Pass(nil)
+	if err != nil || report.Checked != 5 {
+		t.Fail()
+		t.Logf("Expected resumed pass to check every blob once. Got: %d, %v", report.Checked, err)
+	}
+
+	report, _ = s.Pass(nil)
+	if report.Checked != 5 {
+		t.Fail()
+		t.Logf("Expected a new pass after a finished one. Got: %d", report.Checked)
+	}
+}
+
+func TestScrub_Packed(t *testing.T) {
+	packs, _, cleanup := testPackStore(t, 1<<20)
+	defer cleanup()
+	store := packs.large.(*assetStore)
+	dir := path.Dir(store.dataDir)
+	s := createScrubber([]*assetStore{store}, packs, ScrubOptions{
+		StateFile:  path.Join(dir, "scrub", "state.json"),
+		ReportFile: path.Join(dir, "scrub", "report.json"),
+	}, path.Join(dir, "quarantine"))
+
+	hashes := []string{}
+	for i := 0; i < 5; i++ {
+		hash, _ := packs.Store(base64Of(fmt.Sprintf("packed gesture %d", i)))
+		hashes = append(hashes, hash)
+	}
+	entry := packs.index[hashes[3]]
+	packs.segments[entry.segment].f.WriteAt([]byte{0}, entry.offset+int64(entry.length)-1)
+
+	// Stop after two packed blobs and resume
+	stop := make(chan struct{})
+	sleeps := 0
+	s.Rate = 1
+	s.now = func() time.Time { return time.Unix(0, 0) }
+	s.sleep = func(time.Duration) {
+		sleeps++
+		if sleeps == 2 {
+			close(stop)
+		}
+	}
+	report, err := s.Pass(stop)
+	if err != errScrubStopped || report.Checked != 2 {
+		t.Fail()
+		t.Logf("Expected pass to stop after 2 packed blobs. Got: %d, %v", report.Checked, err)
+	}
+	state, _ := s.loadState()
+	if state == nil || state.Disk != packs.Dir || state.Segment != entry.segment || state.Offset == 0 {
+		t.Fail()
+		t.Logf("Expected the state to record the last packed blob checked. Got: %+v", state)
+	}
+
+	s.Rate = 0
+	report, err = s.Pass(nil)
+	if err != nil || report.Checked != 5 || report.Corrupt != 1 || len(report.Problems) != 1 {
+		t.Fail()
+		t.Logf("Expected every packed blob to be checked once and one to be corrupt. Got: %+v (%v)", report, err)
+	}
+	if packs.Exists(hashes[3]) || !packs.Exists(hashes[4]) {
+		t.Fail()
+		t.Log("Expected only the corrupt packed blob to be taken out of the store")
+	}
+	for _, problem := range report.Problems {
+		if _, err := os.Stat(problem.Quarantined); err != nil {
+			t.Fail()
+			t.Logf("Expected the corrupt packed blob in quarantine. Got: %v", err)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxSearchText is the number of bytes of an asset's text that is indexed
+const maxSearchText = 1 << 20
+
+var (
+	ErrSearchDisabled = errors.New("search is disabled")
+	errEmptyQuery     = errors.New("empty search query")
+)
+
+// textAssetTypes are the asset types whose contents are indexed:
+// notecards, LSL scripts and gestures.
+var textAssetTypes = map[int8]bool{7: true, 10: true, 21: true}
+
+type SearchQuery struct {
+	// Text holds words, "quoted phrases" and prefixes like wel*, all of
+	// which have to match
+	Text    string
+	Type    int8
+	HasType bool
+	Limit   int
+	Offset  int
+}
+
+type SearchResult struct {
+	Id          string  `xml:"ID" db:"id" json:"id"`
+	Name        string  `xml:"Name" db:"name" json:"name"`
+	Description string  `xml:"Description" db:"description" json:"description"`
+	Type        int8    `xml:"Type" db:"type" json:"type"`
+	Score       float64 `xml:"Score" db:"score" json:"score"`
+}
+
+// searchIndex keeps the names, descriptions and text contents of assets in
+// a MySQL full-text index.
+type searchIndex struct {
+	db Database
+	// content is false if the contents of text assets are left out, the
+	// index holds them in plain text
+	content bool
+}
+
+func createSearchIndex(db Database, content bool) *searchIndex {
+	return &searchIndex{db: db, content: content}
+}
+
+// Index adds or replaces asset in the index. data is the asset's content,
+// it is only looked at for text asset types.
+func (s *searchIndex) Index(asset AssetBase, data []byte) error {
+	content := ""
+	if s.content && textAssetTypes[asset.Type] {
+		content = assetText(data)
+	}
+	_, err := s.db.Exec("INSERT INTO `snapper_search` (`id`, `name`, `description`, `content`) VALUES (?, ?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE `name` = ?, `description` = ?, `content` = ?",
+		asset.Id, asset.Name, asset.Description, content, asset.Name, asset.Description, content)
+	if err == nil {
+		statAdd("search.indexed", 1)
+	}
+	return err
+}
+
+// Search returns the assets matching q, the best matches first. Assets
+// deleted since they were indexed are left out.
+func (s *searchIndex) Search(q SearchQuery) (results []SearchResult, err error) {
+	match := booleanQuery(q.Text)
+	if match == "" {
+		return nil, errEmptyQuery
+	}
+	where := ""
+	args := []interface{}{match, match}
+	if q.HasType {
+		where = " AND a.`type` = ?"
+		args = append(args, q.Type)
+	}
+	args = append(args, q.Limit, q.Offset)
+	err = s.db.Select(&results, "SELECT a.`id`, a.`name`, a.`description`, a.`type`, "+
+		"MATCH(s.`name`, s.`description`, s.`content`) AGAINST (? IN BOOLEAN MODE) AS `score` "+
+		"FROM `snapper_search` s JOIN `fsassets` a ON a.`id` = s.`id` "+
+		"WHERE MATCH(s.`name`, s.`description`, s.`content`) AGAINST (? IN BOOLEAN MODE)"+where+
+		" ORDER BY `score` DESC, a.`id` LIMIT ? OFFSET ?", args...)
+	statAdd("search.queries", 1)
+	return
+}
+
+// booleanQuery turns the words, "phrases" and prefix* of text into a MySQL
+// boolean mode query all of which have to match. Other operators are
+// dropped so users cannot break the query.
+func booleanQuery(text string) string {
+	terms := []string{}
+	for i, part := range strings.Split(text, `"`) {
+		if i%2 == 1 {
+			// Inside quotes
+			if words := searchWords(part); len(words) > 0 {
+				terms = append(terms, `+"`+strings.Join(words, " ")+`"`)
+			}
+			continue
+		}
+		for _, field := range strings.Fields(part) {
+			words := searchWords(field)
+			for j, word := range words {
+				if j == len(words)-1 && strings.HasSuffix(field, "*") {
+					word += "*"
+				}
+				terms = append(terms, "+"+word)
+			}
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// searchWords splits s into words of letters, digits and underscores.
+func searchWords(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+// assetText returns the text of a notecard, script or gesture. Notecards
+// wrap their text in the Linden text format, only the text is returned.
+func assetText(data []byte) string {
+	if bytes.HasPrefix(data, []byte("Linden text version")) {
+		data = notecardBody(data)
+	}
+	if len(data) > maxSearchText {
+		data = data[:maxSearchText]
+	}
+	return strings.ToValidUTF8(string(data), "")
+}
+
+// notecardBody returns the text of a Linden text notecard, all of data if
+// it cannot be parsed.
+func notecardBody(data []byte) []byte {
+	marker := []byte("Text length ")
+	i := bytes.Index(data, marker)
+	if i < 0 {
+		return data
+	}
+	rest := data[i+len(marker):]
+	eol := bytes.IndexByte(rest, '\n')
+	if eol < 0 {
+		return data
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(string(rest[:eol])))
+	if err != nil || length < 0 {
+		return data
+	}
+	body := rest[eol+1:]
+	if length < len(body) {
+		body = body[:length]
+	}
+	return body
+}
+
+// readText reads the content of a text asset from store, nil for other
+// asset types.
+func readText(store AssetStore, asset AssetBase) ([]byte, error) {
+	if !textAssetTypes[asset.Type] {
+		return nil, nil
+	}
+	if _, ok := hashKey(asset.Hash); !ok {
+		return nil, ErrInvalidHash
+	}
+	reader, err := store.Load(asset.Hash)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(io.LimitReader(reader, maxSearchText*2))
+}
+
+// decodeText returns the content of a text asset being created.
+func decodeText(data *FullAssetData) []byte {
+	if !textAssetTypes[data.Type] {
+		return nil
+	}
+	content, _ := base64.StdEncoding.DecodeString(data.Data)
+	return content
+}
+
+// Reindex indexes every stored asset, starting after the given id, and
+// returns how many it indexed.
+func (s *searchIndex) Reindex(model AssetModel, store AssetStore, after string) (indexed int, err error) {
+	for {
+		assets, err := model.List(AssetFilter{}, after, refsBatchSize)
+		if err != nil {
+			return indexed, err
+		}
+		for _, asset := range assets {
+			var data []byte
+			if s.content {
+				var err error
+				if data, err = readText(store, asset); err != nil {
+					log.Printf("Search: failed to read asset %v: %v\n", asset.Id, err)
+				}
+			}
+			if err := s.Index(asset, data); err != nil {
+				return indexed, err
+			}
+			indexed++
+		}
+		if len(assets) < refsBatchSize {
+			return indexed, nil
+		}
+		after = assets[len(assets)-1].Id
+		log.Printf("Search: indexed %d assets up to %v\n", indexed, after)
+	}
+}
+
+func runReindex(config *Config, args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	after := fs.String("after", "", "Resume after this asset id")
+	fs.Parse(args)
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	store, packs, err := config.OpenStack()
+	if err != nil {
+		return err
+	}
+	if packs != nil {
+		defer packs.Close()
+	}
+	indexed, err := createSearchIndex(db, config.EncryptionKeys == "").Reindex(CreateAssetModel(db), store, *after)
+	log.Printf("Search: indexed %d assets\n", indexed)
+	return err
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type mockSearchDatabase struct {
+	mockMigrationDatabase
+	indexed map[string]string
+}
+
+func (m *mockSearchDatabase) Exec(query string, args ...interface{}) (sql.Result, error) {
+	m.indexed[args[0].(string)] = args[1].(string) + "|" + args[3].(string)
+	return nil, nil
+}
+
+type mockListModel struct {
+	mockModel
+	assets []AssetBase
+}
+
+func (m *mockListModel) List(filter AssetFilter, after string, limit int) ([]AssetBase, error) {
+	result := []AssetBase{}
+	for _, asset := range m.assets {
+		if asset.Id > after && len(result) < limit {
+			result = append(result, asset)
+		}
+	}
+	return result, nil
+}
+
+func TestSearch_BooleanQuery(t *testing.T) {
+	cases := map[string]string{
+		"welcome area":            "+welcome +area",
+		`"welcome area" notecard`: `+"welcome area" +notecard`,
+		"llSay* -foo":             "+llSay* +foo",
+		`+(evil) ~ @2 "" * "open`: `+evil +2 +"open"`,
+		"ll_detected*":            "+ll_detected*",
+		"café menü-karte":         "+café +menü +karte",
+	}
+	for text, expected := range cases {
+		if got := booleanQuery(text); got != expected {
+			t.Fail()
+			t.Logf("Query %q: expected %q, got %q", text, expected, got)
+		}
+	}
+}
+
+func TestSearch_AssetText(t *testing.T) {
+	notecard := "Linden text version 2\n{\nLLEmbeddedItems version 1\n{\ncount 0\n}\nText length 20\nWelcome to the area\n}\n"
+	if text := assetText([]byte(notecard)); text != "Welcome to the area\n" {
+		t.Fail()
+		t.Logf("Expected the notecard text. Got: %q", text)
+	}
+	if text := assetText([]byte("default { state_entry() { llSay(0, \"hi\"); } }\xff")); !strings.HasPrefix(text, "default {") || strings.Contains(text, "\xff") {
+		t.Fail()
+		t.Logf("Expected the script as valid UTF-8. Got: %q", text)
+	}
+}
+
+func TestSearch_Reindex(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+	script, _ := store.Store(base64Of("default { touch_start(integer n) { llSay(0, \"hi\"); } }"))
+	texture, _ := store.Store(base64Of("not text"))
+	model := &mockListModel{assets: []AssetBase{
+		{Id: "a1", Name: "Greeter", Type: 10, Hash: script},
+		{Id: "a2", Name: "Brick", Type: 0, Hash: texture},
+		{Id: "a3", Name: "Lost", Type: 7, Hash: "0000"},
+	}}
+	db := &mockSearchDatabase{indexed: map[string]string{}}
+	indexed, err := createSearchIndex(db, true).Reindex(model, store, "")
+	if err != nil || indexed != 3 {
+		t.Fail()
+		t.Logf("Expected every asset to be indexed. Got: %d (%v)", indexed, err)
+	}
+	if !strings.Contains(db.indexed["a1"], "llSay") || db.indexed["a2"] != "Brick|" || db.indexed["a3"] != "Lost|" {
+		t.Fail()
+		t.Logf("Unexpected index: %v", db.indexed)
+	}
+}
+
+func TestSearch_CreateIndexes(t *testing.T) {
+	db := &mockSearchDatabase{indexed: map[string]string{}}
+	svc := &service{
+		model: &mockModel{},
+		store: &mockStore{
+			testData:     base64Of("Welcome to the area"),
+			expectedHash: testFileDataContentHash,
+		},
+		search: createSearchIndex(db, true),
+	}
+	data := FullAssetData{Data: base64Of("Welcome to the area")}
+	data.Id, data.Name, data.Type = "n1", "Welcome", 7
+	if err := svc.CreateAsset(&data); err != nil || db.indexed["n1"] != "Welcome|Welcome to the area" {
+		t.Fail()
+		t.Logf("Expected the created notecard to be indexed. Got: %v (%v)", db.indexed, err)
+	}
+}
+
+func TestAdmin_Search(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/admin/search?q=welcome&type=7&format=json", nil)
+	httpTestServiceInstance.AdminRouter().ServeHTTP(recorder, request)
+	if recorder.Code != 200 || !strings.Contains(recorder.Body.String(), `"results":[{"id":"`+testContentId) {
+		t.Fail()
+		t.Logf("Unexpected response: %d %s", recorder.Code, recorder.Body)
+	}
+	for _, query := range []string{"", "q=x&offset=-1", "q=x&type=x"} {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/admin/search?"+query, nil)
+		httpTestServiceInstance.AdminRouter().ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusBadRequest {
+			t.Fail()
+			t.Logf("Expected %q to be rejected. Got: %d", query, recorder.Code)
+		}
+	}
+}
+
+func TestSearch_WithoutContent(t *testing.T) {
+	db := &mockSearchDatabase{indexed: map[string]string{}}
+	asset := AssetBase{Id: "n1", Name: "Welcome", Type: 7}
+	if err := createSearchIndex(db, false).Index(asset, []byte("Welcome to the area")); err != nil || db.indexed["n1"] != "Welcome|" {
+		t.Fail()
+		t.Logf("Expected the notecard to be indexed without its text. Got: %v (%v)", db.indexed, err)
+	}
+}
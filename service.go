@@ -19,12 +19,51 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"io"
+	"io/ioutil"
+	"log"
+	"syscall"
 )
 
+var (
+	ErrInsufficientStorage = errors.New("insufficient storage")
+	ErrInvalidHash         = errors.New("invalid hash")
+	ErrUnknownBlob         = errors.New("no blob with this hash is stored, upload the asset data instead")
+)
+
+// StorageGuard decides whether the service currently accepts new assets.
+type StorageGuard interface {
+	ReadOnly() bool
+}
+
+// AccessRecorder is told about every read of an asset.
+type AccessRecorder interface {
+	Record(id string)
+}
+
+// TemporaryAssets holds the assets marked Temporary or Local instead of the
+// store and the database.
+type TemporaryAssets interface {
+	Put(data *FullAssetData) error
+	Get(id string) (meta AssetBase, data []byte, ok bool)
+}
+
+// SearchIndex is told about every created asset and answers searches.
+type SearchIndex interface {
+	Index(asset AssetBase, data []byte) error
+	Search(q SearchQuery) ([]SearchResult, error)
+}
+
 type service struct {
-	model AssetModel
-	store AssetStore
+	model     AssetModel
+	store     AssetStore
+	guard     StorageGuard
+	access    AccessRecorder
+	temporary TemporaryAssets
+	search    SearchIndex
 }
 
 type Service interface {
@@ -34,47 +73,144 @@ type Service interface {
 	CreateAsset(data *FullAssetData) error
 	AssetExists(id string) bool
 	AssetsExist(ids []string) []bool
+	ListAssets(filter AssetFilter, after string, limit int) ([]AssetBase, error)
+	SearchAssets(q SearchQuery) ([]SearchResult, error)
+	GetBlobInfo(hash string) (BlobInfo, error)
+	AssetsByHash(hash string, after string, limit int) ([]string, error)
+	GetBlob(hash string) (io.ReadCloser, error)
+	BlobsExist(hashes []string) []bool
 }
 
-func CreateService(db Database, dataDir, spoolDir string) Service {
+// CreateService creates the asset service. Temporary assets are persisted
+// like any other if temporary is nil, search is disabled if search is.
+func CreateService(db Database, store AssetStore, guard StorageGuard, access AccessRecorder, temporary TemporaryAssets, search SearchIndex) Service {
 	return &service{
-		model: CreateAssetModel(db),
-		store: CreateAssetStore(dataDir, spoolDir),
+		model:     CreateAssetModel(db),
+		store:     store,
+		guard:     guard,
+		access:    access,
+		temporary: temporary,
+		search:    search,
 	}
 }
 
+func (s service) recordAccess(id string) {
+	if s.access != nil {
+		s.access.Record(id)
+	}
+}
+
+// getTemporary returns the temporary asset id, ok is false if there is none.
+func (s service) getTemporary(id string) (meta AssetBase, data []byte, ok bool) {
+	if s.temporary == nil {
+		return
+	}
+	return s.temporary.Get(id)
+}
+
 func (s service) GetFullAssetData(id string) (data FullAssetData, err error) {
+	if meta, buffer, ok := s.getTemporary(id); ok {
+		data.AssetBase = meta
+		data.Data = base64.StdEncoding.EncodeToString(buffer)
+		return
+	}
 	data.AssetBase, err = s.model.Get(id)
 	if err == nil {
 		data.Data, err = s.store.GetAsBase64(data.Hash)
 	}
+	if err == nil {
+		s.recordAccess(id)
+	}
 	return
 }
 
 func (s service) GetAssetMetaData(id string) (data AssetBase, err error) {
+	if meta, _, ok := s.getTemporary(id); ok {
+		return meta, nil
+	}
 	data, err = s.model.Get(id)
 	return
 }
 
 func (s service) GetAssetData(id string) (io.ReadCloser, int8, error) {
+	if meta, buffer, ok := s.getTemporary(id); ok {
+		return ioutil.NopCloser(bytes.NewReader(buffer)), meta.Type, nil
+	}
 	hash, assetType, err := s.model.GetHashAndType(id)
 	if err != nil {
 		return nil, 0, err
 	}
 	reader, err := s.store.Load(hash)
+	if err == nil {
+		s.recordAccess(id)
+	}
 	return reader, assetType, err
 }
 
+// CreateAsset stores the asset. An asset without Data but with BlobHash
+// refers to a blob already in the store and only its row is written.
 func (s service) CreateAsset(data *FullAssetData) error {
-	var err error = nil
-	data.Hash, err = s.store.Store(data.Data)
-	if err != nil {
+	byHash := data.Data == "" && data.BlobHash != ""
+	if byHash {
+		hash, ok := normalizeHash(data.BlobHash)
+		if !ok {
+			return ErrInvalidHash
+		}
+		// Touching the blob keeps garbage collection from deleting it
+		// before the row referring to it is written
+		if !touchBlob(s.store, hash) {
+			statAdd("assets.create_unknown_blob", 1)
+			return ErrUnknownBlob
+		}
+		data.Hash = hash
+	}
+	if (data.Temporary || data.Local) && s.temporary != nil {
+		if byHash {
+			var err error
+			if data.Data, err = s.store.GetAsBase64(data.Hash); err != nil {
+				return err
+			}
+		}
+		return s.temporary.Put(data)
+	}
+	if !byHash {
+		if s.guard != nil && s.guard.ReadOnly() {
+			statAdd("assets.create_rejected", 1)
+			return ErrInsufficientStorage
+		}
+		var err error = nil
+		data.Hash, err = s.store.Store(data.Data)
+		if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) || err == ErrInsufficientStorage {
+			statAdd("assets.create_rejected", 1)
+			return ErrInsufficientStorage
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.model.Put(data.AssetBase); err != nil {
 		return err
 	}
-	return s.model.Put(data.AssetBase)
+	if byHash {
+		statAdd("assets.created_by_hash", 1)
+	}
+	if s.search != nil {
+		text := decodeText(data)
+		if byHash {
+			text, _ = readText(s.store, data.AssetBase)
+		}
+		// The asset is stored, a failure only leaves it out of searches
+		if err := s.search.Index(data.AssetBase, text); err != nil {
+			log.Printf("Failed to index asset %v: %v\n", data.Id, err)
+		}
+	}
+	return nil
 }
 
 func (s service) AssetExists(id string) bool {
+	if _, _, ok := s.getTemporary(id); ok {
+		return true
+	}
 	hash, err := s.model.GetHash(id)
 	if err != nil {
 		return false
@@ -89,3 +225,48 @@ func (s service) AssetsExist(ids []string) []bool {
 	}
 	return result
 }
+
+// ListAssets returns up to limit stored assets matching filter, ordered by
+// and starting after the given id. Temporary assets held in memory are not
+// listed.
+func (s service) ListAssets(filter AssetFilter, after string, limit int) ([]AssetBase, error) {
+	return s.model.List(filter, after, limit)
+}
+
+func (s service) SearchAssets(q SearchQuery) ([]SearchResult, error) {
+	if s.search == nil {
+		return nil, ErrSearchDisabled
+	}
+	return s.search.Search(q)
+}
+
+func (s service) GetBlobInfo(hash string) (BlobInfo, error) {
+	return blobInfo(s.store, hash)
+}
+
+// AssetsByHash returns up to limit ids, ordered and starting after the
+// given one, of the stored assets referring to the blob hash.
+func (s service) AssetsByHash(hash string, after string, limit int) ([]string, error) {
+	return s.model.IdsByHash(hash, after, limit)
+}
+
+// GetBlob reads the blob with the SHA-256 hash, in upper or lower case.
+func (s service) GetBlob(hash string) (io.ReadCloser, error) {
+	hash, ok := normalizeHash(hash)
+	if !ok {
+		return nil, ErrInvalidHash
+	}
+	return s.store.Load(hash)
+}
+
+// BlobsExist reports for each hash whether the store has the blob, invalid
+// hashes are reported missing.
+func (s service) BlobsExist(hashes []string) []bool {
+	result := make([]bool, len(hashes))
+	for i, hash := range hashes {
+		if hash, ok := normalizeHash(hash); ok {
+			result[i] = s.store.Exists(hash)
+		}
+	}
+	return result
+}
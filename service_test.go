@@ -24,6 +24,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 const (
@@ -76,6 +77,42 @@ func (m *mockModel) Put(asset AssetBase) error {
 	return nil
 }
 
+func (m *mockModel) ColdHashes(before int64, after string, limit int) ([]string, error) {
+	return nil, nil
+}
+
+func (m *mockModel) Refs(after string, limit int) ([]AssetRef, error) {
+	return nil, nil
+}
+
+func (m *mockModel) MarkBroken(id string) error {
+	return nil
+}
+
+func (m *mockModel) Collectable(before int64, after string, limit int) ([]AssetRef, error) {
+	return nil, nil
+}
+
+func (m *mockModel) DeleteCollectable(id string, before int64) (bool, error) {
+	return false, nil
+}
+
+func (m *mockModel) HashReferenced(hash string) (bool, error) {
+	return false, nil
+}
+
+func (m *mockModel) Touch(ids []string, at, before int64) error {
+	return nil
+}
+
+func (m *mockModel) List(filter AssetFilter, after string, limit int) ([]AssetBase, error) {
+	return nil, nil
+}
+
+func (m *mockModel) IdsByHash(hash string, after string, limit int) ([]string, error) {
+	return nil, nil
+}
+
 type mockStore struct {
 	testData     string
 	testDataB64  string
@@ -335,3 +372,112 @@ func TestService_AssetsExistsNegative(t *testing.T) {
 		t.Log("Expected one call on Model to Get(id)")
 	}
 }
+
+type mockGuard struct {
+	readOnly bool
+}
+
+func (m *mockGuard) ReadOnly() bool {
+	return m.readOnly
+}
+
+func TestService_CreateAssetReadOnly(t *testing.T) {
+	svc := &service{
+		model: &mockModel{},
+		store: &mockStore{
+			testData:     testFileDataContent,
+			testDataB64:  "",
+			expectedHash: testFileDataContentHash,
+		},
+		guard: &mockGuard{readOnly: true},
+	}
+
+	data := FullAssetData{}
+	data.AssetBase = testServiceAssetInstance()
+	data.Data = testFileDataContent
+	err := svc.CreateAsset(&data)
+	if err != ErrInsufficientStorage {
+		t.Fail()
+		t.Logf("Expected ErrInsufficientStorage on CreateAsset. Got: %v", err)
+	}
+
+	mmodel := svc.model.(*mockModel)
+	if mmodel.PutCalls != 0 {
+		t.Fail()
+		t.Log("Expected no call on Model to Put(asset) while read-only")
+	}
+}
+
+type mockAccessRecorder struct {
+	ids []string
+}
+
+func (m *mockAccessRecorder) Record(id string) {
+	m.ids = append(m.ids, id)
+}
+
+func TestService_RecordsAccess(t *testing.T) {
+	access := &mockAccessRecorder{}
+	svc := &service{
+		model: &mockModel{},
+		store: &mockStore{
+			testData:     testFileDataContent,
+			testDataB64:  testFileDataContentB64,
+			expectedHash: testFileDataContentHash,
+		},
+		access: access,
+	}
+
+	svc.GetFullAssetData(testContentId)
+	reader, _, err := svc.GetAssetData(testContentId)
+	if err == nil {
+		reader.Close()
+	}
+	svc.GetAssetMetaData(testContentId)
+	svc.AssetExists(testContentId)
+	if len(access.ids) != 2 || access.ids[0] != testContentId || access.ids[1] != testContentId {
+		t.Fail()
+		t.Logf("Expected the two data reads to be recorded. Got: %v", access.ids)
+	}
+}
+
+func TestService_TemporaryAssets(t *testing.T) {
+	temp, _ := createTemporaryStore(TemporaryOptions{MaxBytes: 1024, TTL: time.Hour})
+	model := &mockModel{}
+	svc := &service{
+		model:     model,
+		store:     &mockStore{},
+		temporary: temp,
+	}
+
+	data := FullAssetData{Data: testFileDataContentB64}
+	data.AssetBase = testServiceAssetInstance()
+	data.Id, data.Local = "bake", true
+	if err := svc.CreateAsset(&data); err != nil || model.PutCalls != 0 {
+		t.Fail()
+		t.Logf("Expected a local asset to stay out of the database. Got: %v", err)
+	}
+	full, err := svc.GetFullAssetData("bake")
+	if err != nil || full.Data != testFileDataContentB64 || !full.Local {
+		t.Fail()
+		t.Logf("Expected the local asset to be served. Got: %+v (%v)", full.AssetBase, err)
+	}
+	reader, _, err := svc.GetAssetData("bake")
+	if err != nil {
+		t.Fatalf("Expected the local asset data. Got: %v", err)
+	}
+	if content, _ := ioutil.ReadAll(reader); string(content) != testFileDataContent {
+		t.Fail()
+		t.Log("Asset data mismatch")
+	}
+	if !svc.AssetExists("bake") {
+		t.Fail()
+		t.Log("Expected the local asset to exist")
+	}
+
+	svc.temporary = rejectTemporary{}
+	if err := svc.CreateAsset(&data); err != ErrTemporaryRejected {
+		t.Fail()
+		t.Logf("Expected ErrTemporaryRejected. Got: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type SweepReport struct {
+	Scanned    int
+	Removed    int
+	Promoted   int
+	Failed     int
+	BytesFreed int64
+}
+
+// spoolSweeper cleans up files left behind in the spool directory by uploads
+// that never finished, e.g. because the process crashed mid write.
+type spoolSweeper struct {
+	store   placer
+	maxAge  time.Duration
+	promote bool
+	now     func() time.Time
+}
+
+func createSpoolSweeper(store placer, maxAge time.Duration, promote bool) *spoolSweeper {
+	return &spoolSweeper{
+		store:   store,
+		maxAge:  maxAge,
+		promote: promote,
+		now:     time.Now,
+	}
+}
+
+// Sweep removes every spool file older than maxAge. When promotion is enabled
+// files that decompress to content matching the hash in their name are moved
+// into the data store instead.
+func (s *spoolSweeper) Sweep() (report SweepReport, err error) {
+	cutoff := s.now().Add(-s.maxAge)
+	// All disks share the spool directory
+	spoolDir := s.store.dataDisks()[0].spoolDir
+	err = filepath.Walk(spoolDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() && p == filepath.Join(spoolDir, uploadDirName) {
+			// Upload sessions expire on their own
+			return filepath.SkipDir
+		}
+		if info.IsDir() || info.ModTime().After(cutoff) {
+			return nil
+		}
+		report.Scanned++
+
+		if s.promote {
+			promoted, err := s.tryPromote(p)
+			if err != nil {
+				log.Printf("Spool sweep: failed to promote %v: %v\n", p, err)
+			}
+			if promoted {
+				report.Promoted++
+				return nil
+			}
+		}
+
+		if err := os.Remove(p); err != nil {
+			log.Printf("Spool sweep: failed to remove %v: %v\n", p, err)
+			report.Failed++
+			return nil
+		}
+		report.Removed++
+		report.BytesFreed += info.Size()
+		return nil
+	})
+	return
+}
+
+// tryPromote verifies the spool file at p and commits it to the data store.
+// It returns false when the file is incomplete, corrupt or already stored, in
+// which case the caller is expected to remove it.
+func (s *spoolSweeper) tryPromote(p string) (bool, error) {
+	hash := blobHash(p)
+	format := blobFormat(p)
+	if !isValidHash(hash) {
+		return false, nil
+	}
+	if s.store.Exists(hash) {
+		return false, nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	reader, err := newAssetReader(f, format, s.store.dataDisks()[0].keys)
+	if err != nil {
+		return false, nil
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, reader)
+	if err == nil {
+		// The upload may have crashed before it synced the file
+		err = f.Sync()
+	}
+	reader.Close()
+	if err != nil || strings.ToUpper(hex.EncodeToString(hasher.Sum(nil))) != hash {
+		return false, nil
+	}
+
+	if err := moveBlob(p, s.store.placeBlob(hash), hash); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Run sweeps the spool directory every interval until stop is closed.
+func (s *spoolSweeper) Run(interval time.Duration, stop <-chan struct{}) {
+	every(interval, stop, s.sweepAndLog)
+}
+
+func (s *spoolSweeper) sweepAndLog() {
+	report, err := s.Sweep()
+	if err != nil {
+		log.Printf("Spool sweep failed: %v\n", err)
+	}
+	log.Printf("Spool sweep: scanned %d removed %d promoted %d failed %d freed %d bytes\n",
+		report.Scanned, report.Removed, report.Promoted, report.Failed, report.BytesFreed)
+}
+
+// isValidHash reports whether hash looks like the upper case hex SHA-256
+// produced by assetStore.makeHash.
+func isValidHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range hash {
+		if !(c >= '0' && c <= '9') && !(c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
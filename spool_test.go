@@ -0,0 +1,148 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+func testSpoolStore(t *testing.T) (*assetStore, func()) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Skipf("Unable to create temp dir: %v", err)
+	}
+	store := CreateAssetStore(StoreOptions{
+		DataDir:  path.Join(dir, "data"),
+		SpoolDir: path.Join(dir, "tmp"),
+		DirMode:  0755,
+		FileMode: 0644,
+	}).(*assetStore)
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func writeSpoolFile(t *testing.T, store *assetStore, name string, content []byte, age time.Duration) string {
+	p := path.Join(store.spoolDir, name[0:3], name[3:6], name)
+	os.MkdirAll(path.Dir(p), 0755)
+	if err := ioutil.WriteFile(p, content, 0644); err != nil {
+		t.Fatalf("Unable to write spool file: %v", err)
+	}
+	mtime := time.Now().Add(-age)
+	os.Chtimes(p, mtime, mtime)
+	return p
+}
+
+func TestSpoolSweeper_RemovesStale(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+
+	stale := writeSpoolFile(t, store, testFileDataContentHash+".snappy.1", []byte("partial"), 2*time.Hour)
+	fresh := writeSpoolFile(t, store, testFileDataContentHash+".snappy.2", []byte("partial"), 0)
+
+	report, err := createSpoolSweeper(store, time.Hour, false).Sweep()
+	if err != nil {
+		t.Fail()
+		t.Logf("Unexpected sweep error: %v", err)
+	}
+	if report.Scanned != 1 || report.Removed != 1 || report.Promoted != 0 || report.BytesFreed != int64(len("partial")) {
+		t.Fail()
+		t.Logf("Unexpected report: %+v", report)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fail()
+		t.Logf("Expected stale spool file to be removed")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fail()
+		t.Logf("Expected fresh spool file to be kept: %v", err)
+	}
+}
+
+func TestSpoolSweeper_Promotes(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+
+	content := snappyEncode(t, testFileDataContent)
+	writeSpoolFile(t, store, testFileDataContentHash+".snappy.1", content, 2*time.Hour)
+	corrupt := writeSpoolFile(t, store, emptyTestFileDataContentHash+".snappy.1", content, 2*time.Hour)
+
+	report, err := createSpoolSweeper(store, time.Hour, true).Sweep()
+	if err != nil {
+		t.Fail()
+		t.Logf("Unexpected sweep error: %v", err)
+	}
+	if report.Scanned != 2 || report.Promoted != 1 || report.Removed != 1 {
+		t.Fail()
+		t.Logf("Unexpected report: %+v", report)
+	}
+	data, err := store.GetAsBase64(testFileDataContentHash)
+	if err != nil || data != testFileDataContentB64 {
+		t.Fail()
+		t.Logf("Expected promoted blob to be readable. Got: %v (%v)", data, err)
+	}
+	if store.Exists(emptyTestFileDataContentHash) {
+		t.Fail()
+		t.Log("Spool file with mismatching hash must not be promoted")
+	}
+	if _, err := os.Stat(corrupt); !os.IsNotExist(err) {
+		t.Fail()
+		t.Log("Expected spool file with mismatching hash to be removed")
+	}
+}
+
+func TestSpoolSweeper_MissingSpool(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+
+	if _, err := createSpoolSweeper(store, time.Hour, true).Sweep(); err != nil {
+		t.Fail()
+		t.Logf("Expected a missing spool dir to be ignored. Got: %v", err)
+	}
+}
+
+func TestSpool_isValidHash(t *testing.T) {
+	if !isValidHash(testFileDataContentHash) {
+		t.Fail()
+		t.Logf("Expected %v to be valid", testFileDataContentHash)
+	}
+	if isValidHash(strings.ToLower(testFileDataContentHash)) || isValidHash("DEADBEEF") || isValidHash("") {
+		t.Fail()
+		t.Log("Expected lower case and short hashes to be invalid")
+	}
+}
+
+func snappyEncode(t *testing.T, content string) []byte {
+	f, err := ioutil.TempFile("", "snappy")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	w := snappy.NewWriter(f)
+	w.Write([]byte(content))
+	w.Close()
+	f.Close()
+	data, _ := ioutil.ReadFile(f.Name())
+	return data
+}
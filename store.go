@@ -19,7 +19,6 @@
 package main
 
 import (
-	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
 	"encoding/base64"
@@ -29,6 +28,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/golang/snappy"
 )
@@ -40,64 +40,88 @@ type AssetStore interface {
 	GetAsBase64(hash string) (string, error)
 }
 
+type StoreOptions struct {
+	DataDir        string
+	SpoolDir       string
+	DirMode        os.FileMode
+	FileMode       os.FileMode
+	Layout         Layout
+	PreviousLayout *Layout
+	FSAssets       *FSAssetsOptions
+	// Keys encrypts new blobs when set.
+	Keys *keyRing
+}
+
 type assetStore struct {
 	dataDir  string
 	spoolDir string
+	dirMode  os.FileMode
+	fileMode os.FileMode
+	layout   *layoutState
+	fsassets *fsAssetsTree
+	keys     *keyRing
 }
 
-func CreateAssetStore(dataDir, spoolDir string) AssetStore {
+func CreateAssetStore(opts StoreOptions) AssetStore {
+	layout := opts.Layout
+	if layout == (Layout{}) {
+		layout = defaultLayout
+	}
+	var fsassets *fsAssetsTree
+	if opts.FSAssets != nil {
+		fsassets = &fsAssetsTree{FSAssetsOptions: *opts.FSAssets}
+	}
 	return &assetStore{
-		dataDir:  dataDir,
-		spoolDir: spoolDir,
+		dataDir:  opts.DataDir,
+		spoolDir: opts.SpoolDir,
+		dirMode:  opts.DirMode,
+		fileMode: opts.FileMode,
+		layout: &layoutState{
+			dataDir:  opts.DataDir,
+			current:  layout,
+			previous: opts.PreviousLayout,
+			checked:  time.Now(),
+		},
+		fsassets: fsassets,
+		keys:     opts.Keys,
 	}
 }
 
+// makePath returns the location of hash in the layout new blobs are
+// written to.
 func (a assetStore) makePath(hash string) string {
-	return path.Join(a.dataDir, hash[0:3], hash[3:6], hash)
+	return a.makeLayoutPath(a.layout.layouts()[0], hash)
 }
 
-func (a assetStore) Load(hash string) (io.ReadCloser, error) {
-	spath := a.makePath(hash)
-	zipped := false
-	snap := false
-	f, e := os.Open(spath)
-	if e != nil {
+func (a assetStore) makeLayoutPath(layout Layout, hash string) string {
+	return path.Join(a.dataDir, layout.Path(hash))
+}
 
-		f, e = os.Open(spath + ".snappy")
-		if e != nil {
-			f, e = os.Open(spath + ".gz")
-			zipped = true
-		} else {
-			snap = true
+func (a assetStore) Load(hash string) (io.ReadCloser, error) {
+	// A blob may be moved by a running reshard between finding and opening
+	// it, so look it up a second time before giving up.
+	for attempt := 0; ; attempt++ {
+		spath, exists := a.exists(hash)
+		if !exists {
+			return nil, &os.PathError{Op: "open", Path: spath, Err: os.ErrNotExist}
+		}
+		f, e := os.Open(spath)
+		if os.IsNotExist(e) && attempt == 0 {
+			continue
 		}
-	}
-	if e != nil {
-		return nil, e
-	}
-
-	if !zipped && !snap {
-		return f, nil
-	}
-
-	if zipped {
-		gzipreader, e := gzip.NewReader(f)
 		if e != nil {
 			return nil, e
 		}
-		return &assetReader{
-			f:      f,
-			gzip:   gzipreader,
-			snappy: nil,
-		}, nil
+		return newAssetReader(f, blobFormat(f.Name()), a.keys)
 	}
-	return &assetReader{
-		f:      f,
-		gzip:   nil,
-		snappy: snappy.NewReader(f),
-	}, nil
 }
 
 func (a assetStore) makeHash(data []byte) string {
+	return makeHash(data)
+}
+
+// makeHash returns the upper case hex SHA-256 all stores address blobs by.
+func makeHash(data []byte) string {
 	shabuf := sha256.Sum256(data)
 	return strings.ToUpper(hex.EncodeToString(shabuf[0:len(shabuf)]))
 }
@@ -108,33 +132,41 @@ func (a assetStore) Exists(hash string) bool {
 }
 
 func (a assetStore) exists(hash string) (string, bool) {
-	spath := a.makePath(hash)
-	if _, err := os.Stat(spath); err == nil {
-		// already exists
-		return spath, true
-	}
-
-	gzPath := spath + ".gz"
-	if _, err := os.Stat(gzPath); err == nil {
-		// already exists
-		return gzPath, true
+	spath, found := a.findOwn(hash)
+	if !found && a.fsassets != nil {
+		if p, found := a.fsassets.find(hash); found {
+			return a.adoptFSAssets(hash, p), true
+		}
 	}
+	return spath, found
+}
 
-	snappyPath := spath + ".snappy"
-	if _, err := os.Stat(snappyPath); err == nil {
-		// already exists
-		return snappyPath, true
+// findOwn looks for hash in the layouts of the store itself. If it is not
+// found the path a new blob for hash is written to is returned.
+func (a assetStore) findOwn(hash string) (string, bool) {
+	layouts := a.layout.layouts()
+	for _, layout := range layouts {
+		spath := a.makeLayoutPath(layout, hash)
+		for _, candidate := range []string{spath, spath + ".gz", spath + ".snappy"} {
+			if _, err := os.Stat(candidate); err == nil {
+				// already exists
+				return candidate, true
+			}
+		}
 	}
-	return snappyPath, false
+	return a.makeLayoutPath(layouts[0], hash) + ".snappy", false
 }
 
 func (a assetStore) preparePath(hash string) (string, error) {
 	spath, exists := a.exists(hash)
 	if exists {
+		// Stored again, keep it from garbage collection for a while
+		now := time.Now()
+		os.Chtimes(spath, now, now)
 		return "", os.ErrExist
 	}
 
-	err := os.MkdirAll(path.Dir(spath), 0773)
+	err := os.MkdirAll(path.Dir(spath), a.dirMode)
 	if err != nil {
 		if err != os.ErrExist {
 			return "", err
@@ -149,54 +181,115 @@ func (a assetStore) Store(data string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	return a.storeBytes(buffer)
+}
+
+func (a assetStore) storeBytes(buffer []byte) (string, error) {
 	hash := a.makeHash(buffer)
 	spath, err := a.preparePath(hash)
-
 	if os.IsExist(err) {
 		return hash, nil
 	}
+	if err != nil {
+		return hash, err
+	}
+	return hash, a.writeBlob(spath, buffer)
+}
 
+// writeBlob compresses buffer into the blob file spath.
+func (a assetStore) writeBlob(spath string, buffer []byte) error {
 	// All checks done, now create temporary file instead of real one
 	// To have some transaction safety
 	tempPath := strings.Replace(spath, a.dataDir, a.spoolDir, 1)
-	err = os.MkdirAll(path.Dir(tempPath), 0773)
+	err := os.MkdirAll(path.Dir(tempPath), a.dirMode)
 	if err != nil {
-		return hash, err
+		return err
 	}
 
-	f, err := os.Create(tempPath)
+	tempPath, err = a.writeTemp(tempPath, buffer, path.Ext(spath) == ".snappy")
 	if err != nil {
-		return hash, err
+		return err
 	}
-	defer f.Close()
 
-	if path.Ext(spath) == ".snappy" {
-		snap := snappy.NewWriter(f)
-		_, err = io.Copy(snap, bytes.NewReader(buffer))
-	} else {
-		gzw := gzip.NewWriter(f)
-		defer gzw.Close()
-		_, err = io.Copy(gzw, bytes.NewReader(buffer))
+	// File writing is done now move the temp file to the real location
+	err = commitFile(tempPath, spath)
+	if err != nil {
+		os.Remove(tempPath)
+	}
+	return err
+}
+
+// writeTemp compresses data into a new file next to tempPath and syncs it to
+// disk. The name of the created file is returned, it keeps the hash as prefix
+// so concurrent uploads of the same content do not share a spool file.
+func (a assetStore) writeTemp(tempPath string, data []byte, snap bool) (string, error) {
+	f, err := ioutil.TempFile(path.Dir(tempPath), path.Base(tempPath)+".")
+	if err != nil {
+		return "", err
 	}
 
+	// TempFile creates the file readable by its owner only
+	err = f.Chmod(a.fileMode)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	err = encodeBlob(f, data, snap, a.keys)
 	if err == nil {
-		// File writing is done now move the temp file to the real location
-		err = os.Rename(tempPath, spath)
-		if err != nil {
-			os.Remove(tempPath)
-			if os.IsExist(err) {
-				err = nil
-			}
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// encodeBlob writes data compressed with snappy or gzip to w, encrypted with
+// the current key of keys if set.
+func encodeBlob(w io.Writer, data []byte, snap bool, keys *keyRing) error {
+	var enc *encryptWriter
+	if keys != nil {
+		var err error
+		if enc, err = newEncryptWriter(w, keys); err != nil {
+			return err
 		}
+		w = enc
 	}
-	return hash, err
+	var cw io.WriteCloser
+	if snap {
+		cw = snappy.NewWriter(w)
+	} else {
+		cw = gzip.NewWriter(w)
+	}
+	_, err := cw.Write(data)
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+	if enc != nil {
+		if cerr := enc.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 func (a assetStore) GetAsBase64(hash string) (string, error) {
-	reader, err := a.Load(hash)
+	return loadAsBase64(a, hash)
+}
+
+// loadAsBase64 reads the complete blob for hash from store and encodes it.
+func loadAsBase64(store AssetStore, hash string) (string, error) {
+	reader, err := store.Load(hash)
 	if err != nil {
 		return "", err
 	}
+	defer reader.Close()
 	data, err := ioutil.ReadAll(reader)
 	if err == nil {
 		return base64.StdEncoding.EncodeToString(data), nil
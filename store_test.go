@@ -49,10 +49,12 @@ func init() {
 
 	tempBaseDir := os.TempDir()
 	dataDir := path.Join(tempBaseDir, "testing", "store", string(randName))
-	testingAssetStore = &assetStore{
-		dataDir:  path.Join(dataDir, "data"),
-		spoolDir: path.Join(dataDir, "tmp"),
-	}
+	testingAssetStore = CreateAssetStore(StoreOptions{
+		DataDir:  path.Join(dataDir, "data"),
+		SpoolDir: path.Join(dataDir, "tmp"),
+		DirMode:  0755,
+		FileMode: 0644,
+	}).(*assetStore)
 
 }
 
@@ -0,0 +1,408 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spill files are kept in a directory of their own inside the configured
+// one and named with a fixed prefix, so only files snapper wrote are ever
+// removed from it.
+const (
+	temporarySpillDirName = "snapper-temporary"
+	temporarySpillPrefix  = "spill-"
+)
+
+var (
+	ErrTemporaryRejected = errors.New("temporary assets are not accepted")
+	errTemporaryTooLarge = errors.New("temporary asset too large")
+)
+
+// TemporaryMode selects what happens to assets marked Temporary or Local.
+type TemporaryMode int
+
+const (
+	// TemporaryCache holds them in the temporary store
+	TemporaryCache TemporaryMode = iota
+	// TemporaryReject refuses to create them
+	TemporaryReject
+	// TemporaryPersist stores them like any other asset
+	TemporaryPersist
+)
+
+var temporaryModeNames = []string{"cache", "reject", "persist"}
+
+func (m TemporaryMode) String() string {
+	if int(m) < len(temporaryModeNames) {
+		return temporaryModeNames[m]
+	}
+	return ""
+}
+
+func (m *TemporaryMode) Set(s string) error {
+	for i, name := range temporaryModeNames {
+		if s == name {
+			*m = TemporaryMode(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown temporary asset mode %q, expected cache, reject or persist", s)
+}
+
+type TemporaryOptions struct {
+	Mode TemporaryMode
+	// MaxBytes bounds the memory held by temporary assets
+	MaxBytes int64
+	TTL      time.Duration
+	// SpillDir receives the oldest assets once MaxBytes is reached, empty
+	// to drop them instead
+	SpillDir      string
+	SpillMaxBytes int64
+	// Keys encrypts spill files when set
+	Keys *keyRing
+}
+
+type tempAsset struct {
+	meta    AssetBase
+	data    []byte
+	size    int64
+	expires time.Time
+	// spilled is the file holding data once it left memory
+	spilled string
+	// spilling is set while data is written to the spill directory
+	spilling bool
+	element  *list.Element
+}
+
+// temporaryStore holds assets marked Temporary or Local for TTL. They never
+// reach the data store or the database and are lost on restart.
+type temporaryStore struct {
+	TemporaryOptions
+	now func() time.Time
+	// spillDir is the directory inside SpillDir spill files are written to
+	spillDir string
+
+	mu     sync.Mutex
+	assets map[string]*tempAsset
+	// order holds the ids from the oldest to the newest asset
+	order     *list.List
+	memBytes  int64
+	diskBytes int64
+	// spillingBytes are the bytes in memory that are being spilled
+	spillingBytes int64
+}
+
+// createTemporaryStore creates the store, removing the spill files left by
+// an earlier run.
+func createTemporaryStore(opts TemporaryOptions) (*temporaryStore, error) {
+	t := &temporaryStore{
+		TemporaryOptions: opts,
+		now:              time.Now,
+		assets:           map[string]*tempAsset{},
+		order:            list.New(),
+	}
+	if opts.SpillDir != "" {
+		t.spillDir = path.Join(opts.SpillDir, temporarySpillDirName)
+		if err := os.MkdirAll(t.spillDir, 0700); err != nil {
+			return nil, err
+		}
+		entries, err := ioutil.ReadDir(t.spillDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && isSpillFile(entry.Name()) {
+				if err := os.Remove(path.Join(t.spillDir, entry.Name())); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return t, nil
+}
+
+// isSpillFile reports whether name is that of a spill file.
+func isSpillFile(name string) bool {
+	suffix := strings.TrimPrefix(name, temporarySpillPrefix)
+	if suffix == name || suffix == "" {
+		return false
+	}
+	for _, c := range suffix {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Put holds the asset, replacing an earlier one with the same id.
+func (t *temporaryStore) Put(data *FullAssetData) error {
+	buffer, err := base64.StdEncoding.DecodeString(data.Data)
+	if err != nil {
+		return err
+	}
+	size := int64(len(buffer))
+	if size > t.MaxBytes && (t.SpillDir == "" || size > t.SpillMaxBytes) {
+		return errTemporaryTooLarge
+	}
+	data.Hash = makeHash(buffer)
+	now := t.now()
+	asset := &tempAsset{
+		meta:    data.AssetBase,
+		data:    buffer,
+		size:    size,
+		expires: now.Add(t.TTL),
+	}
+	asset.meta.FullId = asset.meta.Id
+	asset.meta.CreateTime = now.Unix()
+	asset.meta.AccessTime = now.Unix()
+
+	t.mu.Lock()
+	if old, ok := t.assets[data.Id]; ok {
+		t.remove(old)
+	}
+	asset.element = t.order.PushBack(data.Id)
+	t.assets[data.Id] = asset
+	t.memBytes += size
+	pending := t.makeRoom()
+	statAdd("temporary.stored", 1)
+	t.updateStats()
+	t.mu.Unlock()
+
+	if len(pending) > 0 {
+		t.spill(pending)
+	}
+	return nil
+}
+
+// Get returns the asset id with its data, ok is false if it is not held or
+// expired.
+func (t *temporaryStore) Get(id string) (meta AssetBase, data []byte, ok bool) {
+	t.mu.Lock()
+	asset, ok := t.assets[id]
+	if ok && !t.now().Before(asset.expires) {
+		t.remove(asset)
+		statAdd("temporary.expired", 1)
+		t.updateStats()
+		ok = false
+	}
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	meta, data, spilled := asset.meta, asset.data, asset.spilled
+	t.mu.Unlock()
+
+	if data == nil {
+		var err error
+		// A concurrent eviction may remove the file
+		if data, err = t.readSpillFile(spilled); err != nil {
+			return AssetBase{}, nil, false
+		}
+	}
+	statAdd("temporary.hits", 1)
+	return meta, data, true
+}
+
+// remove drops asset, t.mu must be held.
+func (t *temporaryStore) remove(asset *tempAsset) {
+	if asset.data != nil {
+		t.memBytes -= asset.size
+	} else {
+		t.diskBytes -= asset.size
+		os.Remove(asset.spilled)
+	}
+	t.order.Remove(asset.element)
+	delete(t.assets, asset.meta.Id)
+}
+
+// makeRoom drops the oldest assets until the memory limit is kept and
+// returns those that are spilled instead, t.mu must be held. They are
+// marked as spilling and stay in memory until spill wrote them.
+func (t *temporaryStore) makeRoom() []*tempAsset {
+	var pending []*tempAsset
+	excess := t.memBytes - t.spillingBytes - t.MaxBytes
+	for e := t.order.Front(); e != nil && excess > 0; {
+		asset := t.assets[e.Value.(string)]
+		e = e.Next()
+		if asset.data == nil || asset.spilling {
+			continue
+		}
+		excess -= asset.size
+		if t.spillDir != "" && asset.size <= t.SpillMaxBytes {
+			asset.spilling = true
+			t.spillingBytes += asset.size
+			pending = append(pending, asset)
+			continue
+		}
+		t.remove(asset)
+		statAdd("temporary.evicted", 1)
+	}
+	return pending
+}
+
+// spill writes the data of the pending assets to the spill directory
+// without holding t.mu and then drops it from memory. Assets that cannot be
+// written are dropped, as are the oldest spilled ones beyond SpillMaxBytes.
+// Puts made meanwhile did not count on the memory of spilled assets that
+// were replaced, so room is made again afterwards.
+func (t *temporaryStore) spill(pending []*tempAsset) {
+	for len(pending) > 0 {
+		pending = t.spillOnce(pending)
+	}
+}
+
+func (t *temporaryStore) spillOnce(pending []*tempAsset) []*tempAsset {
+	names := make([]string, len(pending))
+	errs := make([]error, len(pending))
+	for i, asset := range pending {
+		// data is never modified, only replaced under t.mu
+		names[i], errs[i] = t.writeSpillFile(asset.data)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, asset := range pending {
+		asset.spilling = false
+		t.spillingBytes -= asset.size
+		switch {
+		case t.assets[asset.meta.Id] != asset:
+			// Replaced or expired while it was written
+			if errs[i] == nil {
+				os.Remove(names[i])
+			}
+		case errs[i] != nil:
+			t.remove(asset)
+			statAdd("temporary.evicted", 1)
+		default:
+			asset.spilled, asset.data = names[i], nil
+			t.memBytes -= asset.size
+			t.diskBytes += asset.size
+			statAdd("temporary.spilled", 1)
+		}
+	}
+	for e := t.order.Front(); e != nil && t.diskBytes > t.SpillMaxBytes; {
+		asset := t.assets[e.Value.(string)]
+		e = e.Next()
+		if asset.data == nil {
+			t.remove(asset)
+			statAdd("temporary.evicted", 1)
+		}
+	}
+	t.updateStats()
+	return t.makeRoom()
+}
+
+// writeSpillFile writes data to a new spill file, encrypted if Keys is
+// set, and returns its name.
+func (t *temporaryStore) writeSpillFile(data []byte) (string, error) {
+	f, err := ioutil.TempFile(t.spillDir, temporarySpillPrefix)
+	if err != nil {
+		return "", err
+	}
+	if t.Keys == nil {
+		_, err = f.Write(data)
+	} else {
+		var enc *encryptWriter
+		if enc, err = newEncryptWriter(f, t.Keys); err == nil {
+			if _, err = enc.Write(data); err == nil {
+				err = enc.Close()
+			}
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// readSpillFile reads the data of the spill file name.
+func (t *temporaryStore) readSpillFile(name string) ([]byte, error) {
+	if t.Keys == nil {
+		return ioutil.ReadFile(name)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec, err := newDecryptReader(bufio.NewReader(f), t.Keys)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(dec)
+}
+
+// Sweep drops the expired assets and returns how many it dropped.
+func (t *temporaryStore) Sweep() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	expired := 0
+	// Assets are appended with the same TTL so they expire in order
+	for e := t.order.Front(); e != nil; e = t.order.Front() {
+		asset := t.assets[e.Value.(string)]
+		if now.Before(asset.expires) {
+			break
+		}
+		t.remove(asset)
+		expired++
+	}
+	statAdd("temporary.expired", int64(expired))
+	t.updateStats()
+	return expired
+}
+
+// updateStats publishes the size of the store, t.mu must be held.
+func (t *temporaryStore) updateStats() {
+	statSet("temporary.assets", int64(len(t.assets)))
+	statSet("temporary.memory_bytes", t.memBytes)
+	statSet("temporary.spill_bytes", t.diskBytes)
+}
+
+func (t *temporaryStore) Run(interval time.Duration, stop <-chan struct{}) {
+	every(interval, stop, func() { t.Sweep() })
+}
+
+// rejectTemporary refuses every temporary asset.
+type rejectTemporary struct{}
+
+func (rejectTemporary) Put(data *FullAssetData) error {
+	statAdd("temporary.rejected", 1)
+	return ErrTemporaryRejected
+}
+
+func (rejectTemporary) Get(id string) (AssetBase, []byte, bool) {
+	return AssetBase{}, nil, false
+}
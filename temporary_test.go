@@ -0,0 +1,229 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testTemporaryAsset(id, content string) *FullAssetData {
+	data := &FullAssetData{Data: base64Of(content)}
+	data.Id, data.Type, data.Temporary = id, 0, true
+	return data
+}
+
+func TestTemporaryStore_Expiry(t *testing.T) {
+	temp, _ := createTemporaryStore(TemporaryOptions{MaxBytes: 1024, TTL: time.Hour})
+	now := time.Now()
+	temp.now = func() time.Time { return now }
+
+	temp.Put(testTemporaryAsset("t1", "a baked texture"))
+	now = now.Add(30 * time.Minute)
+	temp.Put(testTemporaryAsset("t2", "another baked texture"))
+	meta, data, ok := temp.Get("t1")
+	if !ok || string(data) != "a baked texture" || !meta.Temporary || meta.Hash != makeHash(data) {
+		t.Fail()
+		t.Logf("Expected the asset to be held. Got: %+v %q", meta, data)
+	}
+
+	now = now.Add(45 * time.Minute)
+	if expired := temp.Sweep(); expired != 1 {
+		t.Fail()
+		t.Logf("Expected one asset to expire. Got: %d", expired)
+	}
+	if _, _, ok := temp.Get("t1"); ok {
+		t.Fail()
+		t.Log("Expected the expired asset to be gone")
+	}
+	now = now.Add(time.Hour)
+	if _, _, ok := temp.Get("t2"); ok || len(temp.assets) != 0 || temp.memBytes != 0 {
+		t.Fail()
+		t.Logf("Expected an expired asset not to be served. Held: %d, %d bytes", len(temp.assets), temp.memBytes)
+	}
+}
+
+func TestTemporaryStore_Evict(t *testing.T) {
+	temp, _ := createTemporaryStore(TemporaryOptions{MaxBytes: 20, TTL: time.Hour})
+	temp.Put(testTemporaryAsset("t1", "0123456789"))
+	temp.Put(testTemporaryAsset("t2", "0123456789"))
+	temp.Put(testTemporaryAsset("t3", "0123456789"))
+	if _, _, ok := temp.Get("t1"); ok || temp.memBytes != 20 {
+		t.Fail()
+		t.Logf("Expected the oldest asset to be dropped. Held %d bytes", temp.memBytes)
+	}
+	if err := temp.Put(testTemporaryAsset("t4", "012345678901234567890")); err != errTemporaryTooLarge {
+		t.Fail()
+		t.Logf("Expected an asset larger than memory to be refused. Got: %v", err)
+	}
+}
+
+func TestTemporaryStore_Spill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapper-temporary")
+	if err != nil {
+		t.Skipf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	spillDir := path.Join(dir, temporarySpillDirName)
+	os.MkdirAll(spillDir, 0700)
+	ioutil.WriteFile(path.Join(dir, "unrelated"), []byte("not ours"), 0644)
+	ioutil.WriteFile(path.Join(spillDir, "unrelated"), []byte("not ours"), 0644)
+	ioutil.WriteFile(path.Join(spillDir, temporarySpillPrefix+"123"), []byte("left over"), 0600)
+
+	temp, err := createTemporaryStore(TemporaryOptions{
+		MaxBytes:      20,
+		TTL:           time.Hour,
+		SpillDir:      dir,
+		SpillMaxBytes: 20,
+	})
+	if err != nil {
+		t.Fatalf("Unable to create temporary store: %v", err)
+	}
+	if _, err := os.Stat(path.Join(spillDir, temporarySpillPrefix+"123")); !os.IsNotExist(err) {
+		t.Fail()
+		t.Log("Expected spill files of an earlier run to be removed")
+	}
+	for _, name := range []string{path.Join(dir, "unrelated"), path.Join(spillDir, "unrelated")} {
+		if _, err := os.Stat(name); err != nil {
+			t.Fail()
+			t.Logf("Expected %v to be left alone. Got: %v", name, err)
+		}
+	}
+	for _, id := range []string{"t1", "t2", "t3", "t4", "t5"} {
+		temp.Put(testTemporaryAsset(id, "content "+id))
+	}
+	if _, _, ok := temp.Get("t1"); ok {
+		t.Fail()
+		t.Log("Expected the oldest spilled asset to be dropped")
+	}
+	if _, data, ok := temp.Get("t2"); !ok || string(data) != "content t2" {
+		t.Fail()
+		t.Logf("Expected the asset to be read from the spill directory. Got: %q", data)
+	}
+	if temp.memBytes != 20 || temp.diskBytes != 20 {
+		t.Fail()
+		t.Logf("Unexpected sizes: %d in memory, %d spilled", temp.memBytes, temp.diskBytes)
+	}
+	temp.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	temp.Sweep()
+	if files, _ := ioutil.ReadDir(spillDir); len(files) != 1 {
+		t.Fail()
+		t.Logf("Expected the spill files of expired assets to be removed. Got: %d", len(files))
+	}
+}
+
+func TestTemporaryMode(t *testing.T) {
+	var mode TemporaryMode
+	if err := mode.Set("reject"); err != nil || mode != TemporaryReject || mode.String() != "reject" {
+		t.Fail()
+		t.Logf("Unexpected mode: %v (%v)", mode, err)
+	}
+	if err := mode.Set("drop"); err == nil {
+		t.Fail()
+		t.Log("Expected an unknown mode to be rejected")
+	}
+}
+
+func TestTemporaryStore_ConcurrentSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapper-temporary")
+	if err != nil {
+		t.Skipf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	temp, err := createTemporaryStore(TemporaryOptions{
+		MaxBytes:      100,
+		TTL:           time.Hour,
+		SpillDir:      dir,
+		SpillMaxBytes: 1 << 20,
+	})
+	if err != nil {
+		t.Fatalf("Unable to create temporary store: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				// Ids are shared between workers so assets are replaced
+				// while they are spilled
+				id := fmt.Sprintf("t%d", i%20)
+				temp.Put(testTemporaryAsset(id, fmt.Sprintf("content %d of %d", i, w)))
+				temp.Get(id)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	files, _ := ioutil.ReadDir(path.Join(dir, temporarySpillDirName))
+	spilled := 0
+	for _, asset := range temp.assets {
+		if asset.data == nil {
+			spilled++
+		}
+	}
+	if temp.memBytes > 100 || temp.spillingBytes != 0 || len(files) != spilled || len(temp.assets) != 20 {
+		t.Fail()
+		t.Logf("Unexpected state: %d bytes in memory, %d spilling, %d files for %d spilled of %d assets",
+			temp.memBytes, temp.spillingBytes, len(files), spilled, len(temp.assets))
+	}
+}
+
+func TestTemporaryStore_EncryptedSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapper-temporary")
+	if err != nil {
+		t.Skipf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	temp, err := createTemporaryStore(TemporaryOptions{
+		MaxBytes:      20,
+		TTL:           time.Hour,
+		SpillDir:      dir,
+		SpillMaxBytes: 1024,
+		Keys:          testKeyRing(t, "k1 "+testKey1+"\n", ""),
+	})
+	if err != nil {
+		t.Fatalf("Unable to create temporary store: %v", err)
+	}
+	temp.Put(testTemporaryAsset("t1", "secret t1"))
+	temp.Put(testTemporaryAsset("t2", "a newer asset"))
+	temp.Put(testTemporaryAsset("t3", "the newest one"))
+
+	files, _ := ioutil.ReadDir(temp.spillDir)
+	if len(files) != 2 {
+		t.Fatalf("Expected two spill files. Got: %v", files)
+	}
+	for _, fi := range files {
+		if data, _ := ioutil.ReadFile(path.Join(temp.spillDir, fi.Name())); strings.Contains(string(data), "t1") || strings.Contains(string(data), "asset") {
+			t.Fail()
+			t.Logf("Expected spill file %v to be encrypted", fi.Name())
+		}
+	}
+	if _, data, ok := temp.Get("t1"); !ok || string(data) != "secret t1" {
+		t.Fail()
+		t.Logf("Expected the encrypted spill file to be read. Got: %q", data)
+	}
+}
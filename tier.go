@@ -0,0 +1,250 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// tierBatchSize is the number of hashes the mover asks the database for at
+// once.
+const tierBatchSize = 1000
+
+// tieredStore keeps recently used blobs in a hot store and the rest in a
+// cold directory on cheaper storage. New blobs always go to the hot store,
+// the mover demotes blobs nobody accessed for a while and reads promote
+// them back.
+type tieredStore struct {
+	hot     placer
+	cold    *assetStore
+	promote bool
+
+	mu sync.Mutex
+	// promoted remembers when blobs were promoted, so the mover does not
+	// demote them again before their access time was updated.
+	promoted map[string]time.Time
+}
+
+func CreateTieredStore(hot placer, cold *assetStore, promote bool) *tieredStore {
+	return &tieredStore{
+		hot:      hot,
+		cold:     cold,
+		promote:  promote,
+		promoted: map[string]time.Time{},
+	}
+}
+
+func (t *tieredStore) placeBlob(hash string) *assetStore {
+	return t.hot.placeBlob(hash)
+}
+
+func (t *tieredStore) dataDisks() []*assetStore {
+	return t.hot.dataDisks()
+}
+
+func (t *tieredStore) Exists(hash string) bool {
+	return t.hot.Exists(hash) || t.cold.Exists(hash)
+}
+
+func (t *tieredStore) Load(hash string) (io.ReadCloser, error) {
+	reader, err := t.hot.Load(hash)
+	if !os.IsNotExist(err) {
+		return reader, err
+	}
+	reader, err = t.cold.Load(hash)
+	if err == nil && t.promote {
+		t.startPromote(hash)
+	}
+	return reader, err
+}
+
+func (t *tieredStore) Store(data string) (string, error) {
+	buffer, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+	return t.storeBytes(buffer)
+}
+
+func (t *tieredStore) storeBytes(buffer []byte) (string, error) {
+	hash := makeHash(buffer)
+	if p, found := t.cold.findOwn(hash); found {
+		now := time.Now()
+		os.Chtimes(p, now, now)
+		return hash, nil
+	}
+	return t.hot.storeBytes(buffer)
+}
+
+func (t *tieredStore) GetAsBase64(hash string) (string, error) {
+	return loadAsBase64(t, hash)
+}
+
+// startPromote moves hash back to the hot store in the background, the read
+// that triggered it is served from the cold tier.
+func (t *tieredStore) startPromote(hash string) {
+	t.mu.Lock()
+	if _, busy := t.promoted[hash]; busy {
+		t.mu.Unlock()
+		return
+	}
+	t.promoted[hash] = time.Now()
+	t.mu.Unlock()
+
+	go func() {
+		if err := t.Promote(hash); err != nil {
+			log.Printf("Tiering: failed to promote %v: %v\n", hash, err)
+		}
+	}()
+}
+
+// Promote moves the blob for hash from the cold tier to the hot store.
+func (t *tieredStore) Promote(hash string) error {
+	src, found := t.cold.findOwn(hash)
+	if !found {
+		return nil
+	}
+	if t.hot.Exists(hash) {
+		return os.Remove(src)
+	}
+	if err := moveBlob(src, t.hot.placeBlob(hash), hash); err != nil {
+		return err
+	}
+	statAdd("tier.promoted", 1)
+	return nil
+}
+
+// Demote moves the blob for hash from the hot store to the cold tier. It
+// reports whether anything was moved.
+func (t *tieredStore) Demote(hash string) (bool, error) {
+	for _, disk := range t.hot.dataDisks() {
+		src, found := disk.findOwn(hash)
+		if !found {
+			continue
+		}
+		if _, found := t.cold.findOwn(hash); found {
+			return true, os.Remove(src)
+		}
+		if err := moveBlob(src, t.cold, hash); err != nil {
+			return false, err
+		}
+		statAdd("tier.demoted", 1)
+		return true, nil
+	}
+	return false, nil
+}
+
+// moveBlob commits the blob file src to its place for hash on disk, keeping
+// its compression format.
+func moveBlob(src string, disk *assetStore, hash string) error {
+	dst := disk.makePath(hash)
+	if format := blobFormat(src); format != formatRaw {
+		dst += "." + format
+	}
+	if err := os.MkdirAll(path.Dir(dst), disk.dirMode); err != nil {
+		return err
+	}
+	return commitFile(src, dst)
+}
+
+type TierReport struct {
+	Demoted int
+	Failed  int
+}
+
+// tierMover demotes blobs of which no asset was accessed for longer than
+// after to the cold tier. slack is added to after, as the recorded access
+// time of an asset may be that much older than its last read.
+type tierMover struct {
+	store *tieredStore
+	model AssetModel
+	after time.Duration
+	slack time.Duration
+	now   func() time.Time
+}
+
+func createTierMover(store *tieredStore, model AssetModel, after, slack time.Duration) *tierMover {
+	return &tierMover{
+		store: store,
+		model: model,
+		after: after,
+		slack: slack,
+		now:   time.Now,
+	}
+}
+
+// Move demotes all blobs that went cold.
+func (m *tierMover) Move() (report TierReport, err error) {
+	cutoff := m.now().Add(-m.after - m.slack)
+
+	m.store.mu.Lock()
+	for hash, promoted := range m.store.promoted {
+		if promoted.Before(cutoff) {
+			delete(m.store.promoted, hash)
+		}
+	}
+	m.store.mu.Unlock()
+
+	after := ""
+	for {
+		var hashes []string
+		hashes, err = m.model.ColdHashes(cutoff.Unix(), after, tierBatchSize)
+		if err != nil {
+			return
+		}
+		for _, hash := range hashes {
+			m.store.mu.Lock()
+			_, recent := m.store.promoted[hash]
+			m.store.mu.Unlock()
+			if recent {
+				continue
+			}
+			moved, err := m.store.Demote(hash)
+			if err != nil {
+				log.Printf("Tiering: failed to demote %v: %v\n", hash, err)
+				report.Failed++
+			} else if moved {
+				report.Demoted++
+			}
+		}
+		if len(hashes) < tierBatchSize {
+			return
+		}
+		after = hashes[len(hashes)-1]
+	}
+}
+
+// Run demotes cold blobs every interval until stop is closed.
+func (m *tierMover) Run(interval time.Duration, stop <-chan struct{}) {
+	every(interval, stop, m.moveAndLog)
+}
+
+func (m *tierMover) moveAndLog() {
+	report, err := m.Move()
+	if err != nil {
+		log.Printf("Tiering failed: %v\n", err)
+	}
+	log.Printf("Tiering: demoted %d blobs, %d failed\n", report.Demoted, report.Failed)
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+type mockColdModel struct {
+	mockModel
+	hashes []string
+	before int64
+}
+
+func (m *mockColdModel) ColdHashes(before int64, after string, limit int) ([]string, error) {
+	m.before = before
+	result := []string{}
+	for _, hash := range m.hashes {
+		if hash > after && len(result) < limit {
+			result = append(result, hash)
+		}
+	}
+	return result, nil
+}
+
+func testTieredStore(t *testing.T, promote bool) (*tieredStore, func()) {
+	dir, err := ioutil.TempDir("", "tier")
+	if err != nil {
+		t.Skipf("Unable to create temp dir: %v", err)
+	}
+	opts := StoreOptions{
+		DataDir:  path.Join(dir, "hot"),
+		SpoolDir: path.Join(dir, "tmp"),
+		DirMode:  0755,
+		FileMode: 0644,
+	}
+	hot := CreateAssetStore(opts).(*assetStore)
+	opts.DataDir = path.Join(dir, "cold")
+	cold := CreateAssetStore(opts).(*assetStore)
+	return CreateTieredStore(hot, cold, promote), func() { os.RemoveAll(dir) }
+}
+
+func TestTier_DemoteAndPromote(t *testing.T) {
+	store, cleanup := testTieredStore(t, false)
+	defer cleanup()
+
+	store.Store(testFileDataContentB64)
+	if moved, err := store.Demote(testFileDataContentHash); !moved || err != nil {
+		t.Fatalf("Expected blob to be demoted. Got: %v (%v)", moved, err)
+	}
+	if store.hot.Exists(testFileDataContentHash) || !store.cold.Exists(testFileDataContentHash) {
+		t.Fail()
+		t.Log("Expected blob to be in the cold tier only")
+	}
+	if !store.Exists(testFileDataContentHash) {
+		t.Fail()
+		t.Log("Expected demoted blob to exist")
+	}
+	data, err := store.GetAsBase64(testFileDataContentHash)
+	if err != nil || data != testFileDataContentB64 {
+		t.Fail()
+		t.Logf("Expected demoted blob to be readable. Got: %v (%v)", data, err)
+	}
+	if store.hot.Exists(testFileDataContentHash) {
+		t.Fail()
+		t.Log("Expected no promotion when it is disabled")
+	}
+
+	// Storing the same content again keeps it where it is
+	store.Store(testFileDataContentB64)
+	if store.hot.Exists(testFileDataContentHash) {
+		t.Fail()
+		t.Log("Expected content in the cold tier not to be written to the hot tier")
+	}
+
+	if err := store.Promote(testFileDataContentHash); err != nil {
+		t.Fatalf("Unexpected promote error: %v", err)
+	}
+	if !store.hot.Exists(testFileDataContentHash) || store.cold.Exists(testFileDataContentHash) {
+		t.Fail()
+		t.Log("Expected blob to be in the hot tier only after promotion")
+	}
+	if moved, err := store.Demote(emptyTestFileDataContentHash); moved || err != nil {
+		t.Fail()
+		t.Logf("Expected missing blob not to be demoted. Got: %v (%v)", moved, err)
+	}
+}
+
+func TestTier_PromoteOnRead(t *testing.T) {
+	store, cleanup := testTieredStore(t, true)
+	defer cleanup()
+
+	store.Store(testFileDataContentB64)
+	store.Demote(testFileDataContentHash)
+	if _, err := store.GetAsBase64(testFileDataContentHash); err != nil {
+		t.Fatalf("Unexpected read error: %v", err)
+	}
+	for i := 0; i < 100 && !store.hot.Exists(testFileDataContentHash); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !store.hot.Exists(testFileDataContentHash) {
+		t.Fail()
+		t.Log("Expected blob to be promoted after a read")
+	}
+}
+
+func TestTier_Mover(t *testing.T) {
+	store, cleanup := testTieredStore(t, true)
+	defer cleanup()
+
+	hashes := []string{}
+	for _, data := range []string{testFileDataContentB64, emptyTestFileDataContentB64, base64Of("third")} {
+		hash, _ := store.Store(data)
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	// A recently promoted blob stays hot even if its assets look cold
+	store.promoted[hashes[2]] = time.Now()
+
+	model := &mockColdModel{hashes: hashes}
+	mover := createTierMover(store, model, 24*time.Hour, time.Hour)
+	now := time.Now()
+	mover.now = func() time.Time { return now }
+	report, err := mover.Move()
+	if err != nil || report.Demoted != 2 || report.Failed != 0 {
+		t.Fail()
+		t.Logf("Unexpected report: %+v (%v)", report, err)
+	}
+	if model.before != now.Add(-25*time.Hour).Unix() {
+		t.Fail()
+		t.Logf("Unexpected access time cutoff: %v", model.before)
+	}
+	for i, hash := range hashes {
+		if store.hot.Exists(hash) != (i == 2) {
+			t.Fail()
+			t.Logf("Unexpected tier of %v", hash)
+		}
+	}
+}
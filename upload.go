@@ -0,0 +1,461 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// uploadDirName is the directory of the spool store upload sessions are
+// kept in
+const uploadDirName = "uploads"
+
+var (
+	errUploadNotFound     = errors.New("no such upload session")
+	errUploadTooLarge     = errors.New("upload too large")
+	errUploadOffset       = errors.New("offset is past the bytes received")
+	errUploadIncomplete   = errors.New("upload incomplete")
+	errUploadHashMismatch = errors.New("uploaded data does not match the expected hash")
+	errUploadTooMany      = errors.New("too many upload sessions")
+)
+
+type UploadOptions struct {
+	// TTL is the time after the last write an upload session is kept
+	TTL     time.Duration
+	MaxSize int64
+	// MaxSessions bounds the sessions open at the same time
+	MaxSessions int
+}
+
+// UploadSession is the state of a resumable upload. Data is written in
+// parts at offsets up to Received, the bytes received so far.
+type UploadSession struct {
+	XMLName  xml.Name  `xml:"UploadSession" json:"-"`
+	Id       string    `xml:"ID" json:"id"`
+	Asset    AssetBase `xml:"AssetBase" json:"asset"`
+	Size     int64     `xml:"Size" json:"size"`
+	Received int64     `xml:"Received" json:"received"`
+	Expires  int64     `xml:"Expires" json:"expires"`
+}
+
+type uploadSession struct {
+	// mu serializes writes to the data file
+	mu sync.Mutex
+	// removed is set once the session files are deleted
+	removed bool
+	UploadSession
+}
+
+// uploadManager keeps upload sessions as a data file and a JSON state file
+// each, so they survive restarts.
+type uploadManager struct {
+	UploadOptions
+	dir   string
+	guard StorageGuard
+	now   func() time.Time
+
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+	// finalizing is held while an upload is finalized and stored, which
+	// takes a few times its size in memory
+	finalizing sync.Mutex
+}
+
+// createUploadManager loads the sessions kept in dir and removes expired
+// ones and files without a session. No data is accepted while guard, if
+// set, reports the storage read only.
+func createUploadManager(dir string, opts UploadOptions, guard StorageGuard) (*uploadManager, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	u := &uploadManager{
+		UploadOptions: opts,
+		dir:           dir,
+		guard:         guard,
+		now:           time.Now,
+		sessions:      map[string]*uploadSession{},
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		session := &uploadSession{}
+		if err := json.Unmarshal(data, &session.UploadSession); err != nil || session.Id+".json" != fi.Name() {
+			log.Printf("Uploads: ignoring invalid session %v\n", fi.Name())
+			continue
+		}
+		u.sessions[session.Id] = session
+	}
+	for _, fi := range files {
+		id := strings.TrimSuffix(strings.TrimSuffix(fi.Name(), ".json"), ".data")
+		if _, ok := u.sessions[id]; !ok {
+			os.Remove(path.Join(dir, fi.Name()))
+		}
+	}
+	u.Sweep()
+	return u, nil
+}
+
+func (u *uploadManager) dataPath(id string) string {
+	return path.Join(u.dir, id+".data")
+}
+
+func (u *uploadManager) statePath(id string) string {
+	return path.Join(u.dir, id+".json")
+}
+
+// save writes the state of session, its lock must be held.
+func (u *uploadManager) save(session *uploadSession) error {
+	data, err := json.Marshal(session.UploadSession)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(u.statePath(session.Id), data, 0600)
+}
+
+// readOnly reports whether the storage is too full to accept data.
+func (u *uploadManager) readOnly() bool {
+	if u.guard != nil && u.guard.ReadOnly() {
+		statAdd("uploads.rejected", 1)
+		return true
+	}
+	return false
+}
+
+// full reports whether no more sessions may be opened.
+func (u *uploadManager) full() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.sessions) >= u.MaxSessions
+}
+
+// Create starts a session for an asset of size bytes.
+func (u *uploadManager) Create(asset AssetBase, size int64) (UploadSession, error) {
+	if size < 1 || size > u.MaxSize {
+		return UploadSession{}, errUploadTooLarge
+	}
+	if u.readOnly() {
+		return UploadSession{}, ErrInsufficientStorage
+	}
+	if u.full() {
+		statAdd("uploads.rejected", 1)
+		return UploadSession{}, errUploadTooMany
+	}
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return UploadSession{}, err
+	}
+	session := &uploadSession{UploadSession: UploadSession{
+		Id:      hex.EncodeToString(raw[:]),
+		Asset:   asset,
+		Size:    size,
+		Expires: u.now().Add(u.TTL).Unix(),
+	}}
+	if err := ioutil.WriteFile(u.dataPath(session.Id), nil, 0600); err != nil {
+		return UploadSession{}, err
+	}
+	if err := u.save(session); err != nil {
+		os.Remove(u.dataPath(session.Id))
+		return UploadSession{}, err
+	}
+	u.mu.Lock()
+	// Sessions created concurrently may have filled the slots meanwhile
+	if len(u.sessions) >= u.MaxSessions {
+		u.mu.Unlock()
+		os.Remove(u.dataPath(session.Id))
+		os.Remove(u.statePath(session.Id))
+		statAdd("uploads.rejected", 1)
+		return UploadSession{}, errUploadTooMany
+	}
+	u.sessions[session.Id] = session
+	u.mu.Unlock()
+	statAdd("uploads.created", 1)
+	return session.UploadSession, nil
+}
+
+// session returns the live session id.
+func (u *uploadManager) session(id string) (*uploadSession, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	session, ok := u.sessions[id]
+	if !ok || u.now().Unix() >= session.Expires {
+		return nil, errUploadNotFound
+	}
+	return session, nil
+}
+
+// Get returns the progress of the session id.
+func (u *uploadManager) Get(id string) (UploadSession, error) {
+	session, err := u.session(id)
+	if err != nil {
+		return UploadSession{}, err
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.UploadSession, nil
+}
+
+// Write stores the data of body at offset, which may not be past the bytes
+// received so far. The bytes read before body fails are kept, so the client
+// can continue after them.
+func (u *uploadManager) Write(id string, offset int64, body io.Reader) (UploadSession, error) {
+	session, err := u.session(id)
+	if err != nil {
+		return UploadSession{}, err
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.removed {
+		return UploadSession{}, errUploadNotFound
+	}
+	if offset < 0 || offset > session.Received {
+		return session.UploadSession, errUploadOffset
+	}
+	if u.readOnly() {
+		return session.UploadSession, ErrInsufficientStorage
+	}
+
+	f, err := os.OpenFile(u.dataPath(id), os.O_WRONLY, 0600)
+	if err != nil {
+		return session.UploadSession, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return session.UploadSession, err
+	}
+	// One byte more than fits tells a too large upload apart
+	n, copyErr := io.Copy(f, io.LimitReader(body, session.Size-offset+1))
+	if offset+n > session.Size {
+		f.Truncate(session.Received)
+		return session.UploadSession, errUploadTooLarge
+	}
+	if err := f.Sync(); err != nil {
+		return session.UploadSession, err
+	}
+	if offset+n > session.Received {
+		session.Received = offset + n
+	}
+	session.Expires = u.now().Add(u.TTL).Unix()
+	statAdd("uploads.bytes", n)
+	if err := u.save(session); err != nil {
+		return session.UploadSession, err
+	}
+	return session.UploadSession, copyErr
+}
+
+// Finalize returns the asset of the complete session id with its data,
+// once the data matches the SHA-256 hash. The session is kept until it is
+// removed, so a failure to store the asset can be retried.
+func (u *uploadManager) Finalize(id, hash string) (FullAssetData, error) {
+	session, err := u.session(id)
+	if err != nil {
+		return FullAssetData{}, err
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.removed {
+		return FullAssetData{}, errUploadNotFound
+	}
+	if session.Received != session.Size {
+		return FullAssetData{}, errUploadIncomplete
+	}
+	f, err := os.Open(u.dataPath(id))
+	if err != nil {
+		return FullAssetData{}, err
+	}
+	defer f.Close()
+
+	// The data is hashed while it is encoded, the store decodes the
+	// encoded copy again
+	var encoded strings.Builder
+	encoded.Grow(base64.StdEncoding.EncodedLen(int(session.Size)))
+	encoder := base64.NewEncoder(base64.StdEncoding, &encoded)
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(hasher, encoder), io.LimitReader(f, session.Size))
+	if err != nil {
+		return FullAssetData{}, err
+	}
+	if n < session.Size {
+		return FullAssetData{}, errUploadIncomplete
+	}
+	encoder.Close()
+	sum := strings.ToUpper(hex.EncodeToString(hasher.Sum(nil)))
+	if expected, ok := normalizeHash(hash); !ok || sum != expected {
+		statAdd("uploads.hash_mismatch", 1)
+		return FullAssetData{}, errUploadHashMismatch
+	}
+	return FullAssetData{
+		AssetBase: session.Asset,
+		Data:      encoded.String(),
+	}, nil
+}
+
+// Remove ends the session id and deletes its files. A write or finalize
+// that is in progress is waited for, later ones fail.
+func (u *uploadManager) Remove(id string) {
+	u.mu.Lock()
+	session, ok := u.sessions[id]
+	delete(u.sessions, id)
+	u.mu.Unlock()
+	if ok {
+		session.mu.Lock()
+		defer session.mu.Unlock()
+		session.removed = true
+	}
+	os.Remove(u.dataPath(id))
+	os.Remove(u.statePath(id))
+}
+
+// Sweep removes the expired sessions and returns how many it removed.
+func (u *uploadManager) Sweep() int {
+	now := u.now().Unix()
+	expired := []string{}
+	u.mu.Lock()
+	for id, session := range u.sessions {
+		if now >= session.Expires {
+			expired = append(expired, id)
+		}
+	}
+	u.mu.Unlock()
+	for _, id := range expired {
+		u.Remove(id)
+	}
+	statAdd("uploads.expired", int64(len(expired)))
+	return len(expired)
+}
+
+func (u *uploadManager) Run(interval time.Duration, stop <-chan struct{}) {
+	every(interval, stop, func() { u.Sweep() })
+}
+
+func (h HTTPService) uploadError(err error, resp http.ResponseWriter) {
+	switch err {
+	case errUploadNotFound:
+		http.Error(resp, err.Error(), http.StatusNotFound)
+	case errUploadTooLarge:
+		http.Error(resp, err.Error(), http.StatusRequestEntityTooLarge)
+	case errUploadIncomplete:
+		http.Error(resp, err.Error(), http.StatusConflict)
+	case errUploadHashMismatch:
+		http.Error(resp, err.Error(), http.StatusUnprocessableEntity)
+	case errUploadTooMany:
+		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+	case ErrInsufficientStorage:
+		http.Error(resp, err.Error(), http.StatusInsufficientStorage)
+	default:
+		http.Error(resp, "upload failed", http.StatusInternalServerError)
+		log.Printf("Upload failed: %v\n", err)
+	}
+}
+
+func (h HTTPService) createUpload(resp http.ResponseWriter, req *http.Request) {
+	var request UploadSession
+	defer req.Body.Close()
+	if err := xml.NewDecoder(req.Body).Decode(&request); err != nil || request.Asset.Id == "" {
+		http.Error(resp, "invalid upload request", http.StatusBadRequest)
+		return
+	}
+	session, err := h.uploads.Create(request.Asset, request.Size)
+	if err != nil {
+		h.uploadError(err, resp)
+		return
+	}
+	h.xmlResponse(session, resp, req)
+}
+
+func (h HTTPService) getUpload(resp http.ResponseWriter, req *http.Request) {
+	session, err := h.uploads.Get(mux.Vars(req)["upload_id"])
+	if err != nil {
+		h.uploadError(err, resp)
+		return
+	}
+	h.xmlResponse(session, resp, req)
+}
+
+func (h HTTPService) putUpload(resp http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	offset, err := strconv.ParseInt(req.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(resp, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	session, err := h.uploads.Write(mux.Vars(req)["upload_id"], offset, req.Body)
+	if err == errUploadOffset {
+		// The client learns where to continue from the session
+		resp.Header().Set("Content-Type", "application/xml")
+		resp.WriteHeader(http.StatusConflict)
+		h.xmlResponse(session, resp, req)
+		return
+	} else if err != nil {
+		h.uploadError(err, resp)
+		return
+	}
+	h.xmlResponse(session, resp, req)
+}
+
+func (h HTTPService) finalizeUpload(resp http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["upload_id"]
+	// Finalizing one upload at a time bounds the memory it takes
+	h.uploads.finalizing.Lock()
+	defer h.uploads.finalizing.Unlock()
+	fullData, err := h.uploads.Finalize(id, req.URL.Query().Get("sha256"))
+	if err != nil {
+		h.uploadError(err, resp)
+		return
+	}
+	if h.createAsset(&fullData, resp, req) == nil {
+		h.uploads.Remove(id)
+		statAdd("uploads.finalized", 1)
+	}
+}
+
+func (h HTTPService) deleteUpload(resp http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["upload_id"]
+	if _, err := h.uploads.Get(id); err != nil {
+		h.uploadError(err, resp)
+		return
+	}
+	h.uploads.Remove(id)
+}
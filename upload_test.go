@@ -0,0 +1,277 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingReader returns data and then fails like a dropped connection.
+type failingReader struct {
+	data io.Reader
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func testUploadManager(t *testing.T) (*uploadManager, *assetStore, func()) {
+	store, cleanup := testSpoolStore(t)
+	u, err := createUploadManager(path.Join(store.spoolDir, uploadDirName), UploadOptions{TTL: time.Hour, MaxSize: 1 << 20, MaxSessions: 3}, nil)
+	if err != nil {
+		cleanup()
+		t.Fatalf("Unable to create upload manager: %v", err)
+	}
+	return u, store, cleanup
+}
+
+func TestUpload_Resume(t *testing.T) {
+	u, store, cleanup := testUploadManager(t)
+	defer cleanup()
+	asset := AssetBase{Id: "m1", Name: "Mesh", Type: 49}
+	session, err := u.Create(asset, int64(len(testFileDataContent)))
+	if err != nil {
+		t.Fatalf("Unable to create session: %v", err)
+	}
+
+	session, err = u.Write(session.Id, 0, &failingReader{strings.NewReader(testFileDataContent[:10])})
+	if err == nil || session.Received != 10 {
+		t.Fail()
+		t.Logf("Expected the bytes before the failure to be kept. Got: %d (%v)", session.Received, err)
+	}
+	if _, err := u.Write(session.Id, 12, strings.NewReader("x")); err != errUploadOffset {
+		t.Fail()
+		t.Logf("Expected a gap to be refused. Got: %v", err)
+	}
+	if _, err := u.Finalize(session.Id, testFileDataContentHash); err != errUploadIncomplete {
+		t.Fail()
+		t.Logf("Expected an incomplete upload not to finalize. Got: %v", err)
+	}
+
+	// A restart keeps the session
+	u, err = createUploadManager(u.dir, u.UploadOptions, nil)
+	if err != nil {
+		t.Fatalf("Unable to reopen upload manager: %v", err)
+	}
+	if progress, err := u.Get(session.Id); err != nil || progress.Received != 10 || progress.Asset.Name != "Mesh" {
+		t.Fail()
+		t.Logf("Expected the session to survive a restart. Got: %+v (%v)", progress, err)
+	}
+	if _, err := u.Write(session.Id, 8, strings.NewReader(testFileDataContent[8:]+"extra")); err != errUploadTooLarge {
+		t.Fail()
+		t.Logf("Expected data past the size to be refused. Got: %v", err)
+	}
+	if session, err = u.Write(session.Id, 8, strings.NewReader(testFileDataContent[8:])); err != nil || session.Received != session.Size {
+		t.Fail()
+		t.Logf("Expected the upload to complete. Got: %+v (%v)", session, err)
+	}
+
+	if _, err := u.Finalize(session.Id, makeHash([]byte("other"))); err != errUploadHashMismatch {
+		t.Fail()
+		t.Logf("Expected a hash mismatch. Got: %v", err)
+	}
+	full, err := u.Finalize(session.Id, strings.ToLower(testFileDataContentHash))
+	if err != nil || full.Data != testFileDataContentB64 || full.Id != "m1" {
+		t.Fail()
+		t.Logf("Unexpected asset: %+v (%v)", full.AssetBase, err)
+	}
+	u.Remove(session.Id)
+	if files, _ := ioutil.ReadDir(u.dir); len(files) != 0 {
+		t.Fail()
+		t.Logf("Expected the session files to be removed. Got: %d", len(files))
+	}
+
+	// The spool sweeper leaves sessions alone
+	session, _ = u.Create(asset, 10)
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(u.dataPath(session.Id), old, old)
+	createSpoolSweeper(store, time.Hour, false).Sweep()
+	if _, err := os.Stat(u.dataPath(session.Id)); err != nil {
+		t.Fail()
+		t.Logf("Expected the spool sweeper to keep upload sessions: %v", err)
+	}
+}
+
+func TestUpload_Expiry(t *testing.T) {
+	u, _, cleanup := testUploadManager(t)
+	defer cleanup()
+	now := time.Now()
+	u.now = func() time.Time { return now }
+	session, _ := u.Create(AssetBase{Id: "m1"}, 10)
+	if _, err := u.Create(AssetBase{Id: "m2"}, 2<<20); err != errUploadTooLarge {
+		t.Fail()
+		t.Logf("Expected a session over the maximum size to be refused. Got: %v", err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, err := u.Get(session.Id); err != errUploadNotFound {
+		t.Fail()
+		t.Logf("Expected an expired session to be gone. Got: %v", err)
+	}
+	if expired := u.Sweep(); expired != 1 {
+		t.Fail()
+		t.Logf("Expected one session to expire. Got: %d", expired)
+	}
+	if _, err := os.Stat(u.dataPath(session.Id)); !os.IsNotExist(err) {
+		t.Fail()
+		t.Log("Expected the files of the expired session to be removed")
+	}
+}
+
+func TestUpload_MaxSessions(t *testing.T) {
+	u, _, cleanup := testUploadManager(t)
+	defer cleanup()
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		session, err := u.Create(AssetBase{Id: "m1"}, 10)
+		if err != nil {
+			t.Fatalf("Unable to create session: %v", err)
+		}
+		ids = append(ids, session.Id)
+	}
+	if _, err := u.Create(AssetBase{Id: "m1"}, 10); err != errUploadTooMany {
+		t.Fail()
+		t.Logf("Expected sessions over the maximum to be refused. Got: %v", err)
+	}
+	u.Remove(ids[0])
+	if _, err := u.Create(AssetBase{Id: "m1"}, 10); err != nil {
+		t.Fail()
+		t.Logf("Expected a session to be created once one was removed. Got: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(u.dir); len(files) != 6 {
+		t.Fail()
+		t.Logf("Expected the files of a refused session to be removed. Got: %d", len(files))
+	}
+}
+
+func TestUpload_StorageGuard(t *testing.T) {
+	u, _, cleanup := testUploadManager(t)
+	defer cleanup()
+	guard := &mockGuard{}
+	u.guard = guard
+	session, err := u.Create(AssetBase{Id: "m1"}, 10)
+	if err != nil {
+		t.Fatalf("Unable to create session: %v", err)
+	}
+
+	guard.readOnly = true
+	if _, err := u.Create(AssetBase{Id: "m2"}, 10); err != ErrInsufficientStorage {
+		t.Fail()
+		t.Logf("Expected no session to be created while storage is full. Got: %v", err)
+	}
+	if progress, err := u.Write(session.Id, 0, strings.NewReader("0123456789")); err != ErrInsufficientStorage || progress.Received != 0 {
+		t.Fail()
+		t.Logf("Expected no data to be written while storage is full. Got: %d (%v)", progress.Received, err)
+	}
+	recorder := httptest.NewRecorder()
+	CreateHTTPService(nil, u).uploadError(ErrInsufficientStorage, recorder)
+	if recorder.Code != http.StatusInsufficientStorage {
+		t.Fail()
+		t.Logf("Expected %d. Got: %d", http.StatusInsufficientStorage, recorder.Code)
+	}
+}
+
+func TestUpload_RemoveDuringWrite(t *testing.T) {
+	u, _, cleanup := testUploadManager(t)
+	defer cleanup()
+	session, _ := u.Create(AssetBase{Id: "m1"}, 10)
+
+	body, w := io.Pipe()
+	written := make(chan error)
+	go func() {
+		_, err := u.Write(session.Id, 0, body)
+		written <- err
+	}()
+	w.Write([]byte("01234"))
+	removed := make(chan bool)
+	go func() {
+		u.Remove(session.Id)
+		removed <- true
+	}()
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+	<-written
+	<-removed
+
+	if files, _ := ioutil.ReadDir(u.dir); len(files) != 0 {
+		t.Fail()
+		t.Logf("Expected a write in progress not to bring back a removed session. Got: %d files", len(files))
+	}
+	if _, err := u.Write(session.Id, 5, strings.NewReader("56789")); err != errUploadNotFound {
+		t.Fail()
+		t.Logf("Expected writes to a removed session to fail. Got: %v", err)
+	}
+}
+
+func TestHTTP_Upload(t *testing.T) {
+	u, _, cleanup := testUploadManager(t)
+	defer cleanup()
+	h := CreateHTTPService(&mockService{}, u)
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, url, strings.NewReader(body))
+		h.Router().ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := do("POST", "/uploads", "<UploadSession><AssetBase><ID>"+testContentId+"</ID><Type>49</Type></AssetBase><Size>26</Size></UploadSession>")
+	body := recorder.Body.String()
+	start := strings.Index(body, "<ID>") + 4
+	if recorder.Code != 200 || start < 4 {
+		t.Fatalf("Unable to create session: %d %s", recorder.Code, body)
+	}
+	id := body[start : start+32]
+
+	if recorder := do("PUT", "/uploads/"+id+"?offset=0", testFileDataContent[:13]); recorder.Code != 200 {
+		t.Fail()
+		t.Logf("Unexpected response to the first part: %d %s", recorder.Code, recorder.Body)
+	}
+	recorder = do("PUT", "/uploads/"+id+"?offset=20", testFileDataContent[20:])
+	if recorder.Code != http.StatusConflict || !strings.Contains(recorder.Body.String(), "<Received>13</Received>") {
+		t.Fail()
+		t.Logf("Expected a gap to report the progress. Got: %d %s", recorder.Code, recorder.Body)
+	}
+	do("PUT", "/uploads/"+id+"?offset=13", testFileDataContent[13:])
+	if recorder := do("POST", "/uploads/"+id+"/finalize?sha256="+makeHash([]byte("other")), ""); recorder.Code != http.StatusUnprocessableEntity {
+		t.Fail()
+		t.Logf("Expected a hash mismatch to be refused. Got: %d", recorder.Code)
+	}
+	recorder = do("POST", "/uploads/"+id+"/finalize?sha256="+testFileDataContentHash, "")
+	if recorder.Code != 200 || !strings.Contains(recorder.Body.String(), testContentId) {
+		t.Fail()
+		t.Logf("Expected the asset to be created. Got: %d %s", recorder.Code, recorder.Body)
+	}
+	if recorder := do("GET", "/uploads/"+id, ""); recorder.Code != http.StatusNotFound {
+		t.Fail()
+		t.Logf("Expected the finalized session to be removed. Got: %d", recorder.Code)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+var ErrBlobCorrupt = errors.New("blob content does not match its hash")
+
+// verifyStore checks that the content read from the store hashes to the
+// requested hash. Blobs up to bufferSize bytes are read and checked before
+// the first byte is handed out, larger ones are checked while streaming and
+// fail at the end. Corrupt blobs are moved to the quarantine directory.
+type verifyStore struct {
+	AssetStore
+	bufferSize    int
+	quarantineDir string
+	mu            sync.Mutex
+}
+
+func CreateVerifyStore(store AssetStore, bufferSize int, quarantineDir string) *verifyStore {
+	return &verifyStore{
+		AssetStore:    store,
+		bufferSize:    bufferSize,
+		quarantineDir: quarantineDir,
+	}
+}
+
+func (v *verifyStore) Load(hash string) (io.ReadCloser, error) {
+	reader, err := v.AssetStore.Load(hash)
+	if err != nil {
+		// Decoders that check a header fail when they are opened
+		if isCorruption(err) {
+			return nil, v.corrupt(hash)
+		}
+		return nil, err
+	}
+	statAdd("verify.reads", 1)
+	hasher := sha256.New()
+	head, err := ioutil.ReadAll(io.LimitReader(io.TeeReader(reader, hasher), int64(v.bufferSize)+1))
+	if err != nil {
+		reader.Close()
+		if isCorruption(err) {
+			return nil, v.corrupt(hash)
+		}
+		return nil, err
+	}
+	if len(head) <= v.bufferSize {
+		reader.Close()
+		if err := v.check(hash, hasher); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(head)), nil
+	}
+	return &verifyReader{
+		store:  v,
+		hash:   hash,
+		hasher: hasher,
+		head:   head,
+		rest:   reader,
+	}, nil
+}
+
+func (v *verifyStore) GetAsBase64(hash string) (string, error) {
+	return loadAsBase64(v, hash)
+}
+
+// check compares the hash of everything read with the expected one and
+// quarantines the blob on a mismatch.
+func (v *verifyStore) check(expected string, hasher hash.Hash) error {
+	if strings.ToUpper(hex.EncodeToString(hasher.Sum(nil))) == expected {
+		return nil
+	}
+	return v.corrupt(expected)
+}
+
+// corrupt records and quarantines a corrupt blob and returns ErrBlobCorrupt.
+func (v *verifyStore) corrupt(hash string) error {
+	statAdd("verify.corrupt", 1)
+	log.Printf("Blob %v is corrupt, moving it to quarantine\n", hash)
+	v.mu.Lock()
+	moved, err := quarantineBlob(v.AssetStore, hash, v.quarantineDir)
+	v.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to quarantine blob %v: %v\n", hash, err)
+	}
+	statAdd("verify.quarantined", int64(moved))
+	return ErrBlobCorrupt
+}
+
+// isCorruption reports whether err shows the stored data is damaged rather
+// than that it could not be read. A decoder running out of data means the
+// blob was truncated.
+func isCorruption(err error) bool {
+	for _, corrupt := range []error{ErrBlobCorrupt, ErrBlobAuthentication, gzip.ErrChecksum, gzip.ErrHeader, snappy.ErrCorrupt, io.ErrUnexpectedEOF} {
+		if errors.Is(err, corrupt) {
+			return true
+		}
+	}
+	var flateErr flate.CorruptInputError
+	return errors.As(err, &flateErr)
+}
+
+type verifyReader struct {
+	store  *verifyStore
+	hash   string
+	hasher hash.Hash
+	head   []byte
+	rest   io.ReadCloser
+}
+
+func (r *verifyReader) Read(p []byte) (int, error) {
+	if len(r.head) > 0 {
+		n := copy(p, r.head)
+		r.head = r.head[n:]
+		return n, nil
+	}
+	n, err := r.rest.Read(p)
+	r.hasher.Write(p[:n])
+	if isCorruption(err) {
+		return n, r.store.corrupt(r.hash)
+	}
+	if err == io.EOF {
+		if cerr := r.store.check(r.hash, r.hasher); cerr != nil {
+			return n, cerr
+		}
+	}
+	return n, err
+}
+
+func (r *verifyReader) Close() error {
+	return r.rest.Close()
+}
+
+// quarantineBlob moves everything store keeps for hash to dir and returns
+// the number of files moved there. For a chunked blob only the chunks that
+// do not match their own hash are taken out, the others may be shared.
+func quarantineBlob(store AssetStore, hash, dir string) (moved int, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	switch s := store.(type) {
+	case *verifyStore:
+		return quarantineBlob(s.AssetStore, hash, dir)
+	case *chunkStore:
+		_, chunks, err := readManifest(s.manifestPath(hash))
+		if os.IsNotExist(err) {
+			return quarantineBlob(s.inner, hash, dir)
+		}
+		if err != nil {
+			return 0, err
+		}
+		for _, chunk := range chunks {
+			if verifyBlob(s.inner, chunk.hash) == ErrBlobCorrupt {
+				n, err := quarantineBlob(s.inner, chunk.hash, dir)
+				if err != nil {
+					return moved, err
+				}
+				moved += n
+			}
+		}
+		return moved, nil
+	case *packStore:
+		s.mu.RLock()
+		entry, found := s.index[hash]
+		var payload []byte
+		if found {
+			payload = make([]byte, entry.length)
+			_, err = s.segments[entry.segment].f.ReadAt(payload, entry.offset)
+		}
+		s.mu.RUnlock()
+		if !found {
+			return quarantineBlob(s.large, hash, dir)
+		}
+		if err != nil {
+			return
+		}
+		if err = ioutil.WriteFile(path.Join(dir, hash+"."+formatSnappy), payload, 0600); err != nil {
+			return
+		}
+		return 1, s.Delete(hash)
+	}
+
+	disks := localDisks(store)
+	if disks == nil {
+		return 0, fmt.Errorf("quarantine is not supported by this store backend")
+	}
+	for _, disk := range disks {
+		p, found := disk.findOwn(hash)
+		if !found {
+			continue
+		}
+		if _, err = quarantineFile(p, dir); err != nil {
+			return
+		}
+		moved++
+	}
+	return
+}
+
+// quarantineFile moves the blob file p to dir and returns its new path.
+func quarantineFile(p, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	dst := path.Join(dir, path.Base(p))
+	return dst, commitFile(p, dst)
+}
+
+// verifyBlob reads the blob for hash from store and reports ErrBlobCorrupt
+// if its content does not match.
+func verifyBlob(store AssetStore, hash string) error {
+	reader, err := store.Load(hash)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		if isCorruption(err) {
+			return ErrBlobCorrupt
+		}
+		return err
+	}
+	if strings.ToUpper(hex.EncodeToString(hasher.Sum(nil))) != hash {
+		return ErrBlobCorrupt
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+// corruptBlob replaces the content of the blob file for hash by data,
+// encoded the way the store encodes blobs.
+func corruptBlob(t *testing.T, store *assetStore, hash string, data []byte) {
+	p, found := store.findOwn(hash)
+	if !found {
+		t.Fatalf("Blob %v not found", hash)
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatalf("Unable to open blob: %v", err)
+	}
+	defer f.Close()
+	if err := encodeBlob(f, data, blobFormat(p) == formatSnappy, nil); err != nil {
+		t.Fatalf("Unable to write blob: %v", err)
+	}
+}
+
+func TestVerify_Intact(t *testing.T) {
+	inner, cleanup := testSpoolStore(t)
+	defer cleanup()
+	store := CreateVerifyStore(inner, 16, path.Join(path.Dir(inner.dataDir), "quarantine"))
+
+	for _, content := range []string{"short", strings.Repeat("long texture ", 100)} {
+		hash, _ := inner.Store(base64Of(content))
+		data, err := store.GetAsBase64(hash)
+		if err != nil || data != base64Of(content) {
+			t.Fail()
+			t.Logf("Expected intact blob to be read. Got: %v", err)
+		}
+	}
+}
+
+func TestVerify_SmallCorrupt(t *testing.T) {
+	inner, cleanup := testSpoolStore(t)
+	defer cleanup()
+	quarantine := path.Join(path.Dir(inner.dataDir), "quarantine")
+	store := CreateVerifyStore(inner, 1<<10, quarantine)
+
+	hash, _ := inner.Store(base64Of("a notecard"))
+	corruptBlob(t, inner, hash, []byte("a notecarb"))
+
+	if _, err := store.Load(hash); err != ErrBlobCorrupt {
+		t.Fail()
+		t.Logf("Expected corrupt blob to fail before the first byte. Got: %v", err)
+	}
+	if inner.Exists(hash) {
+		t.Fail()
+		t.Log("Expected corrupt blob to be taken out of the store")
+	}
+	if files, _ := ioutil.ReadDir(quarantine); len(files) != 1 || !strings.HasPrefix(files[0].Name(), hash) {
+		t.Fail()
+		t.Logf("Expected corrupt blob in quarantine. Got: %v", files)
+	}
+}
+
+func TestVerify_StreamCorrupt(t *testing.T) {
+	inner, cleanup := testSpoolStore(t)
+	defer cleanup()
+	store := CreateVerifyStore(inner, 16, path.Join(path.Dir(inner.dataDir), "quarantine"))
+
+	content := strings.Repeat("a mesh ", 100)
+	hash, _ := inner.Store(base64Of(content))
+	corruptBlob(t, inner, hash, []byte(strings.Replace(content, "mesh", "mash", 1)))
+
+	reader, err := store.Load(hash)
+	if err != nil {
+		t.Fatalf("Expected large blob to start streaming. Got: %v", err)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != ErrBlobCorrupt {
+		t.Fail()
+		t.Logf("Expected read to fail at the end. Got: %v", err)
+	}
+	if len(data) != len(content) {
+		t.Fail()
+		t.Logf("Expected all %d bytes before the failure. Got: %d", len(content), len(data))
+	}
+	if inner.Exists(hash) {
+		t.Fail()
+		t.Log("Expected corrupt blob to be taken out of the store")
+	}
+}
+
+func TestVerify_CorruptChunk(t *testing.T) {
+	chunks, cleanup := testChunkStore(t)
+	defer cleanup()
+	inner := chunks.inner.(*assetStore)
+	quarantine := path.Join(path.Dir(inner.dataDir), "quarantine")
+	store := CreateVerifyStore(chunks, 1<<20, quarantine)
+
+	data := randomBytes(4, 64<<10)
+	hash, _ := chunks.Store(base64.StdEncoding.EncodeToString(data))
+	_, list, err := readManifest(chunks.manifestPath(hash))
+	if err != nil {
+		t.Fatalf("Unable to read manifest: %v", err)
+	}
+	corruptBlob(t, inner, list[1].hash, randomBytes(5, int(list[1].size)))
+
+	if _, err := store.Load(hash); err != ErrBlobCorrupt {
+		t.Fail()
+		t.Logf("Expected blob with a corrupt chunk to fail. Got: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(quarantine); len(files) != 1 || !strings.HasPrefix(files[0].Name(), list[1].hash) {
+		t.Fail()
+		t.Logf("Expected only the corrupt chunk in quarantine. Got: %v", files)
+	}
+	if !inner.Exists(list[0].hash) {
+		t.Fail()
+		t.Log("Expected intact chunks to stay in the store")
+	}
+}
+
+func TestVerify_IsCorruption(t *testing.T) {
+	for _, err := range []error{flate.CorruptInputError(12), fmt.Errorf("read chunk: %w", io.ErrUnexpectedEOF), snappy.ErrCorrupt, gzip.ErrChecksum} {
+		if !isCorruption(err) {
+			t.Fail()
+			t.Logf("Expected %v to be corruption", err)
+		}
+	}
+	for _, err := range []error{os.ErrPermission, io.EOF} {
+		if isCorruption(err) {
+			t.Fail()
+			t.Logf("Expected %v not to be corruption", err)
+		}
+	}
+}
+
+func TestVerify_TruncatedGzip(t *testing.T) {
+	store, cleanup := testSpoolStore(t)
+	defer cleanup()
+
+	data := []byte(strings.Repeat("an old gzip texture ", 200))
+	hash := makeHash(data)
+	var buf bytes.Buffer
+	encodeBlob(&buf, data, false, nil)
+	p := store.makePath(hash) + ".gz"
+	os.MkdirAll(path.Dir(p), 0755)
+	if err := ioutil.WriteFile(p, buf.Bytes()[:buf.Len()/2], 0644); err != nil {
+		t.Fatalf("Unable to write blob: %v", err)
+	}
+	if err := verifyBlob(store, hash); err != ErrBlobCorrupt {
+		t.Fail()
+		t.Logf("Expected a truncated gzip blob to be corrupt. Got: %v", err)
+	}
+}
+
+func TestVerify_CorruptHeader(t *testing.T) {
+	inner, cleanup := testSpoolStore(t)
+	defer cleanup()
+	quarantine := path.Join(path.Dir(inner.dataDir), "quarantine")
+	store := CreateVerifyStore(inner, 1<<10, quarantine)
+
+	data := []byte("an old gzip notecard")
+	hash := makeHash(data)
+	p := inner.makePath(hash) + ".gz"
+	os.MkdirAll(path.Dir(p), 0755)
+	if err := ioutil.WriteFile(p, []byte("not gzip at all"), 0644); err != nil {
+		t.Fatalf("Unable to write blob: %v", err)
+	}
+	if _, err := store.Load(hash); err != ErrBlobCorrupt {
+		t.Fail()
+		t.Logf("Expected a blob with a corrupt header to be corrupt. Got: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(quarantine); len(files) != 1 || !strings.HasPrefix(files[0].Name(), hash) {
+		t.Fail()
+		t.Logf("Expected the blob in quarantine. Got: %v", files)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Threshold is a free space limit given either as percentage of the total
+// or as an absolute amount. The zero value disables the limit.
+type Threshold struct {
+	Percent  float64
+	Absolute uint64
+}
+
+var sizeSuffixes = map[string]uint64{
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// ParseThreshold accepts values like "5%", "512M", "20G" or "100000".
+func ParseThreshold(s string) (Threshold, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if strings.HasSuffix(s, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "%")), 64)
+		if err != nil {
+			return Threshold{}, err
+		}
+		if p < 0 || p > 100 {
+			return Threshold{}, strconv.ErrRange
+		}
+		return Threshold{Percent: p}, nil
+	}
+	s = strings.TrimSuffix(s, "B")
+	multiplier := uint64(1)
+	if len(s) > 0 {
+		if m, ok := sizeSuffixes[s[len(s)-1:]]; ok {
+			multiplier = m
+			s = s[:len(s)-1]
+		}
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return Threshold{}, err
+	}
+	return Threshold{Absolute: v * multiplier}, nil
+}
+
+func (t Threshold) String() string {
+	if t.Percent > 0 {
+		return strconv.FormatFloat(t.Percent, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatUint(t.Absolute, 10)
+}
+
+func (t *Threshold) Set(s string) error {
+	v, err := ParseThreshold(s)
+	if err == nil {
+		*t = v
+	}
+	return err
+}
+
+func (t Threshold) limit(total uint64) uint64 {
+	if t.Percent > 0 {
+		return uint64(float64(total) * t.Percent / 100)
+	}
+	return t.Absolute
+}
+
+type Watermarks struct {
+	LowSpace       Threshold
+	CriticalSpace  Threshold
+	LowInodes      Threshold
+	CriticalInodes Threshold
+}
+
+type spaceLevel int
+
+const (
+	spaceOK spaceLevel = iota
+	spaceLow
+	spaceCritical
+)
+
+func (l spaceLevel) String() string {
+	switch l {
+	case spaceLow:
+		return "low"
+	case spaceCritical:
+		return "critical"
+	}
+	return "ok"
+}
+
+func (w Watermarks) level(usage DiskUsage) spaceLevel {
+	below := func(free, total uint64, t Threshold) bool {
+		// File systems without inode limits report zero inodes
+		return total > 0 && free < t.limit(total)
+	}
+	if below(usage.FreeBytes, usage.TotalBytes, w.CriticalSpace) ||
+		below(usage.FreeInodes, usage.TotalInodes, w.CriticalInodes) {
+		return spaceCritical
+	}
+	if below(usage.FreeBytes, usage.TotalBytes, w.LowSpace) ||
+		below(usage.FreeInodes, usage.TotalInodes, w.LowInodes) {
+		return spaceLow
+	}
+	return spaceOK
+}
+
+// spaceMonitor watches the free space of the store directories and switches
+// the server into read-only mode while any of them is critically full.
+type spaceMonitor struct {
+	dirs  map[string]string
+	marks Watermarks
+	// pooled directories only make the server read-only once all of them
+	// are critically full, new blobs are placed on the others until then.
+	pooled   map[string]bool
+	usage    func(dir string) (DiskUsage, error)
+	mu       sync.Mutex
+	levels   map[string]spaceLevel
+	readOnly int32
+}
+
+func createSpaceMonitor(dirs map[string]string, marks Watermarks) *spaceMonitor {
+	return &spaceMonitor{
+		dirs:   dirs,
+		marks:  marks,
+		pooled: map[string]bool{},
+		usage:  diskUsage,
+		levels: map[string]spaceLevel{},
+	}
+}
+
+// Level returns the free space level of the directory name at the last check.
+func (m *spaceMonitor) Level(name string) spaceLevel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.levels[name]
+}
+
+// ReadOnly reports whether new assets must be rejected.
+func (m *spaceMonitor) ReadOnly() bool {
+	return atomic.LoadInt32(&m.readOnly) == 1
+}
+
+// Check samples all directories once and updates the read-only state.
+func (m *spaceMonitor) Check() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.dirs))
+	for name := range m.dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	critical := false
+	pooled, pooledCritical := 0, 0
+	for _, name := range names {
+		usage, err := m.usage(m.dirs[name])
+		if err != nil {
+			log.Printf("Unable to check free space of %v (%v): %v\n", name, m.dirs[name], err)
+			continue
+		}
+		level := m.marks.level(usage)
+		statSet("storage."+name+".free_bytes", int64(usage.FreeBytes))
+		statSet("storage."+name+".free_inodes", int64(usage.FreeInodes))
+		statSet("storage."+name+".level", int64(level))
+
+		if level != m.levels[name] {
+			log.Printf("Free space on %v (%v) is %v: %d bytes and %d inodes left\n",
+				name, m.dirs[name], level, usage.FreeBytes, usage.FreeInodes)
+			m.levels[name] = level
+		}
+		if m.pooled[name] {
+			pooled++
+			if level == spaceCritical {
+				pooledCritical++
+			}
+		} else if level == spaceCritical {
+			critical = true
+		}
+	}
+	if pooled > 0 && pooledCritical == pooled {
+		critical = true
+	}
+
+	if critical && atomic.SwapInt32(&m.readOnly, 1) == 0 {
+		log.Printf("Storage critically full, switching to read-only mode\n")
+	} else if !critical && atomic.SwapInt32(&m.readOnly, 0) == 1 {
+		log.Printf("Storage recovered, leaving read-only mode\n")
+	}
+	statSet("storage.readonly", int64(atomic.LoadInt32(&m.readOnly)))
+}
+
+// Run checks the free space every interval until stop is closed.
+func (m *spaceMonitor) Run(interval time.Duration, stop <-chan struct{}) {
+	every(interval, stop, m.Check)
+}
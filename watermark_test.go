@@ -0,0 +1,136 @@
+// Copyright (c) 2015-2018 Cinderblocks Design Co.
+//
+// This file is part of snapper
+// (see https://bitbucket.org/cinderblocks/snapper).
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestWatermark_ParseThreshold(t *testing.T) {
+	cases := map[string]Threshold{
+		"5%":     {Percent: 5},
+		"12.5 %": {Percent: 12.5},
+		"100":    {Absolute: 100},
+		"512M":   {Absolute: 512 << 20},
+		"20GB":   {Absolute: 20 << 30},
+		"1t":     {Absolute: 1 << 40},
+	}
+	for in, expected := range cases {
+		result, err := ParseThreshold(in)
+		if err != nil || result != expected {
+			t.Fail()
+			t.Logf("ParseThreshold(%q) Expected: %+v Got: %+v (%v)", in, expected, result, err)
+		}
+	}
+	for _, in := range []string{"", "abc", "101%", "-1%", "12X"} {
+		if _, err := ParseThreshold(in); err == nil {
+			t.Fail()
+			t.Logf("Expected ParseThreshold(%q) to fail", in)
+		}
+	}
+}
+
+func TestWatermark_level(t *testing.T) {
+	marks := Watermarks{
+		LowSpace:       Threshold{Percent: 10},
+		CriticalSpace:  Threshold{Absolute: 100},
+		LowInodes:      Threshold{Percent: 10},
+		CriticalInodes: Threshold{Percent: 1},
+	}
+	cases := []struct {
+		usage    DiskUsage
+		expected spaceLevel
+	}{
+		{DiskUsage{FreeBytes: 500, TotalBytes: 1000, FreeInodes: 500, TotalInodes: 1000}, spaceOK},
+		{DiskUsage{FreeBytes: 50, TotalBytes: 1000, FreeInodes: 500, TotalInodes: 1000}, spaceCritical},
+		{DiskUsage{FreeBytes: 500, TotalBytes: 10000, FreeInodes: 500, TotalInodes: 1000}, spaceLow},
+		{DiskUsage{FreeBytes: 500, TotalBytes: 1000, FreeInodes: 50, TotalInodes: 1000}, spaceLow},
+		{DiskUsage{FreeBytes: 500, TotalBytes: 1000, FreeInodes: 5, TotalInodes: 1000}, spaceCritical},
+		{DiskUsage{FreeBytes: 500, TotalBytes: 1000, FreeInodes: 0, TotalInodes: 0}, spaceOK},
+	}
+	for _, c := range cases {
+		if result := marks.level(c.usage); result != c.expected {
+			t.Fail()
+			t.Logf("Usage %+v Expected: %v Got: %v", c.usage, c.expected, result)
+		}
+	}
+}
+
+func TestWatermark_MonitorReadOnly(t *testing.T) {
+	free := uint64(500)
+	m := createSpaceMonitor(map[string]string{"datastore": "data", "spoolstore": "tmp"}, Watermarks{
+		LowSpace:      Threshold{Percent: 10},
+		CriticalSpace: Threshold{Percent: 2},
+	})
+	m.usage = func(dir string) (DiskUsage, error) {
+		if dir == "tmp" {
+			return DiskUsage{FreeBytes: 1000, TotalBytes: 1000}, nil
+		}
+		return DiskUsage{FreeBytes: free, TotalBytes: 1000}, nil
+	}
+
+	m.Check()
+	if m.ReadOnly() {
+		t.Fail()
+		t.Log("Expected monitor to be writable with enough free space")
+	}
+	free = 10
+	m.Check()
+	if !m.ReadOnly() {
+		t.Fail()
+		t.Log("Expected monitor to switch to read-only below the critical watermark")
+	}
+	if m.levels["datastore"] != spaceCritical || m.levels["spoolstore"] != spaceOK {
+		t.Fail()
+		t.Logf("Unexpected levels: %v", m.levels)
+	}
+	free = 50
+	m.Check()
+	if m.ReadOnly() {
+		t.Fail()
+		t.Log("Expected monitor to recover once space is freed")
+	}
+	if m.levels["datastore"] != spaceLow {
+		t.Fail()
+		t.Logf("Expected datastore to be low. Got: %v", m.levels["datastore"])
+	}
+}
+
+func TestWatermark_MonitorPooled(t *testing.T) {
+	free := map[string]uint64{"disk0": 10, "disk1": 500, "tmp": 1000}
+	m := createSpaceMonitor(map[string]string{"datastore0": "disk0", "datastore1": "disk1", "spoolstore": "tmp"}, Watermarks{
+		CriticalSpace: Threshold{Percent: 2},
+	})
+	m.pooled["datastore0"], m.pooled["datastore1"] = true, true
+	m.usage = func(dir string) (DiskUsage, error) {
+		return DiskUsage{FreeBytes: free[dir], TotalBytes: 1000}, nil
+	}
+
+	m.Check()
+	if m.ReadOnly() || m.Level("datastore0") != spaceCritical {
+		t.Fail()
+		t.Logf("Expected one full disk of a pool to keep the server writable. Levels: %v", m.levels)
+	}
+	free["disk1"] = 10
+	m.Check()
+	if !m.ReadOnly() {
+		t.Fail()
+		t.Log("Expected monitor to switch to read-only once all pooled disks are full")
+	}
+}